@@ -0,0 +1,76 @@
+package fsfuse
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+)
+
+// Appender is implemented by backend files which can atomically append data
+// at their current end, such as objects of stores with an append operation.
+//
+// Writes to handles opened with O_APPEND go to the current end of the file
+// on the backend rather than to the offset given by the kernel, which may be
+// stale when other clients extend the file. They use Append if the backend
+// file implements it, and otherwise seek to the end before writing, or write
+// at the size reported by Stat. Such handles bypass the page cache, which
+// would otherwise keep the data at the offset the kernel gave.
+type Appender interface {
+	// Append writes p at the end of the file.
+	Append(p []byte) (n int, err error)
+}
+
+// writeAppend writes data at the current end of the backend file.
+// fh.mu must be held.
+func (fh *fileHandle) writeAppend(ctx context.Context, data []byte) (uint32, syscall.Errno) {
+	if a, ok := fh.f.(Appender); ok {
+		n, err := a.Append(data)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			if err != nil {
+				return uint32(n), fh.fail(ctx, "Write", "Append failed", err)
+			}
+			return uint32(n), 0
+		}
+	}
+
+	w, ok := fh.f.(io.Writer)
+	if !ok {
+		return 0, fh.fail(ctx, "Write", "Append failed", errors.ErrUnsupported)
+	}
+	if s, ok := fh.f.(io.Seeker); ok {
+		_, err := s.Seek(0, io.SeekEnd)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			if err != nil {
+				return 0, fh.fail(ctx, "Write", "Seek to end failed", err)
+			}
+			n, err := w.Write(data)
+			if err != nil {
+				return uint32(n), fh.fail(ctx, "Write", "Write failed after seek to end", err)
+			}
+			return uint32(n), 0
+		}
+	}
+	if wa, ok := fh.f.(io.WriterAt); ok && !fh.noWriteAt.Load() {
+		fi, err := fh.f.Stat()
+		if err != nil {
+			return 0, fh.fail(ctx, "Write", "Append: stat failed", err)
+		}
+		n, err := wa.WriteAt(data, fi.Size())
+		if !errors.Is(err, errors.ErrUnsupported) {
+			if err != nil {
+				return uint32(n), fh.fail(ctx, "Write", "WriteAt failed", err, "offset", fi.Size())
+			}
+			return uint32(n), 0
+		}
+		fh.noWriteAt.Store(true)
+	}
+
+	// Streams are written at their end.
+	n, err := w.Write(data)
+	fh.offset += int64(n)
+	if err != nil {
+		return uint32(n), fh.fail(ctx, "Write", "Write failed", err)
+	}
+	return uint32(n), 0
+}
@@ -0,0 +1,73 @@
+package fsfuse
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gwangyi/fsx/contextual"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// AtimePolicy decides when reads through the mount update the access time of
+// files on the backend, following the mount options of the same names.
+//
+// Updates are batched: a file handle which has been read from updates the
+// access time once, when it is released, rather than on every read.
+type AtimePolicy int
+
+const (
+	// RelAtime updates the access time only if it is not newer than the
+	// modification or change time, or is more than a day old. It is the
+	// zero AtimePolicy, as the recommended policy when access times matter.
+	RelAtime AtimePolicy = iota
+	// StrictAtime updates the access time whenever a handle which has been
+	// read from is released, regardless of the other times.
+	StrictAtime
+	// NoAtime never updates access times. This is the default without
+	// Atime.
+	NoAtime
+)
+
+// relatimeInterval is the age after which RelAtime updates an access time
+// regardless of the other times, as Linux does.
+const relatimeInterval = 24 * time.Hour
+
+// Atime enables updating access times on reads with the policy p. The zero
+// AtimePolicy is RelAtime, so relatime semantics apply unless another policy
+// is given. Without Atime, access times are never updated.
+func Atime(p AtimePolicy) Option {
+	return func(c *config) {
+		c.atime = p
+	}
+}
+
+// touchAtime updates the access time of n after it has been read from,
+// according to the AtimePolicy. Failures are logged and otherwise ignored, as
+// access times are advisory.
+func (n *node) touchAtime(ctx context.Context) {
+	if n.cfg.atime == NoAtime || n.cfg.readOnly {
+		return
+	}
+	fi, err := contextual.Lstat(ctx, n.fsys, n.path)
+	if err != nil {
+		n.fail(ctx, "Release", "Atime update: lstat failed", err, "path", n.path)
+		return
+	}
+
+	// statToAttr knows best where to find the times of fi.
+	var attr fuse.Attr
+	statToAttr(fi, &attr)
+	atime := time.Unix(int64(attr.Atime), int64(attr.Atimensec))
+	mtime := time.Unix(int64(attr.Mtime), int64(attr.Mtimensec))
+	ctime := time.Unix(int64(attr.Ctime), int64(attr.Ctimensec))
+	now := time.Now()
+	if n.cfg.atime == RelAtime && atime.After(mtime) && atime.After(ctime) && now.Sub(atime) < relatimeInterval {
+		return
+	}
+
+	err = contextual.Chtimes(ctx, n.fsys, n.path, now, fi.ModTime())
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		n.fail(ctx, "Release", "Atime update failed", err, "path", n.path)
+	}
+}
@@ -0,0 +1,99 @@
+package fsfuse
+
+import (
+	"context"
+	"io/fs"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// writeFlags are the open(2) flags which require a writable filesystem.
+const writeFlags = syscall.O_WRONLY | syscall.O_RDWR | syscall.O_TRUNC
+
+// ReadOnly makes the mount read-only. Operations modifying it fail with
+// EROFS, access times are not updated, and Mount mounts it read-only.
+func ReadOnly() Option {
+	return func(c *config) {
+		c.readOnly = true
+	}
+}
+
+// MapOwners changes the owner and group presented for files.
+// The mappers receive the context of the request and the UID or GID found on
+// the backend, in decimal, and return a user or group name or ID. An empty
+// result keeps the original value. Either mapper may be nil.
+// MirrorOwner and MirrorGroup present files as owned by the caller.
+func MapOwners(owner, group func(ctx context.Context, id string) string) Option {
+	return func(c *config) {
+		c.ownerMapper = owner
+		c.groupMapper = group
+	}
+}
+
+// PermissionMasks clears the permission bits in fmask from files and those in
+// dmask from directories, like the fmask and dmask mount options of other
+// filesystems do.
+func PermissionMasks(fmask, dmask fs.FileMode) Option {
+	return func(c *config) {
+		c.fmask = fmask & fs.ModePerm
+		c.dmask = dmask & fs.ModePerm
+	}
+}
+
+// fillAttr converts fi into the FUSE attributes presented for n, applying
+// the owner mappers and permission masks.
+func (n *node) fillAttr(ctx context.Context, fi fs.FileInfo, out *fuse.Attr) {
+	statToAttr(fi, out)
+
+	if m := n.cfg.ownerMapper; m != nil {
+		if uid, ok := lookupUID(m(ctx, strconv.FormatUint(uint64(out.Uid), 10))); ok {
+			out.Uid = uid
+		}
+	}
+	if m := n.cfg.groupMapper; m != nil {
+		if gid, ok := lookupGID(m(ctx, strconv.FormatUint(uint64(out.Gid), 10))); ok {
+			out.Gid = gid
+		}
+	}
+
+	mask := n.cfg.fmask
+	if fi.IsDir() {
+		mask = n.cfg.dmask
+	}
+	out.Mode &^= uint32(mask)
+}
+
+// lookupUID resolves a user name or numeric ID into a UID.
+func lookupUID(name string) (uint32, bool) {
+	if name == "" {
+		return 0, false
+	}
+	if uid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(uid), true
+	}
+	if u, err := user.Lookup(name); err == nil {
+		if uid, err := strconv.ParseUint(u.Uid, 10, 32); err == nil {
+			return uint32(uid), true
+		}
+	}
+	return 0, false
+}
+
+// lookupGID resolves a group name or numeric ID into a GID.
+func lookupGID(name string) (uint32, bool) {
+	if name == "" {
+		return 0, false
+	}
+	if gid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(gid), true
+	}
+	if g, err := user.LookupGroup(name); err == nil {
+		if gid, err := strconv.ParseUint(g.Gid, 10, 32); err == nil {
+			return uint32(gid), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,66 @@
+package fsfuse
+
+import (
+	"context"
+	"io/fs"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// cacheState remembers the attributes a file had when it was last opened.
+// The kernel page cache is only kept across opens if they are unchanged,
+// so that modifications made directly on the backend (e.g. by other hosts
+// sharing it) become visible.
+type cacheState struct {
+	mu    sync.Mutex
+	valid bool
+	size  int64
+	mtime time.Time
+}
+
+// update records the attributes of a newly opened file and reports whether
+// they match the ones recorded by the previous open.
+// A nil fi invalidates the recorded state.
+func (s *cacheState) update(fi fs.FileInfo) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fi == nil {
+		s.valid = false
+		return false
+	}
+	unchanged := s.valid && s.size == fi.Size() && s.mtime.Equal(fi.ModTime())
+	s.valid = true
+	s.size = fi.Size()
+	s.mtime = fi.ModTime()
+	return unchanged
+}
+
+// openFlags computes the FOPEN_* flags for a file opened with the given
+// open(2) flags.
+//
+// Files opened with O_DIRECT or matching one of the DirectIO patterns bypass
+// the page cache, as do files opened with O_APPEND: their writes land at the
+// end of the backend file rather than at the offset the kernel would cache
+// them at. Otherwise the cache is kept only if the file has not
+// changed since the previous open. fresh indicates that the file was just
+// created, in which case there is nothing stale to drop.
+// The configured CachePolicy, if any, has the final say.
+func (n *node) openFlags(ctx context.Context, flags uint32, fi fs.FileInfo, fresh bool) uint32 {
+	var out uint32
+	unchanged := n.cache.update(fi)
+	name := n.cfg.mountPath(n.path)
+	switch {
+	case flags&(syscall.O_DIRECT|syscall.O_APPEND) != 0 || matchPath(n.cfg.directIO, name):
+		out = fuse.FOPEN_DIRECT_IO
+	case unchanged || fresh:
+		out = fuse.FOPEN_KEEP_CACHE
+	}
+	if n.cfg.cachePolicy != nil {
+		out = n.cfg.cachePolicy(ctx, name, flags, fi, out)
+	}
+	return out
+}
@@ -0,0 +1,243 @@
+// Command fsfuse mounts fsfuse backends for ad-hoc use and debugging,
+// without writing any code.
+//
+// Usage:
+//
+//	fsfuse mount [flags] <source> <mountpoint>
+//	fsfuse unmount [-lazy] <mountpoint>
+//	fsfuse status [mountpoint]
+//	fsfuse run [-check] <config>
+//
+// The source is a local directory, or "backend:param" for another built-in
+// backend. mount has a flag for every fsfuse option; see fsfuse mount -h.
+// It serves the filesystem in the foreground until interrupted, or in the
+// background with -background. run mounts everything described by a
+// configuration file (see package config) and serves it likewise; -check only
+// validates the file.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gwangyi/fsfuse"
+	"github.com/gwangyi/fsfuse/config"
+	"github.com/gwangyi/fsfuse/internal/cli"
+)
+
+const usage = `usage:
+  fsfuse mount [flags] <source> <mountpoint>
+  fsfuse unmount [-lazy] <mountpoint>
+  fsfuse status [mountpoint]
+  fsfuse run [-check] [-background] <config>
+`
+
+// errUsage is returned for invalid command lines, whose details have already
+// been reported.
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil && !errors.Is(err, flag.ErrHelp) {
+		if !errors.Is(err, errUsage) {
+			fmt.Fprintf(os.Stderr, "fsfuse: %v\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run executes the subcommand given by args.
+func run(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return errUsage
+	}
+	switch args[0] {
+	case "mount":
+		return mount(args[1:], stderr)
+	case "unmount", "umount":
+		return unmount(args[1:], stderr)
+	case "status":
+		return status(args[1:], stdout, stderr)
+	case "run":
+		return runConfig(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return nil
+	}
+	fmt.Fprintf(stderr, "unknown command %q\n%s", args[0], usage)
+	return errUsage
+}
+
+// newFlagSet creates the flag set of a subcommand.
+func newFlagSet(name, args string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: fsfuse %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses args into fs and checks the number of positional
+// arguments. It returns flag.ErrHelp if help was requested.
+func parseFlags(fs *flag.FlagSet, args []string, minArgs, maxArgs int) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() < minArgs || fs.NArg() > maxArgs {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// mount mounts a backend and serves it until it is unmounted.
+func mount(args []string, stderr io.Writer) error {
+	fs := newFlagSet("mount", "<source> <mountpoint>", stderr)
+	var mo cli.MountOptions
+	var lo cli.LogOptions
+	mo.RegisterFlags(fs)
+	lo.RegisterFlags(fs)
+	background := fs.Bool("background", false, "serve in the background once mounted")
+	if err := parseFlags(fs, args, 2, 2); err != nil {
+		return err
+	}
+	source, mountpoint := fs.Arg(0), fs.Arg(1)
+	if mo.FsName == "" {
+		mo.FsName = source
+	}
+
+	if *background && !cli.IsDaemon() {
+		return cli.Daemonize()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	logger := lo.Logger(stderr)
+	m, err := func() (*fsfuse.MountHandle, error) {
+		fsys, err := cli.OpenSource(source)
+		if err != nil {
+			return nil, err
+		}
+		return fsfuse.Mount(ctx, mountpoint, fsys, append(mo.Options(), fsfuse.Logger(logger))...)
+	}()
+	cli.NotifyReady(err)
+	if err != nil {
+		return err
+	}
+	logger.Info("Mounted", "source", source, "mountpoint", mountpoint)
+
+	select {
+	case <-m.Done():
+	case <-ctx.Done():
+		// Let another signal terminate the process if unmounting fails
+		// because the filesystem is busy.
+		stop()
+		logger.Info("Unmounting", "mountpoint", mountpoint)
+		m.Wait()
+	}
+	return nil
+}
+
+// runConfig mounts the filesystems described by a configuration file and
+// serves them until they are all unmounted.
+func runConfig(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("run", "<config>", stderr)
+	var lo cli.LogOptions
+	lo.RegisterFlags(fs)
+	check := fs.Bool("check", false, "validate the configuration without mounting")
+	background := fs.Bool("background", false, "serve in the background once mounted")
+	if err := parseFlags(fs, args, 1, 1); err != nil {
+		return err
+	}
+	c, err := config.LoadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *check {
+		fmt.Fprintf(stdout, "%s: %d mounts ok\n", fs.Arg(0), len(c.Mounts))
+		return nil
+	}
+
+	if *background && !cli.IsDaemon() {
+		return cli.Daemonize()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	logger := lo.Logger(stderr)
+	handles, err := c.Mount(ctx, fsfuse.Logger(logger))
+	cli.NotifyReady(err)
+	if err != nil {
+		return err
+	}
+	for _, h := range handles {
+		logger.Info("Mounted", "mountpoint", h.Mountpoint())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, h := range handles {
+			h.Wait()
+		}
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		stop()
+		logger.Info("Unmounting", "mounts", len(handles))
+		<-done
+	}
+	return nil
+}
+
+// unmount unmounts a filesystem.
+func unmount(args []string, stderr io.Writer) error {
+	fs := newFlagSet("unmount", "<mountpoint>", stderr)
+	lazy := fs.Bool("lazy", false, "detach the filesystem even if it is busy")
+	if err := parseFlags(fs, args, 1, 1); err != nil {
+		return err
+	}
+	return cli.Unmount(fs.Arg(0), *lazy)
+}
+
+// status lists the fsfuse mounts, or the one at the given mountpoint.
+func status(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("status", "[mountpoint]", stderr)
+	if err := parseFlags(fs, args, 0, 1); err != nil {
+		return err
+	}
+	mounts, err := cli.Mounts()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, m := range mounts {
+		if fs.NArg() == 1 && m.Mountpoint != fs.Arg(0) {
+			continue
+		}
+		found = true
+		state := "ok"
+		if cli.Stale(m.Mountpoint) {
+			state = "stale"
+		}
+		fmt.Fprintf(stdout, "%s\t%s\t%s\t%s\n", m.Mountpoint, m.Source, state, m.Options)
+	}
+	if fs.NArg() == 1 && !found {
+		return fmt.Errorf("%s: not an fsfuse mount", fs.Arg(0))
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun_Usage(t *testing.T) {
+	tests := []struct {
+		args []string
+		want error
+	}{
+		{nil, errUsage},
+		{[]string{"frobnicate"}, errUsage},
+		{[]string{"mount", "/src"}, errUsage},
+		{[]string{"mount", "-symlinks", "sideways", "/src", "/mnt"}, errUsage},
+		{[]string{"mount", "-o", "bogus", "/src", "/mnt"}, errUsage},
+		{[]string{"mount", "-h"}, flag.ErrHelp},
+		{[]string{"unmount"}, errUsage},
+		{[]string{"status", "/a", "/b"}, errUsage},
+		{[]string{"run"}, errUsage},
+	}
+
+	for _, tt := range tests {
+		var stdout, stderr strings.Builder
+		if err := run(tt.args, &stdout, &stderr); !errors.Is(err, tt.want) {
+			t.Errorf("run(%q) = %v, want %v", tt.args, err, tt.want)
+		}
+		if stderr.Len() == 0 {
+			t.Errorf("run(%q) printed no usage", tt.args)
+		}
+	}
+}
+
+func TestRun_Help(t *testing.T) {
+	var stdout, stderr strings.Builder
+	if err := run([]string{"help"}, &stdout, &stderr); err != nil {
+		t.Fatalf("run(help) failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "fsfuse mount") {
+		t.Errorf("help = %q, want the usage", stdout.String())
+	}
+}
+
+func TestRun_Status(t *testing.T) {
+	var stdout, stderr strings.Builder
+	err := run([]string{"status", t.TempDir()}, &stdout, &stderr)
+	if err == nil || !strings.Contains(err.Error(), "not an fsfuse mount") {
+		t.Errorf("run(status) = %v, want not an fsfuse mount", err)
+	}
+}
+
+func TestRun_Check(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "fsfuse.json")
+	conf := `{
+  "backends": {"data": {"type": "osfs", "params": {"root": "` + dir + `"}}},
+  "mounts": [{"mountpoint": "/mnt/a", "backend": "data", "options": {"symlinks": "sideways"}}]
+}`
+	if err := os.WriteFile(name, []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr strings.Builder
+	err := run([]string{"run", "-check", name}, &stdout, &stderr)
+	if err == nil || !strings.Contains(err.Error(), "mounts[0].options.symlinks") {
+		t.Errorf("run(run -check) = %v, want an error at mounts[0].options.symlinks", err)
+	}
+}
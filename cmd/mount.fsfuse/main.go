@@ -0,0 +1,29 @@
+// Command mount.fsfuse mounts an fsfuse backend following the conventions of
+// mount(8) helpers, so that fsfuse can be mounted with
+//
+//	mount -t fsfuse /path/to/source /path/to/mountpoint -o ro,allow_other
+//
+// or from /etc/fstab. Mounts are listed in the mount table with the type
+// fuse.fsfuse, which mount(8) serves with mount.fuse.fsfuse instead, as used
+// by systemd mount units. The source is a local directory, or
+// "backend:param" for another backend.
+//
+// Besides the generic mount options, it accepts ro, allow_other,
+// default_permissions, uid=, gid=, fmask=, dmask=, umask=, entry_timeout=,
+// attr_timeout=, negative_timeout= (in seconds), noatime, relatime,
+// strictatime, fsname= and subtree=.
+//
+// The helper returns once the filesystem is mounted, leaving a background
+// process serving it, unless -f is given. Exit codes follow mount(8): 1 for
+// invalid invocations and 32 for mount failures.
+package main
+
+import (
+	"os"
+
+	"github.com/gwangyi/fsfuse/internal/mounthelper"
+)
+
+func main() {
+	os.Exit(mounthelper.Run("mount.fsfuse", os.Args[1:], os.Stderr))
+}
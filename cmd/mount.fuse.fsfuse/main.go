@@ -0,0 +1,19 @@
+// Command mount.fuse.fsfuse is the mount(8) helper for the type fuse.fsfuse,
+// the type fsfuse mounts are listed with in the mount table, so that fsfuse
+// can be mounted with
+//
+//	mount -t fuse.fsfuse /path/to/source /path/to/mountpoint -o ro,allow_other
+//
+// or from /etc/fstab and systemd mount units with the type fuse.fsfuse. It
+// is the same as mount.fsfuse, which serves the type fsfuse.
+package main
+
+import (
+	"os"
+
+	"github.com/gwangyi/fsfuse/internal/mounthelper"
+)
+
+func main() {
+	os.Exit(mounthelper.Run("mount.fuse.fsfuse", os.Args[1:], os.Stderr))
+}
@@ -0,0 +1,24 @@
+package config
+
+import (
+	"encoding/json"
+
+	"github.com/gwangyi/fsfuse/internal/cli"
+	"github.com/gwangyi/fsx/contextual"
+)
+
+// BackendFactory opens a backend from the params of its configuration.
+type BackendFactory func(params json.RawMessage) (contextual.FS, error)
+
+// RegisterBackend makes the backend type name available to configurations.
+// The types are shared with the mount sources of the command-line tools,
+// where the type is given its params as a JSON object, as in
+// name:{"key":"value"}. It panics if name is already registered.
+func RegisterBackend(name string, factory BackendFactory) {
+	cli.RegisterBackend(name, cli.Backend{Open: factory})
+}
+
+// BackendTypes returns the registered backend types.
+func BackendTypes() []string {
+	return cli.Backends()
+}
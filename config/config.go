@@ -0,0 +1,277 @@
+// Package config describes fsfuse mounts declaratively, in JSON files, and
+// turns such descriptions into running mounts.
+//
+// A configuration names the backends to serve, default options, and the
+// mounts, each of which layers its own options over the defaults:
+//
+//	{
+//	  "backends": {
+//	    "data": {"type": "osfs", "params": {"root": "/srv/data"}}
+//	  },
+//	  "defaults": {"read_only": true, "hide": [".git"]},
+//	  "mounts": [
+//	    {"mountpoint": "/mnt/a", "backend": "data", "options": {"subtree": "projects/a"}},
+//	    {"mountpoint": "/mnt/b", "backend": "data", "options": {"subtree": "projects/b", "read_only": false}}
+//	  ]
+//	}
+//
+// Mounts sharing a backend share a single instance of it. Errors found while
+// loading or mounting a configuration are of type *Error and name the
+// offending key.
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gwangyi/fsfuse"
+	"github.com/gwangyi/fsfuse/internal/cli"
+	"github.com/gwangyi/fsx/contextual"
+)
+
+// Config is a set of mounts.
+type Config struct {
+	// Backends are the backends by name.
+	Backends map[string]Backend
+	// Defaults are the options shared by all mounts.
+	Defaults Options
+	// Mounts are the mounts, with their options layered over Defaults.
+	Mounts []Mount
+}
+
+// Backend describes a backend instance.
+type Backend struct {
+	// Type is the name the backend type is registered under.
+	Type string `json:"type"`
+	// Params are passed to the BackendFactory of the type.
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Mount describes a mount.
+type Mount struct {
+	Mountpoint string
+	// Backend is the name of the backend to serve.
+	Backend string
+	// Options are the options of the mount, including the defaults.
+	Options Options
+}
+
+// Error is an error found at a key of a configuration, such as
+// "mounts[1].options.symlinks".
+type Error struct {
+	Key string
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Key == "" {
+		return e.Err.Error()
+	}
+	return e.Key + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// keyError wraps err in an *Error for key, unless it already is one or a
+// *cli.ParamError, in which case key is prepended to its key.
+func keyError(key string, err error) error {
+	var e *Error
+	if errors.As(err, &e) {
+		return &Error{Key: joinKey(key, e.Key), Err: e.Err}
+	}
+	var pe *cli.ParamError
+	if errors.As(err, &pe) {
+		return &Error{Key: joinKey(key, pe.Key), Err: pe.Err}
+	}
+	return &Error{Key: key, Err: err}
+}
+
+// joinKey joins the keys of nested values.
+func joinKey(parent, child string) string {
+	switch {
+	case parent == "":
+		return child
+	case child == "" || strings.HasPrefix(child, "["):
+		return parent + child
+	}
+	return parent + "." + child
+}
+
+// rawConfig is the layout of configuration files.
+type rawConfig struct {
+	Backends map[string]json.RawMessage `json:"backends"`
+	Defaults json.RawMessage            `json:"defaults"`
+	Mounts   []json.RawMessage          `json:"mounts"`
+}
+
+// rawMount is the layout of a mount in configuration files.
+type rawMount struct {
+	Mountpoint string          `json:"mountpoint"`
+	Backend    string          `json:"backend"`
+	Options    json.RawMessage `json:"options"`
+}
+
+// LoadFile reads the configuration file at name.
+func LoadFile(name string) (*Config, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return c, nil
+}
+
+// Load reads a configuration from r.
+func Load(r io.Reader) (*Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses and validates a configuration.
+func Parse(data []byte) (*Config, error) {
+	var raw rawConfig
+	if err := decode(data, &raw); err != nil {
+		return nil, err
+	}
+
+	c := &Config{Backends: make(map[string]Backend, len(raw.Backends))}
+	for _, name := range sortedKeys(raw.Backends) {
+		key := "backends." + name
+		var b Backend
+		if err := decode(raw.Backends[name], &b); err != nil {
+			return nil, keyError(key, err)
+		}
+		if b.Type == "" {
+			return nil, &Error{Key: key + ".type", Err: errors.New("missing backend type")}
+		}
+		if _, ok := cli.LookupBackend(b.Type); !ok {
+			return nil, &Error{Key: key + ".type", Err: fmt.Errorf("unknown backend type %q (known: %s)", b.Type, strings.Join(BackendTypes(), ", "))}
+		}
+		c.Backends[name] = b
+	}
+
+	if err := c.Defaults.decode(raw.Defaults); err != nil {
+		return nil, keyError("defaults", err)
+	}
+	if _, err := c.Defaults.mountOptions(); err != nil {
+		return nil, keyError("defaults", err)
+	}
+
+	mountpoints := make(map[string]string)
+	for i, data := range raw.Mounts {
+		key := fmt.Sprintf("mounts[%d]", i)
+		var rm rawMount
+		if err := decode(data, &rm); err != nil {
+			return nil, keyError(key, err)
+		}
+		if rm.Mountpoint == "" {
+			return nil, &Error{Key: key + ".mountpoint", Err: errors.New("missing mountpoint")}
+		}
+		mountpoint := filepath.Clean(rm.Mountpoint)
+		if other, ok := mountpoints[mountpoint]; ok {
+			return nil, &Error{Key: key + ".mountpoint", Err: fmt.Errorf("%s is already used by %s", rm.Mountpoint, other)}
+		}
+		mountpoints[mountpoint] = key
+		if _, ok := c.Backends[rm.Backend]; !ok {
+			return nil, &Error{Key: key + ".backend", Err: fmt.Errorf("undefined backend %q", rm.Backend)}
+		}
+
+		m := Mount{Mountpoint: rm.Mountpoint, Backend: rm.Backend, Options: c.Defaults.clone()}
+		if err := m.Options.decode(rm.Options); err != nil {
+			return nil, keyError(key+".options", err)
+		}
+		if _, err := m.Options.mountOptions(); err != nil {
+			return nil, keyError(key+".options", err)
+		}
+		c.Mounts = append(c.Mounts, m)
+	}
+	return c, nil
+}
+
+// decode strictly decodes the JSON value data into v, if present.
+// Errors are reported at the key of the offending value, if known.
+func decode(data []byte, v any) error {
+	if len(data) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &typeErr):
+		return &Error{Key: typeErr.Field, Err: fmt.Errorf("cannot use a JSON %s as %s", typeErr.Value, typeErr.Type)}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return &Error{Key: field, Err: errors.New("unknown key")}
+	}
+	return &Error{Err: err}
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Mount opens the backends and mounts every mount of c. opts are applied to
+// every mount before the ones of the configuration, e.g. to set the logger.
+// If a mount fails, the ones already mounted are unmounted.
+// Canceling ctx unmounts all of them.
+func (c *Config) Mount(ctx context.Context, opts ...fsfuse.Option) ([]*fsfuse.MountHandle, error) {
+	fsyss := make(map[string]contextual.FS)
+	var handles []*fsfuse.MountHandle
+	fail := func(err error) ([]*fsfuse.MountHandle, error) {
+		for _, h := range handles {
+			_ = h.Unmount()
+		}
+		return nil, err
+	}
+
+	for i, m := range c.Mounts {
+		key := fmt.Sprintf("mounts[%d]", i)
+		fsys, ok := fsyss[m.Backend]
+		if !ok {
+			b := c.Backends[m.Backend]
+			backend, _ := cli.LookupBackend(b.Type)
+			var err error
+			if fsys, err = backend.Open(b.Params); err != nil {
+				return fail(keyError("backends."+m.Backend+".params", err))
+			}
+			fsyss[m.Backend] = fsys
+		}
+
+		mo, err := m.Options.mountOptions()
+		if err != nil {
+			return fail(keyError(key+".options", err))
+		}
+		h, err := fsfuse.Mount(ctx, m.Mountpoint, fsys, append(opts, mo.Options()...)...)
+		if err != nil {
+			return fail(keyError(key, err))
+		}
+		handles = append(handles, h)
+	}
+	return handles, nil
+}
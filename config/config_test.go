@@ -0,0 +1,164 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gwangyi/fsfuse"
+	"github.com/gwangyi/fsfuse/internal/cli"
+	"github.com/gwangyi/fsx/contextual"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(`{
+  "backends": {"data": {"type": "osfs", "params": {"root": "/srv/data"}}},
+  "defaults": {"read_only": true, "hide": [".git"], "symlinks": "follow", "attr_timeout": "5s"},
+  "mounts": [
+    {"mountpoint": "/mnt/a", "backend": "data", "options": {"subtree": "a"}},
+    {"mountpoint": "/mnt/b", "backend": "data", "options": {"read_only": false, "hide": [".svn"], "case_preserving": false}}
+  ]
+}`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if got := c.Backends["data"].Type; got != "osfs" {
+		t.Errorf("backend type = %q, want osfs", got)
+	}
+	if len(c.Mounts) != 2 {
+		t.Fatalf("got %d mounts, want 2", len(c.Mounts))
+	}
+
+	a, err := c.Mounts[0].Options.mountOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.ReadOnly || a.Subtree != "a" || a.Symlinks != fsfuse.SymlinkFollow || !a.CasePreserving {
+		t.Errorf("mounts[0] options = %+v, want defaults with subtree a", a)
+	}
+	if a.AttrTimeout == nil || *a.AttrTimeout != 5*time.Second {
+		t.Errorf("mounts[0] attr timeout = %v, want 5s", a.AttrTimeout)
+	}
+
+	b, err := c.Mounts[1].Options.mountOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ReadOnly || b.CasePreserving || b.Symlinks != fsfuse.SymlinkFollow {
+		t.Errorf("mounts[1] options = %+v, want writable, case folding, following links", b)
+	}
+	if len(b.Hide) != 1 || b.Hide[0] != ".svn" {
+		t.Errorf("mounts[1] hide = %q, want [.svn]", b.Hide)
+	}
+	if len(c.Defaults.Hide) != 1 || c.Defaults.Hide[0] != ".git" {
+		t.Errorf("defaults hide = %q, want [.git]", c.Defaults.Hide)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	const backends = `"backends": {"data": {"type": "osfs", "params": {"root": "/srv"}}}`
+	tests := []struct {
+		conf string
+		key  string
+	}{
+		{`{"mount": []}`, "mount"},
+		{`{"backends": {"data": {"params": {}}}}`, "backends.data.type"},
+		{`{"backends": {"data": {"type": "ftp"}}}`, "backends.data.type"},
+		{`{"backends": {"data": {"type": "osfs", "root": "/"}}}`, "backends.data.root"},
+		{`{"defaults": {"read_only": "yes"}}`, "defaults.read_only"},
+		{`{"defaults": {"fmask": "999"}}`, "defaults.fmask"},
+		{`{"defaults": {"entry_timeout": "-1s"}}`, "defaults.entry_timeout"},
+		{`{` + backends + `, "mounts": [{"backend": "data"}]}`, "mounts[0].mountpoint"},
+		{`{` + backends + `, "mounts": [{"mountpoint": "/mnt", "backend": "other"}]}`, "mounts[0].backend"},
+		{`{` + backends + `, "mounts": [{"mountpoint": "/mnt", "backend": "data"}, {"mountpoint": "/mnt/", "backend": "data"}]}`, "mounts[1].mountpoint"},
+		{`{` + backends + `, "mounts": [{"mountpoint": "/mnt", "backend": "data", "options": {"symlinks": "sideways"}}]}`, "mounts[0].options.symlinks"},
+		{`{` + backends + `, "mounts": [{"mountpoint": "/mnt", "backend": "data", "options": {"max_name_len": -1}}]}`, "mounts[0].options.max_name_len"},
+		{`{` + backends + `, "mounts": [{"mountpoint": "/mnt", "backend": "data", "options": {"colour": "red"}}]}`, "mounts[0].options.colour"},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.conf))
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Errorf("Parse(%s) = %v, want *Error", tt.conf, err)
+			continue
+		}
+		if e.Key != tt.key {
+			t.Errorf("Parse(%s) failed at %q (%v), want %q", tt.conf, e.Key, err, tt.key)
+		}
+		if !strings.HasPrefix(err.Error(), tt.key+": ") {
+			t.Errorf("Parse(%s) = %q, want the key first", tt.conf, err)
+		}
+	}
+}
+
+func TestParse_Syntax(t *testing.T) {
+	if _, err := Load(strings.NewReader(`{"mounts": [`)); err == nil {
+		t.Error("Load succeeded on truncated JSON")
+	}
+}
+
+// registerTest registers the backend type "test", whose factory fails with
+// its params. The registry is shared by the package, so it is registered once
+// however many times the tests run.
+var registerTest = sync.OnceFunc(func() {
+	RegisterBackend("test", func(params json.RawMessage) (contextual.FS, error) {
+		return nil, fmt.Errorf("params %s", params)
+	})
+})
+
+func TestRegisterBackend(t *testing.T) {
+	registerTest()
+	if !slices.Contains(BackendTypes(), "test") {
+		t.Errorf("BackendTypes() = %v, want test", BackendTypes())
+	}
+
+	c, err := Parse([]byte(`{
+  "backends": {"remote": {"type": "test", "params": {"host": "example"}}},
+  "mounts": [{"mountpoint": "/mnt", "backend": "remote"}]
+}`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	_, err = c.Mount(t.Context())
+	var e *Error
+	if !errors.As(err, &e) || e.Key != "backends.remote.params" {
+		t.Errorf("Mount = %v, want an error at backends.remote.params", err)
+	}
+	if want := `params {"host": "example"}`; e == nil || e.Err.Error() != want {
+		t.Errorf("Mount = %v, want the raw params passed to the factory", err)
+	}
+
+	// Types registered here are mount sources too.
+	if _, err := cli.OpenSource(`test:{"host": "example"}`); err == nil || err.Error() != `params {"host": "example"}` {
+		t.Errorf("OpenSource(test:...) = %v, want the factory to be called", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a type twice did not panic")
+		}
+	}()
+	RegisterBackend("test", nil)
+}
+
+func TestMount_OSFSRoot(t *testing.T) {
+	c, err := Parse([]byte(`{
+  "backends": {"data": {"type": "osfs", "params": {}}},
+  "mounts": [{"mountpoint": "/mnt", "backend": "data"}]
+}`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	_, err = c.Mount(t.Context())
+	var e *Error
+	if !errors.As(err, &e) || e.Key != "backends.data.params.root" {
+		t.Errorf("Mount = %v, want an error at backends.data.params.root", err)
+	}
+}
@@ -0,0 +1,216 @@
+package config
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/gwangyi/fsfuse/internal/cli"
+)
+
+// Options are the fsfuse options of a mount. Enumerations, masks, durations
+// and sizes are strings, such as "follow", "022", "1.5s" and "256K". Keys missing from
+// a mount keep their value from the defaults.
+type Options struct {
+	ReadOnly           bool              `json:"read_only,omitempty"`
+	AllowOther         bool              `json:"allow_other,omitempty"`
+	DefaultPermissions bool              `json:"default_permissions,omitempty"`
+	UID                string            `json:"uid,omitempty"`
+	GID                string            `json:"gid,omitempty"`
+	MirrorOwner        bool              `json:"mirror_owner,omitempty"`
+	UIDMap             map[string]string `json:"uid_map,omitempty"`
+	GIDMap             map[string]string `json:"gid_map,omitempty"`
+	FMask              string            `json:"fmask,omitempty"`
+	DMask              string            `json:"dmask,omitempty"`
+	EntryTimeout       string            `json:"entry_timeout,omitempty"`
+	AttrTimeout        string            `json:"attr_timeout,omitempty"`
+	NegativeTimeout    string            `json:"negative_timeout,omitempty"`
+	Atime              string            `json:"atime,omitempty"`
+	FsName             string            `json:"fsname,omitempty"`
+	Subtree            string            `json:"subtree,omitempty"`
+	DirectIO           []string          `json:"direct_io,omitempty"`
+	Hide               []string          `json:"hide,omitempty"`
+	CaseInsensitive    bool              `json:"case_insensitive,omitempty"`
+	CasePreserving     *bool             `json:"case_preserving,omitempty"`
+	Collision          string            `json:"collision,omitempty"`
+	Normalize          string            `json:"normalize,omitempty"`
+	Symlinks           string            `json:"symlinks,omitempty"`
+	MaxNameLen         int               `json:"max_name_len,omitempty"`
+	MaxPathLen         int               `json:"max_path_len,omitempty"`
+	LogBurst           int               `json:"log_burst,omitempty"`
+	LogInterval        string            `json:"log_interval,omitempty"`
+	ReplayBuffer       string            `json:"replay_buffer,omitempty"`
+	StageWrites        bool              `json:"stage_writes,omitempty"`
+	StageDir           string            `json:"stage_dir,omitempty"`
+	SpoolReads         bool              `json:"spool_reads,omitempty"`
+	SpoolDir           string            `json:"spool_dir,omitempty"`
+	Readahead          string            `json:"readahead,omitempty"`
+	ReadaheadMemory    string            `json:"readahead_memory,omitempty"`
+	WriteBehind        string            `json:"write_behind,omitempty"`
+	MaxZeroFill        string            `json:"max_zero_fill,omitempty"`
+	ResumeReads        int               `json:"resume_reads,omitempty"`
+}
+
+// decode layers the options in the JSON object data over o.
+func (o *Options) decode(data []byte) error {
+	return decode(data, o)
+}
+
+// clone returns a deep copy of o, so that layering over it leaves o intact.
+func (o *Options) clone() Options {
+	c := *o
+	c.UIDMap = maps.Clone(o.UIDMap)
+	c.GIDMap = maps.Clone(o.GIDMap)
+	c.DirectIO = slices.Clone(o.DirectIO)
+	c.Hide = slices.Clone(o.Hide)
+	return c
+}
+
+// mountOptions validates o and converts it into cli.MountOptions.
+func (o *Options) mountOptions() (*cli.MountOptions, error) {
+	mo := &cli.MountOptions{
+		ReadOnly:           o.ReadOnly,
+		AllowOther:         o.AllowOther,
+		DefaultPermissions: o.DefaultPermissions,
+		UID:                o.UID,
+		GID:                o.GID,
+		MirrorOwner:        o.MirrorOwner,
+		UIDMap:             o.UIDMap,
+		GIDMap:             o.GIDMap,
+		FsName:             o.FsName,
+		Subtree:            o.Subtree,
+		DirectIO:           o.DirectIO,
+		Hide:               o.Hide,
+		CaseInsensitive:    o.CaseInsensitive,
+		CasePreserving:     o.CasePreserving == nil || *o.CasePreserving,
+		MaxNameLen:         o.MaxNameLen,
+		MaxPathLen:         o.MaxPathLen,
+		LogBurst:           o.LogBurst,
+		StageWrites:        o.StageWrites,
+		StageDir:           o.StageDir,
+		SpoolReads:         o.SpoolReads,
+		SpoolDir:           o.SpoolDir,
+		ResumeReads:        o.ResumeReads,
+	}
+
+	var err error
+	check := func(key string, f func() error) {
+		if err == nil {
+			if e := f(); e != nil {
+				err = &Error{Key: key, Err: e}
+			}
+		}
+	}
+	check("fmask", func() (err error) {
+		if o.FMask != "" {
+			mo.FMask, err = cli.ParseMask(o.FMask)
+		}
+		return err
+	})
+	check("dmask", func() (err error) {
+		if o.DMask != "" {
+			mo.DMask, err = cli.ParseMask(o.DMask)
+		}
+		return err
+	})
+	check("entry_timeout", func() (err error) { mo.EntryTimeout, err = parseDuration(o.EntryTimeout); return err })
+	check("attr_timeout", func() (err error) { mo.AttrTimeout, err = parseDuration(o.AttrTimeout); return err })
+	check("negative_timeout", func() (err error) { mo.NegativeTimeout, err = parseDuration(o.NegativeTimeout); return err })
+	check("log_interval", func() error {
+		d, err := parseDuration(o.LogInterval)
+		if d != nil {
+			mo.LogInterval = *d
+		}
+		return err
+	})
+	check("atime", func() error {
+		if o.Atime != "" {
+			p, err := cli.ParseEnum(cli.AtimePolicies, o.Atime)
+			mo.Atime = &p
+			return err
+		}
+		return nil
+	})
+	check("collision", func() (err error) {
+		if o.Collision != "" {
+			mo.Collision, err = cli.ParseEnum(cli.CollisionPolicies, o.Collision)
+		}
+		return err
+	})
+	check("normalize", func() (err error) {
+		if o.Normalize != "" {
+			mo.Normalization, err = cli.ParseEnum(cli.NormalizationForms, o.Normalize)
+		}
+		return err
+	})
+	check("symlinks", func() (err error) {
+		if o.Symlinks != "" {
+			mo.Symlinks, err = cli.ParseEnum(cli.SymlinkPolicies, o.Symlinks)
+		}
+		return err
+	})
+	check("replay_buffer", func() (err error) {
+		if o.ReplayBuffer != "" {
+			mo.ReplayBuffer, err = cli.ParseSize(o.ReplayBuffer)
+		}
+		return err
+	})
+	check("readahead", func() (err error) {
+		if o.Readahead != "" {
+			mo.Readahead, err = cli.ParseSize(o.Readahead)
+		}
+		return err
+	})
+	check("readahead_memory", func() (err error) {
+		if o.ReadaheadMemory != "" {
+			mo.ReadaheadMemory, err = cli.ParseSize(o.ReadaheadMemory)
+		}
+		return err
+	})
+	check("write_behind", func() (err error) {
+		if o.WriteBehind != "" {
+			mo.WriteBehind, err = cli.ParseSize(o.WriteBehind)
+		}
+		return err
+	})
+	check("max_zero_fill", func() error {
+		if o.MaxZeroFill == "" {
+			return nil
+		}
+		n, err := cli.ParseSize(o.MaxZeroFill)
+		mo.MaxZeroFill = &n
+		return err
+	})
+	check("max_name_len", func() error { return nonNegative(o.MaxNameLen) })
+	check("max_path_len", func() error { return nonNegative(o.MaxPathLen) })
+	check("log_burst", func() error { return nonNegative(o.LogBurst) })
+	check("resume_reads", func() error { return nonNegative(o.ResumeReads) })
+	if err != nil {
+		return nil, err
+	}
+	return mo, nil
+}
+
+// parseDuration parses an optional duration.
+func parseDuration(s string) (*time.Duration, error) {
+	if s == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, err
+	}
+	if d < 0 {
+		return nil, errors.New("negative duration")
+	}
+	return &d, nil
+}
+
+// nonNegative fails for negative limits.
+func nonNegative(n int) error {
+	if n < 0 {
+		return errors.New("must not be negative")
+	}
+	return nil
+}
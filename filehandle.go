@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"io"
+	iofs "io/fs"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/gwangyi/fsx/contextual"
@@ -16,132 +18,363 @@ import (
 // fileHandle wraps a contextual.File to serve FUSE read/write requests.
 // It maintains an internal offset for files that do not support Seeking (e.g. streams),
 // allowing sequential read/write operations to work via fallback logic.
+// mu serializes the fallbacks and guards the state of the handle; reads and
+// writes at an offset do not take it.
 type fileHandle struct {
-	f      contextual.File
+	f contextual.File
+	// fmu guards f against being replaced by a reopen while it is read at
+	// an offset.
+	fmu sync.RWMutex
+	// readerAt records that f can be read at an offset, as f may only be
+	// loaded under a lock once it can be reopened.
+	readerAt bool
+	// flags are the open(2) flags of the file.
+	flags  uint32
 	offset int64
 	mu     sync.Mutex
 	logger *slog.Logger
+	cfg    *config
+	// node is the node the file was opened from.
+	node *node
+	// id identifies the handle in log records.
+	id uint64
+	// accessed records that the file has been read from, so that its
+	// access time is updated on release.
+	accessed atomic.Bool
+	// noReadAt and noWriteAt record that the file does not support
+	// reading or writing at an offset after all.
+	noReadAt  atomic.Bool
+	noWriteAt atomic.Bool
+	// noSeek and noExtend record that the file does not support seeking
+	// or extending after all; they are guarded by mu.
+	noSeek   bool
+	noExtend bool
+	// replay holds the data recently read from a stream, if ReplayBuffer is
+	// given.
+	replay *replayBuffer
+	// pending holds the data at pendingOff consumed from a stream by a read
+	// which failed. It is only valid while it ends at offset.
+	pending    []byte
+	pendingOff int64
+	// stage holds the content written through the handle, if StageWrites
+	// applies.
+	stage *stage
+	// spool holds the data of the stream read through the handle, if
+	// SpoolReads applies.
+	spool *spool
+	// readahead prefetches data, if Readahead is given and the file can be
+	// read at an offset.
+	readahead *readahead
+	// wb buffers writes, if WriteBehind is given.
+	wb *writeBuffer
+	// origin holds the attributes of the file when it was opened, if
+	// ResumeReads applies; a reopened file must still have them.
+	origin iofs.FileInfo
 }
 
 var _ fs.FileReader = &fileHandle{}
 var _ fs.FileWriter = &fileHandle{}
 var _ fs.FileReleaser = &fileHandle{}
 var _ fs.FileFlusher = &fileHandle{}
+var _ fs.FileFsyncer = &fileHandle{}
 
 // Read reads data from the file at the given offset.
 //
-// It attempts to use io.ReaderAt first.
+// It attempts to use io.ReaderAt first, through the Readahead if given.
 // If not supported, it tries io.Seeker to seek to the offset.
 // If neither are supported (e.g. pipe), it simulates seeking by reading and discarding data
 // until the desired offset is reached (if moving forward).
-// Backward seeks on non-seekable files return ENOSYS.
+// Backward seeks on non-seekable files are served from the ReplayBuffer if it
+// still holds the data, and return ENOSYS otherwise. The data consumed by a
+// read which fails is kept regardless, so that retrying it succeeds.
+// Reads from the position of the file are repeated until dest is full or the
+// end of the file is reached, so that short reads are not taken for the end
+// of the file. With ResumeReads, failed reads are retried on a reopened
+// file.
+//
+// Reads at an offset run concurrently; only the fallbacks, which depend on
+// the position of the file, are serialized.
 func (fh *fileHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
-	fh.mu.Lock()
-	defer fh.mu.Unlock()
+	ctx = fh.startRequest(ctx, "Read")
+	fh.accessed.Store(true)
 
-	if ra, ok := fh.f.(io.ReaderAt); ok {
-		n, err := ra.ReadAt(dest, off)
-		if err != errors.ErrUnsupported {
+	if fh.stage != nil {
+		return fh.readStaged(ctx, dest, off)
+	}
+	if fh.spool != nil {
+		return fh.readSpooled(ctx, dest, off)
+	}
+	if fh.wb != nil {
+		fh.mu.Lock()
+		fh.flushOverlapping(ctx, off, int64(len(dest)))
+		fh.mu.Unlock()
+	}
+	if fh.readerAt && !fh.noReadAt.Load() {
+		var n int
+		var err error
+		if fh.readahead != nil {
+			n, err = fh.readahead.read(ctx, dest, off)
+		} else {
+			n, err = fh.readAt(dest, off)
+		}
+		if !errors.Is(err, errors.ErrUnsupported) {
 			if err != nil && err != io.EOF {
-				fh.logger.Error("ReadAt failed", "offset", off, "error", err)
-				return nil, toErrno(err)
+				errno := fh.fail(ctx, "Read", "ReadAt failed", err, "offset", off)
+				if fh.origin == nil {
+					return nil, errno
+				}
+				fh.mu.Lock()
+				defer fh.mu.Unlock()
+				return fh.resume(ctx, dest, off, errno)
 			}
 			return fuse.ReadResultData(dest[:n]), 0
 		}
+		fh.noReadAt.Store(true)
+		if fh.readahead != nil {
+			fh.readahead.close()
+		}
 	}
 
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	res, errno := fh.readPosition(ctx, dest, off)
+	if errno != 0 && fh.origin != nil {
+		res, errno = fh.resume(ctx, dest, off, errno)
+	}
+	return res, errno
+}
+
+// readAt reads from the file at off. The file must be an io.ReaderAt.
+func (fh *fileHandle) readAt(p []byte, off int64) (int, error) {
+	fh.fmu.RLock()
+	defer fh.fmu.RUnlock()
+	return fh.f.(io.ReaderAt).ReadAt(p, off)
+}
+
+// readerAtFunc adapts a function to io.ReaderAt.
+type readerAtFunc func(p []byte, off int64) (int, error)
+
+func (f readerAtFunc) ReadAt(p []byte, off int64) (int, error) {
+	return f(p, off)
+}
+
+// readPosition reads data at off by seeking, or from the position of a
+// stream. fh.mu must be held.
+func (fh *fileHandle) readPosition(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	if s, ok := fh.f.(io.Seeker); ok {
 		_, err := s.Seek(off, io.SeekStart)
 		if err != errors.ErrUnsupported {
 			if err != nil {
-				fh.logger.Error("Seek failed", "offset", off, "error", err)
-				return nil, toErrno(err)
+				return nil, fh.fail(ctx, "Read", "Seek failed", err, "offset", off)
 			}
-			n, err := fh.f.Read(dest)
+			n, err := readFull(ctx, fh.f, dest)
 			if err != nil && err != io.EOF {
-				fh.logger.Error("Read failed after seek", "offset", off, "error", err)
-				return nil, toErrno(err)
+				return nil, fh.fail(ctx, "Read", "Read failed after seek", err, "offset", off)
 			}
 			return fuse.ReadResultData(dest[:n]), 0
 		}
 	}
 
+	if fh.replay == nil && fh.cfg.replaySize > 0 {
+		fh.replay = newReplayBuffer(fh.cfg.replaySize)
+	}
 	if off < fh.offset {
-		return nil, syscall.ENOSYS
+		return fh.readReplay(ctx, dest, off)
 	}
 	if off > fh.offset {
-		n, err := io.CopyN(io.Discard, fh.f, off-fh.offset)
+		var skipped io.Writer = io.Discard
+		if fh.replay != nil {
+			skipped = fh.replay
+		}
+		n, err := io.CopyN(skipped, fh.f, off-fh.offset)
 		fh.offset += n
 		if err != nil {
 			if err == io.EOF {
 				return fuse.ReadResultData(nil), 0
 			}
-			fh.logger.Error("Discard forward failed", "target", off, "current", fh.offset-n, "error", err)
-			return nil, toErrno(err)
+			return nil, fh.fail(ctx, "Read", "Discard forward failed", err, "target", off, "current", fh.offset-n)
 		}
 	}
 
-	n, err := fh.f.Read(dest)
+	n, err := fh.readStream(ctx, dest)
+	if err != nil && err != io.EOF {
+		fh.keepPending(dest[:n])
+		return nil, fh.fail(ctx, "Read", "Read failed", err, "offset", fh.offset-int64(n))
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+// readReplay serves a read behind the current position of a stream from the
+// replay buffer, or from the data consumed by a failed read, continuing with
+// the stream if the read extends beyond the data held. fh.mu must be held.
+func (fh *fileHandle) readReplay(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	back := fh.offset - off
+	var n int
+	switch {
+	case fh.replay != nil && back <= int64(fh.replay.Len()):
+		n = fh.replay.ReplayAt(dest, int(back))
+	case fh.pendingOff+int64(len(fh.pending)) == fh.offset && back <= int64(len(fh.pending)):
+		n = copy(dest, fh.pending[int64(len(fh.pending))-back:])
+	default:
+		return nil, syscall.ENOSYS
+	}
+	if n < len(dest) {
+		m, err := fh.readStream(ctx, dest[n:])
+		if err != nil && err != io.EOF {
+			fh.keepPending(dest[:n+m])
+			return nil, fh.fail(ctx, "Read", "Read failed", err, "offset", fh.offset-int64(m))
+		}
+		n += m
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+// keepPending keeps data, which ends at the current position of the stream
+// and was consumed by a read which then failed, so that the kernel's retry
+// of the read is served. fh.mu must be held.
+func (fh *fileHandle) keepPending(data []byte) {
+	fh.pending = append(fh.pending[:0], data...)
+	fh.pendingOff = fh.offset - int64(len(data))
+}
+
+// readStream reads from the current position of a stream, advancing it and
+// recording the data in the replay buffer. fh.mu must be held.
+func (fh *fileHandle) readStream(ctx context.Context, dest []byte) (int, error) {
+	n, err := readFull(ctx, fh.f, dest)
 	if n > 0 {
 		fh.offset += int64(n)
+		if fh.replay != nil {
+			_, _ = fh.replay.Write(dest[:n])
+		}
 	}
-	if err != nil && err != io.EOF {
-		fh.logger.Error("Read failed", "offset", fh.offset-int64(n), "error", err)
-		return nil, toErrno(err)
+	return n, err
+}
+
+// maxEmptyReads is the number of consecutive reads returning neither data
+// nor an error after which readFull gives up.
+const maxEmptyReads = 100
+
+// readFull reads from r until dest is full, r reports the end of the file or
+// an error, or ctx is done. Backends such as network bodies or decompressors
+// may return fewer bytes than asked for before the end of the file, which
+// the kernel would take for the end of the file if passed on.
+// Like Read, it returns io.EOF along with the data read before the end.
+func readFull(ctx context.Context, r io.Reader, dest []byte) (int, error) {
+	n, empty := 0, 0
+	for n < len(dest) {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		m, err := r.Read(dest[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m > 0 {
+			empty = 0
+		} else if empty++; empty >= maxEmptyReads {
+			return n, io.ErrNoProgress
+		}
 	}
-	return fuse.ReadResultData(dest[:n]), 0
+	return n, nil
 }
 
 // Write writes data to the file at the given offset.
 //
 // It attempts to use io.WriterAt first.
 // If not supported, it tries io.Seeker.
-// If neither are supported, it simulates seeking forward by writing zeros (padding)
-// to fill the gap between the current offset and the requested offset.
+// If neither are supported, it moves forward to the requested offset by
+// extending the file, or by writing zeros (padding) to fill the gap, up to
+// MaxZeroFill.
 // Backward seeks on non-seekable files return ENOSYS.
+// Files opened with O_APPEND are written at their current end instead; see
+// Appender. With WriteBehind, data is buffered and written later.
+//
+// Writes at an offset run concurrently, unless they are buffered; only the
+// fallbacks, which depend on the position of the file, are serialized.
 func (fh *fileHandle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	ctx = fh.startRequest(ctx, "Write")
+	if fh.readahead != nil {
+		// Data prefetched while the write is in progress may be stale, so
+		// it is dropped once the write is done.
+		defer fh.readahead.invalidate()
+	}
+	if fh.stage == nil && fh.wb == nil && fh.flags&syscall.O_APPEND == 0 {
+		if n, errno, ok := fh.writeAt(ctx, data, off); ok {
+			return n, errno
+		}
+	}
+
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
+	switch {
+	case fh.stage != nil:
+		return fh.writeStaged(ctx, data, off)
+	case fh.wb != nil:
+		return fh.writeBehind(ctx, data, off)
+	}
+	return fh.writeBackend(ctx, data, off)
+}
 
-	if wa, ok := fh.f.(io.WriterAt); ok {
-		n, err := wa.WriteAt(data, off)
+// writeBackend writes data to the backend file, at its end if it was opened
+// with O_APPEND. fh.mu must be held.
+func (fh *fileHandle) writeBackend(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	if fh.flags&syscall.O_APPEND != 0 {
+		return fh.writeAppend(ctx, data)
+	}
+	if n, errno, ok := fh.writeAt(ctx, data, off); ok {
+		return n, errno
+	}
+	return fh.writeSequential(ctx, data, off)
+}
+
+// writeAt writes data at an offset, if the backend file supports it, as
+// reported by ok. It does not need fh.mu.
+func (fh *fileHandle) writeAt(ctx context.Context, data []byte, off int64) (n uint32, errno syscall.Errno, ok bool) {
+	wa, ok := fh.f.(io.WriterAt)
+	if !ok || fh.noWriteAt.Load() {
+		return 0, 0, false
+	}
+	m, err := wa.WriteAt(data, off)
+	if errors.Is(err, errors.ErrUnsupported) {
+		fh.noWriteAt.Store(true)
+		return 0, 0, false
+	}
+	if err != nil {
+		return uint32(m), fh.fail(ctx, "Write", "WriteAt failed", err, "offset", off), true
+	}
+	return uint32(m), 0, true
+}
+
+// writeSequential writes data by seeking, or by padding a stream forward.
+// fh.mu must be held.
+func (fh *fileHandle) writeSequential(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	if s, ok := fh.f.(io.Seeker); ok && !fh.noSeek {
+		// Seeking past the end leaves a hole.
+		_, err := s.Seek(off, io.SeekStart)
 		if !errors.Is(err, errors.ErrUnsupported) {
 			if err != nil {
-				fh.logger.Error("WriteAt failed", "offset", off, "error", err)
+				return 0, fh.fail(ctx, "Write", "Seek failed", err, "offset", off)
 			}
-			return uint32(n), toErrno(err)
-		}
-	}
-
-	if s, ok := fh.f.(io.Seeker); ok {
-		if _, err := s.Seek(off, io.SeekStart); err != nil {
-			fh.logger.Error("Seek failed", "offset", off, "error", err)
-			return 0, toErrno(err)
-		}
-		n, err := fh.f.(io.Writer).Write(data)
-		if err != nil {
-			fh.logger.Error("Write failed after seek", "offset", off, "error", err)
+			n, err := fh.f.(io.Writer).Write(data)
+			if err != nil {
+				return uint32(n), fh.fail(ctx, "Write", "Write failed after seek", err, "offset", off)
+			}
+			return uint32(n), 0
 		}
-		return uint32(n), toErrno(err)
+		fh.noSeek = true
 	}
 
 	if off < fh.offset {
 		return 0, syscall.ENOSYS
 	}
+	if fh.replay != nil {
+		// The data read so far is no longer what precedes the offset.
+		fh.replay.Reset()
+	}
 	if off > fh.offset {
-		zeros := make([]byte, 4096)
-		remaining := off - fh.offset
-		for remaining > 0 {
-			toWrite := min(remaining, int64(len(zeros)))
-			n, err := fh.f.(io.Writer).Write(zeros[:toWrite])
-			if n > 0 {
-				fh.offset += int64(n)
-				remaining -= int64(n)
-			}
-			if err != nil {
-				fh.logger.Error("Write zeros (padding) failed", "offset", fh.offset-int64(n), "error", err)
-				return 0, toErrno(err)
-			}
+		if errno := fh.skipTo(ctx, off); errno != 0 {
+			return 0, errno
 		}
 	}
 
@@ -150,22 +383,85 @@ func (fh *fileHandle) Write(ctx context.Context, data []byte, off int64) (uint32
 		fh.offset += int64(n)
 	}
 	if err != nil {
-		fh.logger.Error("Write failed", "offset", fh.offset-int64(n), "error", err)
+		return uint32(n), fh.fail(ctx, "Write", "Write failed", err, "offset", fh.offset-int64(n))
 	}
-	return uint32(n), toErrno(err)
+	return uint32(n), 0
 }
 
 // Flush is called when the file is closed or flushed.
-// It returns 0 as fsx does not currently expose explicit Flush.
+// Staged content is uploaded and buffered writes are written, so that
+// close(2) reports the outcome. Otherwise it returns 0 as fsx does not
+// currently expose explicit Flush.
 func (fh *fileHandle) Flush(ctx context.Context) syscall.Errno {
+	if fh.stage == nil && fh.wb == nil {
+		return 0
+	}
+	ctx = fh.startRequest(ctx, "Flush")
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	if fh.wb != nil {
+		return fh.flushWrites(ctx)
+	}
+	if err := fh.upload(ctx); err != nil {
+		return fh.fail(ctx, "Flush", "Staging: upload failed", err, "path", fh.node.path)
+	}
+	return 0
+}
+
+// Fsync writes buffered writes and, if the backend file supports it, syncs
+// it.
+func (fh *fileHandle) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	ctx = fh.startRequest(ctx, "Fsync")
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	if fh.stage != nil {
+		return 0
+	}
+	if fh.wb != nil {
+		if errno := fh.flushWrites(ctx); errno != 0 {
+			return errno
+		}
+	}
+	if s, ok := fh.f.(interface{ Sync() error }); ok {
+		if err := s.Sync(); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			return fh.fail(ctx, "Fsync", "Sync failed", err)
+		}
+	}
 	return 0
 }
 
-// Release closes the file handle.
+// Release closes the file handle, after writing buffered writes.
+// If the file has been read from, its access time is then updated according
+// to the AtimePolicy.
 func (fh *fileHandle) Release(ctx context.Context) syscall.Errno {
-	err := fh.f.Close()
+	ctx = fh.startRequest(ctx, "Release")
+	var err error
+	// errno reports a failure which has already been logged.
+	var errno syscall.Errno
+	switch {
+	case fh.stage != nil:
+		err = fh.releaseStaged(ctx)
+	case fh.spool != nil:
+		err = fh.spool.stop(fh.f)
+	default:
+		if fh.readahead != nil {
+			fh.readahead.close()
+		}
+		if fh.wb != nil {
+			fh.mu.Lock()
+			errno = fh.flushWrites(ctx)
+			fh.mu.Unlock()
+		}
+		err = fh.f.Close()
+	}
+	if fh.wb != nil {
+		fh.node.removeWriter(fh)
+	}
+	if fh.accessed.Load() {
+		fh.node.touchAtime(ctx)
+	}
 	if err != nil {
-		fh.logger.Error("Release failed", "error", err)
+		return fh.fail(ctx, "Release", "Release failed", err)
 	}
-	return toErrno(err)
+	return errno
 }
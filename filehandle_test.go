@@ -1,17 +1,25 @@
 package fsfuse_test
 
 import (
+	"context"
 	"errors"
 	"io"
+	iofs "io/fs"
 	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 
+	"github.com/gwangyi/fsfuse"
 	"github.com/gwangyi/fsfuse/internal/mock"
 	"github.com/gwangyi/fsx"
 	"github.com/gwangyi/fsx/mockfs"
 	cmockfs "github.com/gwangyi/fsx/mockfs/contextual"
 	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"go.uber.org/mock/gomock"
 )
 
@@ -22,14 +30,29 @@ type filehandle interface {
 	fs.FileFlusher
 }
 
-func MakeFileHandle(t *testing.T, ctrl *gomock.Controller, file fsx.File) filehandle {
+func MakeFileHandle(t *testing.T, ctrl *gomock.Controller, file fsx.File, opts ...fsfuse.Option) filehandle {
+	t.Helper()
+	return OpenFileHandle(t, ctrl, file, os.O_RDWR, opts...)
+}
+
+// OpenFileHandle is MakeFileHandle opening the file with the given flags.
+func OpenFileHandle(t *testing.T, ctrl *gomock.Controller, file fsx.File, flags int, opts ...fsfuse.Option) filehandle {
 	t.Helper()
 	mfs := cmockfs.NewMockFileSystem(ctrl)
 	mfi := setupFileInfo(ctrl, "file", 0, 0644)
 	mfs.EXPECT().Lstat(gomock.Any(), "file").Return(mfi, nil).AnyTimes()
 	mfs.EXPECT().OpenFile(gomock.Any(), "file", gomock.Any(), gomock.Any()).Return(file, nil)
-	node := MakeNode(t, mfs, "file")
-	fh, _, err := node.Open(t.Context(), uint32(os.O_RDWR))
+	// Open stats the file to decide on the caching policy.
+	switch m := file.(type) {
+	case *mock.MockFullFile:
+		m.EXPECT().Stat().Return(mfi, nil)
+	case *mockfs.MockFile:
+		m.EXPECT().Stat().Return(mfi, nil)
+	case *extendFile:
+		m.EXPECT().Stat().Return(mfi, nil)
+	}
+	node := MakeNode(t, mfs, "file", opts...)
+	fh, _, err := node.Open(t.Context(), uint32(flags))
 	if err != syscall.Errno(0) {
 		t.Fatalf("Open failed: %v", err)
 	}
@@ -106,7 +129,7 @@ func TestFileHandle_Read(t *testing.T) {
 		// Force fallthrough to Seeker
 		m.EXPECT().ReadAt(gomock.Any(), int64(5)).Return(0, errors.ErrUnsupported)
 		m.EXPECT().Seek(int64(5), 0).Return(int64(5), nil)
-		m.EXPECT().Read(gomock.Any()).Return(3, nil)
+		m.EXPECT().Read(gomock.Any()).Return(3, io.EOF)
 
 		dest := make([]byte, 10)
 		res, errno := fh.Read(ctx, dest, 5)
@@ -161,7 +184,7 @@ func TestFileHandle_Read(t *testing.T) {
 		fh := MakeFileHandle(t, ctrl, m)
 
 		m.EXPECT().Read(gomock.Any()).DoAndReturn(func(b []byte) (int, error) {
-			return copy(b, "data"), nil
+			return copy(b, "data"), io.EOF
 		})
 
 		dest := make([]byte, 10)
@@ -192,7 +215,7 @@ func TestFileHandle_Read(t *testing.T) {
 		})
 		// Read actual data
 		m.EXPECT().Read(gomock.Any()).DoAndReturn(func(b []byte) (int, error) {
-			return copy(b, "data"), nil
+			return copy(b, "data"), io.EOF
 		})
 
 		dest := make([]byte, 10)
@@ -300,6 +323,337 @@ func TestFileHandle_Read(t *testing.T) {
 	})
 }
 
+func TestFileHandle_Replay(t *testing.T) {
+	const data = "0123456789abcdefghij"
+	stream := func(m *mockfs.MockFile) {
+		pos := 0
+		m.EXPECT().Read(gomock.Any()).DoAndReturn(func(b []byte) (int, error) {
+			if pos == len(data) {
+				return 0, io.EOF
+			}
+			n := copy(b, data[pos:])
+			pos += n
+			return n, nil
+		}).AnyTimes()
+	}
+	read := func(t *testing.T, fh filehandle, size int, off int64) (string, syscall.Errno) {
+		t.Helper()
+		dest := make([]byte, size)
+		res, errno := fh.Read(t.Context(), dest, off)
+		if errno != 0 {
+			return "", errno
+		}
+		d, _ := res.Bytes(dest)
+		return string(d), 0
+	}
+
+	tests := []struct {
+		name  string
+		size  int
+		reads []int64
+		off   int64
+		want  string
+		errno syscall.Errno
+	}{
+		{"Disabled", 0, []int64{0}, 2, "", syscall.ENOSYS},
+		{"Within", 8, []int64{0}, 2, "2345", 0},
+		{"Beyond", 4, []int64{0, 4}, 2, "", syscall.ENOSYS},
+		{"Extending", 8, []int64{0}, 4, "4567", 0},
+		{"Wrapped", 6, []int64{0, 4, 8}, 7, "789a", 0},
+		{"Skipped", 8, []int64{12}, 10, "abcd", 0},
+		{"Reordered", 16, []int64{8, 0}, 4, "4567", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			m := mockfs.NewMockFile(ctrl)
+			stream(m)
+			fh := MakeFileHandle(t, ctrl, m, fsfuse.ReplayBuffer(tt.size))
+			for _, off := range tt.reads {
+				if _, errno := read(t, fh, 4, off); errno != 0 && errno != syscall.ENOSYS {
+					t.Fatalf("Read(%d) failed: %v", off, errno)
+				}
+			}
+
+			got, errno := read(t, fh, 4, tt.off)
+			if errno != tt.errno {
+				t.Fatalf("Read(%d) = %v, want %v", tt.off, errno, tt.errno)
+			}
+			if got != tt.want {
+				t.Errorf("Read(%d) = %q, want %q", tt.off, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("ResetByWrite", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		m := mockfs.NewMockFile(ctrl)
+		stream(m)
+		m.EXPECT().Write([]byte("xy")).Return(2, nil)
+		fh := MakeFileHandle(t, ctrl, m, fsfuse.ReplayBuffer(16))
+		if _, errno := read(t, fh, 4, 0); errno != 0 {
+			t.Fatalf("Read failed: %v", errno)
+		}
+		if _, errno := fh.Write(t.Context(), []byte("xy"), 4); errno != 0 {
+			t.Fatalf("Write failed: %v", errno)
+		}
+		if _, errno := read(t, fh, 4, 0); errno != syscall.ENOSYS {
+			t.Errorf("Read after Write = %v, want ENOSYS", errno)
+		}
+	})
+}
+
+// shortReads returns a Read implementation serving content at most limit bytes
+// at a time, as network bodies and decompressors do.
+func shortReads(content string, limit int) func([]byte) (int, error) {
+	return func(b []byte) (int, error) {
+		if content == "" {
+			return 0, io.EOF
+		}
+		n := copy(b[:min(len(b), limit)], content)
+		content = content[n:]
+		return n, nil
+	}
+}
+
+func TestFileHandle_ShortReads(t *testing.T) {
+	const content = "0123456789abcdef"
+	read := func(t *testing.T, fh filehandle, size int, off int64) (string, syscall.Errno) {
+		t.Helper()
+		dest := make([]byte, size)
+		res, errno := fh.Read(t.Context(), dest, off)
+		if errno != 0 {
+			return "", errno
+		}
+		d, _ := res.Bytes(dest)
+		return string(d), 0
+	}
+
+	t.Run("Seeker", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		m := mock.NewMockFullFile(ctrl)
+		fh := MakeFileHandle(t, ctrl, m)
+
+		m.EXPECT().ReadAt(gomock.Any(), int64(4)).Return(0, errors.ErrUnsupported)
+		m.EXPECT().Seek(int64(4), io.SeekStart).Return(int64(4), nil)
+		m.EXPECT().Read(gomock.Any()).DoAndReturn(shortReads(content[4:], 3)).Times(3)
+		if got, errno := read(t, fh, 8, 4); errno != 0 || got != content[4:12] {
+			t.Errorf("Read = (%q, %v), want (%q, 0)", got, errno, content[4:12])
+		}
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		m := mockfs.NewMockFile(ctrl)
+		fh := MakeFileHandle(t, ctrl, m)
+
+		m.EXPECT().Read(gomock.Any()).DoAndReturn(shortReads(content, 5)).AnyTimes()
+		if got, errno := read(t, fh, 12, 0); errno != 0 || got != content[:12] {
+			t.Errorf("Read = (%q, %v), want (%q, 0)", got, errno, content[:12])
+		}
+		// The end of the file ends the read.
+		if got, errno := read(t, fh, 12, 12); errno != 0 || got != content[12:] {
+			t.Errorf("Read = (%q, %v), want (%q, 0)", got, errno, content[12:])
+		}
+	})
+
+	t.Run("NoProgress", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		m := mockfs.NewMockFile(ctrl)
+		fh := MakeFileHandle(t, ctrl, m)
+
+		m.EXPECT().Read(gomock.Any()).DoAndReturn(shortReads(content, 2))
+		m.EXPECT().Read(gomock.Any()).Return(0, nil).AnyTimes()
+		if _, errno := read(t, fh, 8, 0); errno != syscall.EIO {
+			t.Errorf("Read = %v, want EIO", errno)
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		m := mockfs.NewMockFile(ctrl)
+		fh := MakeFileHandle(t, ctrl, m)
+
+		ctx, cancel := context.WithCancel(t.Context())
+		m.EXPECT().Read(gomock.Any()).DoAndReturn(func(b []byte) (int, error) {
+			cancel()
+			return copy(b[:2], content), nil
+		})
+		if _, errno := fh.Read(ctx, make([]byte, 8), 0); errno != syscall.EINTR {
+			t.Errorf("Read = %v, want EINTR", errno)
+		}
+
+		// The retry gets the data consumed by the interrupted read.
+		m.EXPECT().Read(gomock.Any()).DoAndReturn(shortReads(content[2:], 16))
+		if got, errno := read(t, fh, 8, 0); errno != 0 || got != content[:8] {
+			t.Errorf("Read retry = (%q, %v), want (%q, 0)", got, errno, content[:8])
+		}
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		m := mockfs.NewMockFile(ctrl)
+		fh := MakeFileHandle(t, ctrl, m)
+
+		m.EXPECT().Read(gomock.Any()).DoAndReturn(shortReads(content[:3], 3))
+		m.EXPECT().Read(gomock.Any()).Return(0, errors.New("connection reset"))
+		if _, errno := read(t, fh, 8, 0); errno != syscall.EIO {
+			t.Errorf("Read = %v, want EIO", errno)
+		}
+		// The retry fails again after more data; both parts are kept.
+		m.EXPECT().Read(gomock.Any()).DoAndReturn(shortReads(content[3:5], 2))
+		m.EXPECT().Read(gomock.Any()).Return(0, errors.New("connection reset"))
+		if _, errno := read(t, fh, 8, 0); errno != syscall.EIO {
+			t.Errorf("Read = %v, want EIO", errno)
+		}
+		m.EXPECT().Read(gomock.Any()).DoAndReturn(shortReads(content[5:], 16))
+		if got, errno := read(t, fh, 8, 0); errno != 0 || got != content[:8] {
+			t.Errorf("Read retry = (%q, %v), want (%q, 0)", got, errno, content[:8])
+		}
+	})
+}
+
+func TestFileHandle_ResumeReads(t *testing.T) {
+	const content = "0123456789abcdef"
+	// open opens "file" read-only with ResumeReads, returning the handle,
+	// the mock of the backend and of the open file, and its attributes.
+	open := func(t *testing.T, attempts int) (filehandle, *cmockfs.MockFileSystem, *mockfs.MockFile, iofs.FileInfo) {
+		t.Helper()
+		ctrl := gomock.NewController(t)
+		mfs := cmockfs.NewMockFileSystem(ctrl)
+		mfi := setupFileInfo(ctrl, "file", int64(len(content)), 0644)
+		mfs.EXPECT().Lstat(gomock.Any(), "file").Return(mfi, nil).AnyTimes()
+		m := mockfs.NewMockFile(ctrl)
+		m.EXPECT().Stat().Return(mfi, nil)
+		mfs.EXPECT().OpenFile(gomock.Any(), "file", os.O_RDONLY, gomock.Any()).Return(m, nil)
+		node := MakeNode(t, mfs, "file", fsfuse.ResumeReads(attempts))
+		fh, _, errno := node.Open(t.Context(), uint32(os.O_RDONLY))
+		if errno != 0 {
+			t.Fatalf("Open failed: %v", errno)
+		}
+		return fh.(filehandle), mfs, m, mfi
+	}
+	read := func(t *testing.T, fh filehandle, size int, off int64) (string, syscall.Errno) {
+		t.Helper()
+		dest := make([]byte, size)
+		res, errno := fh.Read(t.Context(), dest, off)
+		if errno != 0 {
+			return "", errno
+		}
+		d, _ := res.Bytes(dest)
+		return string(d), 0
+	}
+	broken := errors.New("connection reset")
+
+	t.Run("Resume", func(t *testing.T) {
+		fh, mfs, m, mfi := open(t, 1)
+		ctrl := gomock.NewController(t)
+		m.EXPECT().Read(gomock.Any()).DoAndReturn(shortReads(content[:4], 4))
+		if got, errno := read(t, fh, 4, 0); errno != 0 || got != content[:4] {
+			t.Fatalf("Read = (%q, %v), want (%q, 0)", got, errno, content[:4])
+		}
+
+		// The stream breaks; the reopened one skips what was read.
+		m.EXPECT().Read(gomock.Any()).Return(0, broken)
+		m.EXPECT().Close().Return(nil)
+		m2 := mockfs.NewMockFile(ctrl)
+		mfs.EXPECT().OpenFile(gomock.Any(), "file", os.O_RDONLY, gomock.Any()).Return(m2, nil)
+		m2.EXPECT().Stat().Return(mfi, nil)
+		m2.EXPECT().Read(gomock.Any()).DoAndReturn(shortReads(content, 3)).AnyTimes()
+		if got, errno := read(t, fh, 8, 4); errno != 0 || got != content[4:12] {
+			t.Errorf("Read = (%q, %v), want (%q, 0)", got, errno, content[4:12])
+		}
+	})
+
+	t.Run("Partial", func(t *testing.T) {
+		fh, mfs, m, mfi := open(t, 1)
+		ctrl := gomock.NewController(t)
+		// The stream breaks in the middle of the read, which starts over.
+		m.EXPECT().Read(gomock.Any()).DoAndReturn(shortReads(content[:2], 2))
+		m.EXPECT().Read(gomock.Any()).Return(0, broken)
+		m.EXPECT().Close().Return(nil)
+		m2 := mockfs.NewMockFile(ctrl)
+		mfs.EXPECT().OpenFile(gomock.Any(), "file", os.O_RDONLY, gomock.Any()).Return(m2, nil)
+		m2.EXPECT().Stat().Return(mfi, nil)
+		m2.EXPECT().Read(gomock.Any()).DoAndReturn(shortReads(content, 16)).AnyTimes()
+		if got, errno := read(t, fh, 6, 0); errno != 0 || got != content[:6] {
+			t.Errorf("Read = (%q, %v), want (%q, 0)", got, errno, content[:6])
+		}
+	})
+
+	t.Run("Changed", func(t *testing.T) {
+		fh, mfs, m, _ := open(t, 3)
+		ctrl := gomock.NewController(t)
+		m.EXPECT().Read(gomock.Any()).Return(0, broken)
+		m2 := mockfs.NewMockFile(ctrl)
+		mfs.EXPECT().OpenFile(gomock.Any(), "file", os.O_RDONLY, gomock.Any()).Return(m2, nil)
+		m2.EXPECT().Stat().Return(setupFileInfo(ctrl, "file", 32, 0644), nil)
+		m2.EXPECT().Close().Return(nil)
+		if _, errno := read(t, fh, 8, 0); errno != syscall.ESTALE {
+			t.Errorf("Read = %v, want ESTALE", errno)
+		}
+	})
+
+	t.Run("Attempts", func(t *testing.T) {
+		fh, mfs, m, _ := open(t, 2)
+		m.EXPECT().Read(gomock.Any()).Return(0, broken)
+		mfs.EXPECT().OpenFile(gomock.Any(), "file", os.O_RDONLY, gomock.Any()).Return(nil, broken).Times(2)
+		if _, errno := read(t, fh, 8, 0); errno != syscall.EIO {
+			t.Errorf("Read = %v, want EIO", errno)
+		}
+	})
+
+	t.Run("ReaderAt", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mfs := cmockfs.NewMockFileSystem(ctrl)
+		mfi := setupFileInfo(ctrl, "file", int64(len(content)), 0644)
+		mfs.EXPECT().Lstat(gomock.Any(), "file").Return(mfi, nil).AnyTimes()
+		m := mock.NewMockFullFile(ctrl)
+		m.EXPECT().Stat().Return(mfi, nil)
+		mfs.EXPECT().OpenFile(gomock.Any(), "file", os.O_RDONLY, gomock.Any()).Return(m, nil)
+		node := MakeNode(t, mfs, "file", fsfuse.ResumeReads(1))
+		f, _, errno := node.Open(t.Context(), uint32(os.O_RDONLY))
+		if errno != 0 {
+			t.Fatalf("Open failed: %v", errno)
+		}
+		fh := f.(filehandle)
+
+		// The file fails once; the reopened one is read at the same offset
+		// without being positioned.
+		m.EXPECT().ReadAt(gomock.Any(), int64(4)).Return(0, broken)
+		m.EXPECT().Close().Return(nil)
+		m2 := mock.NewMockFullFile(ctrl)
+		mfs.EXPECT().OpenFile(gomock.Any(), "file", os.O_RDONLY, gomock.Any()).Return(m2, nil)
+		m2.EXPECT().Stat().Return(mfi, nil)
+		m2.EXPECT().ReadAt(gomock.Any(), gomock.Any()).DoAndReturn(func(p []byte, off int64) (int, error) {
+			return copy(p, content[off:]), nil
+		}).Times(2)
+		if got, errno := read(t, fh, 8, 4); errno != 0 || got != content[4:12] {
+			t.Errorf("Read = (%q, %v), want (%q, 0)", got, errno, content[4:12])
+		}
+		// Later reads go to the reopened file.
+		if got, errno := read(t, fh, 4, 0); errno != 0 || got != content[:4] {
+			t.Errorf("Read = (%q, %v), want (%q, 0)", got, errno, content[:4])
+		}
+		m2.EXPECT().Close().Return(nil)
+		if errno := fh.Release(t.Context()); errno != 0 {
+			t.Errorf("Release failed: %v", errno)
+		}
+	})
+
+	t.Run("ReadWrite", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		m := mockfs.NewMockFile(ctrl)
+		// Handles open for writing are not resumed.
+		fh := MakeFileHandle(t, ctrl, m, fsfuse.ResumeReads(3))
+		m.EXPECT().Read(gomock.Any()).Return(0, broken)
+		if _, errno := read(t, fh, 8, 0); errno != syscall.EIO {
+			t.Errorf("Read = %v, want EIO", errno)
+		}
+	})
+}
+
 func TestFileHandle_Write(t *testing.T) {
 	t.Run("WriterAt_Success", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
@@ -412,7 +766,7 @@ func TestFileHandle_Write(t *testing.T) {
 		m := mockfs.NewMockFile(ctrl)
 		fh := MakeFileHandle(t, ctrl, m)
 
-		// Pad 5 bytes with zeros
+		// Pad 5 bytes with zeros; the stream is not truncated to extend it.
 		m.EXPECT().Write(gomock.Any()).DoAndReturn(func(b []byte) (int, error) {
 			if len(b) != 5 {
 				t.Errorf("Pad write length mismatch: got %d", len(b))
@@ -452,6 +806,81 @@ func TestFileHandle_Write(t *testing.T) {
 		}
 	})
 
+	t.Run("Fallback_Extend", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		m := &extendFile{MockFile: mockfs.NewMockFile(ctrl)}
+		fh := MakeFileHandle(t, ctrl, m)
+
+		// The gap is left as a hole; no zeros are written.
+		m.EXPECT().Write([]byte("data")).Return(4, nil)
+		if n, errno := fh.Write(t.Context(), []byte("data"), 1<<40); errno != 0 || n != 4 {
+			t.Errorf("Write = (%d, %v), want (4, 0)", n, errno)
+		}
+		if !slices.Equal(m.extended, []int64{1 << 40}) {
+			t.Errorf("Extend calls = %v, want [%d]", m.extended, int64(1<<40))
+		}
+	})
+
+	t.Run("Fallback_Extend_Error", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		m := &extendFile{MockFile: mockfs.NewMockFile(ctrl), err: syscall.ENOSPC}
+		fh := MakeFileHandle(t, ctrl, m)
+
+		if _, errno := fh.Write(t.Context(), []byte("data"), 5); errno != syscall.ENOSPC {
+			t.Errorf("Write = %v, want ENOSPC", errno)
+		}
+	})
+
+	t.Run("Fallback_Pad_Chunks", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		m := &extendFile{MockFile: mockfs.NewMockFile(ctrl), err: errors.ErrUnsupported}
+		fh := MakeFileHandle(t, ctrl, m)
+
+		const gap = 200 << 10
+		var written, calls int
+		m.EXPECT().Write(gomock.Any()).DoAndReturn(func(b []byte) (int, error) {
+			written += len(b)
+			calls++
+			return len(b), nil
+		}).AnyTimes()
+		if _, errno := fh.Write(t.Context(), []byte("data"), gap); errno != 0 {
+			t.Fatalf("Write failed: %v", errno)
+		}
+		if written != gap+4 || calls < 3 {
+			t.Errorf("wrote %d bytes in %d calls, want %d in at least 3", written, calls, gap+4)
+		}
+		// The file is not extended again.
+		if _, errno := fh.Write(t.Context(), []byte("x"), gap+5); errno != 0 {
+			t.Errorf("Write failed: %v", errno)
+		}
+		if written != gap+6 || len(m.extended) != 1 {
+			t.Errorf("wrote %d bytes after %d Extend calls, want %d after 1", written, len(m.extended), gap+6)
+		}
+	})
+
+	t.Run("Fallback_MaxZeroFill", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		m := mockfs.NewMockFile(ctrl)
+		fh := MakeFileHandle(t, ctrl, m, fsfuse.MaxZeroFill(4))
+
+		if _, errno := fh.Write(t.Context(), []byte("data"), 5); errno != syscall.EFBIG {
+			t.Errorf("Write = %v, want EFBIG", errno)
+		}
+	})
+
+	t.Run("Seeker_Unsupported", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		m := mock.NewMockFullFile(ctrl)
+		fh := MakeFileHandle(t, ctrl, m)
+
+		m.EXPECT().WriteAt(gomock.Any(), gomock.Any()).Return(0, errors.ErrUnsupported)
+		m.EXPECT().Seek(int64(0), io.SeekStart).Return(int64(0), errors.ErrUnsupported)
+		m.EXPECT().Write([]byte("data")).Return(4, nil)
+		if _, errno := fh.Write(t.Context(), []byte("data"), 0); errno != 0 {
+			t.Errorf("Write failed: %v", errno)
+		}
+	})
+
 	t.Run("Fallback_Write_Error", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
@@ -486,6 +915,850 @@ func TestFileHandle_Write(t *testing.T) {
 	})
 }
 
+func TestFileHandle_Stage(t *testing.T) {
+	// open opens "file" of the given size with staged writes, returning the
+	// node, the handle and the mocks of the backend.
+	open := func(t *testing.T, size int64, flags int) (nodeOperations, filehandle, *cmockfs.MockFileSystem, *mockfs.MockFile) {
+		t.Helper()
+		ctrl := gomock.NewController(t)
+		mfs := cmockfs.NewMockFileSystem(ctrl)
+		mfi := setupFileInfo(ctrl, "file", size, 0644)
+		mfs.EXPECT().Lstat(gomock.Any(), "file").Return(mfi, nil).AnyTimes()
+		m := mockfs.NewMockFile(ctrl)
+		m.EXPECT().Stat().Return(mfi, nil)
+		mfs.EXPECT().OpenFile(gomock.Any(), "file", flags, gomock.Any()).Return(m, nil)
+		node := MakeNode(t, mfs, "file", fsfuse.StageWrites(t.TempDir()))
+		fh, _, errno := node.Open(t.Context(), uint32(flags))
+		if errno != 0 {
+			t.Fatalf("Open failed: %v", errno)
+		}
+		return node, fh.(filehandle), mfs, m
+	}
+	write := func(t *testing.T, fh filehandle, data string, off int64) {
+		t.Helper()
+		if _, errno := fh.Write(t.Context(), []byte(data), off); errno != 0 {
+			t.Fatalf("Write(%q, %d) failed: %v", data, off, errno)
+		}
+	}
+	read := func(t *testing.T, fh filehandle) string {
+		t.Helper()
+		dest := make([]byte, 64)
+		res, errno := fh.Read(t.Context(), dest, 0)
+		if errno != 0 {
+			t.Fatalf("Read failed: %v", errno)
+		}
+		d, _ := res.Bytes(dest)
+		return string(d)
+	}
+
+	t.Run("RandomAccess", func(t *testing.T) {
+		node, fh, mfs, m := open(t, 0, os.O_RDWR|os.O_TRUNC)
+		ctx := t.Context()
+		write(t, fh, "world", 6)
+		write(t, fh, "hello ", 0)
+		if got := read(t, fh); got != "hello world" {
+			t.Errorf("Read = %q, want hello world", got)
+		}
+
+		var out fuse.AttrOut
+		if errno := node.Getattr(ctx, nil, &out); errno != 0 || out.Size != 11 {
+			t.Errorf("Getattr = (%d, %v), want the staged size 11", out.Size, errno)
+		}
+		in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: 5}}
+		if errno := node.Setattr(ctx, fh, in, &out); errno != 0 || out.Size != 5 {
+			t.Errorf("Setattr(size 5) = (%d, %v), want 5", out.Size, errno)
+		}
+
+		m.EXPECT().Write([]byte("hello")).Return(5, nil)
+		m.EXPECT().Close().Return(nil)
+		if errno := fh.Flush(ctx); errno != 0 {
+			t.Errorf("Flush failed: %v", errno)
+		}
+		// Written again after the upload, the file is uploaded once more.
+		write(t, fh, "!", 5)
+		m2 := mockfs.NewMockFile(gomock.NewController(t))
+		mfs.EXPECT().OpenFile(gomock.Any(), "file", os.O_WRONLY|os.O_TRUNC, gomock.Any()).Return(m2, nil)
+		m2.EXPECT().Write([]byte("hello!")).Return(6, nil)
+		m2.EXPECT().Close().Return(nil)
+		if errno := fh.Release(ctx); errno != 0 {
+			t.Errorf("Release failed: %v", errno)
+		}
+		// Once released, the backend is consulted again.
+		if errno := node.Getattr(ctx, nil, &out); errno != 0 || out.Size != 0 {
+			t.Errorf("Getattr after Release = (%d, %v), want 0", out.Size, errno)
+		}
+	})
+
+	t.Run("Fill", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mfs := cmockfs.NewMockFileSystem(ctrl)
+		mfi := setupFileInfo(ctrl, "file", 5, 0644)
+		mfs.EXPECT().Lstat(gomock.Any(), "file").Return(mfi, nil).AnyTimes()
+		m := mockfs.NewMockFile(ctrl)
+		m.EXPECT().Stat().Return(mfi, nil)
+		mfs.EXPECT().OpenFile(gomock.Any(), "file", os.O_WRONLY, gomock.Any()).Return(m, nil)
+		r := mockfs.NewMockFile(ctrl)
+		mfs.EXPECT().OpenFile(gomock.Any(), "file", os.O_RDONLY, gomock.Any()).Return(r, nil)
+		r.EXPECT().Read(gomock.Any()).DoAndReturn(func(b []byte) (int, error) {
+			return copy(b, "hello"), io.EOF
+		})
+		r.EXPECT().Close().Return(nil)
+		node := MakeNode(t, mfs, "file", fsfuse.StageWrites(t.TempDir()))
+		f, _, errno := node.Open(t.Context(), uint32(os.O_WRONLY))
+		if errno != 0 {
+			t.Fatalf("Open failed: %v", errno)
+		}
+		fh := f.(filehandle)
+
+		write(t, fh, "J", 0)
+		m.EXPECT().Write([]byte("Jello")).Return(5, nil)
+		m.EXPECT().Close().Return(nil)
+		if errno := fh.Release(t.Context()); errno != 0 {
+			t.Errorf("Release failed: %v", errno)
+		}
+	})
+
+	t.Run("UploadError", func(t *testing.T) {
+		_, fh, _, m := open(t, 0, os.O_WRONLY|os.O_TRUNC)
+		write(t, fh, "data", 0)
+		m.EXPECT().Write([]byte("data")).Return(0, errors.New("quota exceeded"))
+		m.EXPECT().Close().Return(nil)
+		if errno := fh.Flush(t.Context()); errno != syscall.EIO {
+			t.Errorf("Flush = %v, want EIO", errno)
+		}
+	})
+
+	t.Run("Unwritten", func(t *testing.T) {
+		// Opened for writing but never written, the file is not uploaded,
+		// neither on Flush nor on Release.
+		_, fh, _, m := open(t, 0, os.O_WRONLY)
+		if errno := fh.Flush(t.Context()); errno != 0 {
+			t.Errorf("Flush failed: %v", errno)
+		}
+		m.EXPECT().Close().Return(nil)
+		if errno := fh.Release(t.Context()); errno != 0 {
+			t.Errorf("Release failed: %v", errno)
+		}
+	})
+
+	t.Run("ReleaseError", func(t *testing.T) {
+		_, fh, _, m := open(t, 0, os.O_WRONLY|os.O_TRUNC)
+		write(t, fh, "data", 0)
+		m.EXPECT().Write([]byte("data")).Return(0, syscall.EDQUOT)
+		m.EXPECT().Close().Return(errors.New("connection reset"))
+		if errno := fh.Release(t.Context()); errno != syscall.EDQUOT {
+			t.Errorf("Release = %v, want the upload error EDQUOT", errno)
+		}
+	})
+
+	t.Run("CloseError", func(t *testing.T) {
+		_, fh, _, m := open(t, 0, os.O_WRONLY|os.O_TRUNC)
+		m.EXPECT().Write([]byte{}).Return(0, nil).AnyTimes()
+		m.EXPECT().Close().Return(syscall.EDQUOT)
+		if errno := fh.Flush(t.Context()); errno != syscall.EDQUOT {
+			t.Errorf("Flush = %v, want EDQUOT", errno)
+		}
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		_, fh, _, m := open(t, 4, os.O_RDONLY)
+		m.EXPECT().Read(gomock.Any()).DoAndReturn(func(b []byte) (int, error) {
+			return copy(b, "data"), io.EOF
+		})
+		if got := read(t, fh); got != "data" {
+			t.Errorf("Read = %q, want data from the backend", got)
+		}
+		m.EXPECT().Close().Return(nil)
+		if errno := fh.Release(t.Context()); errno != 0 {
+			t.Errorf("Release failed: %v", errno)
+		}
+	})
+}
+
+func TestFileHandle_Spool(t *testing.T) {
+	// open opens "file" read-only with spooled reads from a stream served by
+	// read.
+	open := func(t *testing.T, read func([]byte) (int, error)) (filehandle, *mockfs.MockFile) {
+		t.Helper()
+		ctrl := gomock.NewController(t)
+		mfs := cmockfs.NewMockFileSystem(ctrl)
+		mfi := setupFileInfo(ctrl, "file", 0, 0644)
+		mfs.EXPECT().Lstat(gomock.Any(), "file").Return(mfi, nil).AnyTimes()
+		m := mockfs.NewMockFile(ctrl)
+		m.EXPECT().Stat().Return(mfi, nil)
+		m.EXPECT().Read(gomock.Any()).DoAndReturn(read).AnyTimes()
+		mfs.EXPECT().OpenFile(gomock.Any(), "file", os.O_RDONLY, gomock.Any()).Return(m, nil)
+		node := MakeNode(t, mfs, "file", fsfuse.SpoolReads(t.TempDir()))
+		fh, _, errno := node.Open(t.Context(), uint32(os.O_RDONLY))
+		if errno != 0 {
+			t.Fatalf("Open failed: %v", errno)
+		}
+		return fh.(filehandle), m
+	}
+	// chunks serves data three bytes at a time, failing with err at the end.
+	chunks := func(data string, err error) func([]byte) (int, error) {
+		var mu sync.Mutex
+		pos := 0
+		return func(b []byte) (int, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if pos == len(data) {
+				return 0, err
+			}
+			n := copy(b[:min(len(b), 3)], data[pos:])
+			pos += n
+			return n, nil
+		}
+	}
+	read := func(ctx context.Context, fh filehandle, size int, off int64) (string, syscall.Errno) {
+		dest := make([]byte, size)
+		res, errno := fh.Read(ctx, dest, off)
+		if errno != 0 {
+			return "", errno
+		}
+		d, _ := res.Bytes(dest)
+		return string(d), 0
+	}
+
+	t.Run("RandomReads", func(t *testing.T) {
+		fh, m := open(t, chunks("0123456789", io.EOF))
+		tests := []struct {
+			size int
+			off  int64
+			want string
+		}{
+			{3, 7, "789"},
+			{3, 2, "234"},
+			{10, 8, "89"},
+			{4, 12, ""},
+		}
+		for _, tt := range tests {
+			if got, errno := read(t.Context(), fh, tt.size, tt.off); errno != 0 || got != tt.want {
+				t.Errorf("Read(%d, %d) = (%q, %v), want %q", tt.size, tt.off, got, errno, tt.want)
+			}
+		}
+		m.EXPECT().Close().Return(nil)
+		if errno := fh.Release(t.Context()); errno != 0 {
+			t.Errorf("Release failed: %v", errno)
+		}
+	})
+
+	t.Run("StreamError", func(t *testing.T) {
+		fh, m := open(t, chunks("0123", errors.New("connection reset")))
+		if got, errno := read(t.Context(), fh, 4, 0); errno != 0 || got != "0123" {
+			t.Errorf("Read within the data = (%q, %v), want 0123", got, errno)
+		}
+		if _, errno := read(t.Context(), fh, 4, 2); errno != syscall.EIO {
+			t.Errorf("Read beyond the data = %v, want EIO", errno)
+		}
+		m.EXPECT().Close().Return(nil)
+		_ = fh.Release(t.Context())
+	})
+
+	t.Run("Interrupted", func(t *testing.T) {
+		unblock := make(chan struct{})
+		fh, m := open(t, func([]byte) (int, error) {
+			<-unblock
+			return 0, io.EOF
+		})
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+		if _, errno := read(ctx, fh, 4, 0); errno != syscall.EINTR {
+			t.Errorf("Read = %v, want EINTR", errno)
+		}
+		close(unblock)
+		m.EXPECT().Close().Return(nil)
+		if errno := fh.Release(t.Context()); errno != 0 {
+			t.Errorf("Release failed: %v", errno)
+		}
+	})
+
+	t.Run("ReleaseWhileReading", func(t *testing.T) {
+		// reading is not synchronized, so that the race detector reports
+		// the stream being closed during a read.
+		var reading bool
+		started, unblock := make(chan struct{}), make(chan struct{})
+		fh, m := open(t, func([]byte) (int, error) {
+			reading = true
+			close(started)
+			<-unblock
+			reading = false
+			return 0, io.EOF
+		})
+		m.EXPECT().Close().DoAndReturn(func() error {
+			if reading {
+				t.Error("stream closed during a read")
+			}
+			return nil
+		})
+		<-started
+		released := make(chan syscall.Errno)
+		go func() { released <- fh.Release(t.Context()) }()
+		select {
+		case <-released:
+			t.Fatal("Release returned during a read")
+		case <-time.After(10 * time.Millisecond):
+		}
+		close(unblock)
+		if errno := <-released; errno != 0 {
+			t.Errorf("Release failed: %v", errno)
+		}
+	})
+
+	t.Run("ReleaseStalled", func(t *testing.T) {
+		// The read only returns once the stream is closed, as reads of
+		// network streams do.
+		started, closed := make(chan struct{}), make(chan struct{})
+		fh, m := open(t, func([]byte) (int, error) {
+			close(started)
+			<-closed
+			return 0, iofs.ErrClosed
+		})
+		m.EXPECT().Close().DoAndReturn(func() error {
+			close(closed)
+			return nil
+		})
+		<-started
+		released := make(chan syscall.Errno)
+		go func() { released <- fh.Release(t.Context()) }()
+		select {
+		case errno := <-released:
+			if errno != 0 {
+				t.Errorf("Release failed: %v", errno)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Release hung on a stalled read")
+		}
+	})
+}
+
+// memFile is a file which can be read and written at an offset, recording
+// the reads. Unlike mocks, it can be read by prefetching after the test has
+// ended.
+type memFile struct {
+	fsx.File
+
+	mu    sync.Mutex
+	data  []byte
+	reads map[int64]int
+	// hold, if set, holds writes until it is closed; held counts them.
+	hold chan struct{}
+	held atomic.Int32
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reads[off] = len(b)
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	if f.hold != nil {
+		f.held.Add(1)
+		<-f.hold
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return copy(f.data[off:], b), nil
+}
+
+func (f *memFile) Close() error { return nil }
+
+// prefetched returns the number of reads larger than size.
+func (f *memFile) prefetched(size int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, l := range f.reads {
+		if l > size {
+			n++
+		}
+	}
+	return n
+}
+
+func TestFileHandle_Readahead(t *testing.T) {
+	const size = 1<<20 + 1000
+	open := func(t *testing.T) (filehandle, *memFile) {
+		t.Helper()
+		ctrl := gomock.NewController(t)
+		m := mockfs.NewMockFile(ctrl)
+		m.EXPECT().Stat().Return(setupFileInfo(ctrl, "file", size, 0644), nil)
+		f := &memFile{File: m, data: make([]byte, size), reads: make(map[int64]int)}
+		for i := range f.data {
+			f.data[i] = byte(i * 7)
+		}
+		return MakeFileHandle(t, ctrl, f, fsfuse.Readahead(512<<10, 0)), f
+	}
+	read := func(t *testing.T, fh filehandle, f *memFile, off int64, n int) {
+		t.Helper()
+		dest := make([]byte, n)
+		res, errno := fh.Read(t.Context(), dest, off)
+		if errno != 0 {
+			t.Fatalf("Read(%d) failed: %v", off, errno)
+		}
+		d, _ := res.Bytes(dest)
+		f.mu.Lock()
+		want := f.data[min(off, size):min(off+int64(n), size)]
+		f.mu.Unlock()
+		if string(d) != string(want) {
+			t.Fatalf("Read(%d) returned %d bytes differing from the file", off, len(d))
+		}
+	}
+
+	t.Run("Sequential", func(t *testing.T) {
+		fh, f := open(t)
+		for off := int64(0); off < size+4096; off += 4096 {
+			read(t, fh, f, off, 4096)
+		}
+		if n := f.prefetched(4096); n < 8 {
+			t.Errorf("%d chunks prefetched, want the whole file", n)
+		}
+		if errno := fh.Release(t.Context()); errno != 0 {
+			t.Errorf("Release failed: %v", errno)
+		}
+	})
+
+	t.Run("Random", func(t *testing.T) {
+		fh, f := open(t)
+		for _, off := range []int64{900 << 10, 10 << 10, 500 << 10, 300 << 10} {
+			read(t, fh, f, off, 4096)
+		}
+		if n := f.prefetched(4096); n != 0 {
+			t.Errorf("%d chunks prefetched on random access, want none", n)
+		}
+		_ = fh.Release(t.Context())
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		fh, f := open(t)
+		read(t, fh, f, 0, 4096)
+		read(t, fh, f, 4096, 4096)
+		// The prefetched data is dropped rather than served stale.
+		if _, errno := fh.Write(t.Context(), []byte("fresh"), 8192); errno != 0 {
+			t.Fatalf("Write failed: %v", errno)
+		}
+		read(t, fh, f, 8192, 4096)
+		_ = fh.Release(t.Context())
+	})
+}
+
+func TestFileHandle_ReadaheadWriteBehind(t *testing.T) {
+	const size = 512 << 10
+	ctrl := gomock.NewController(t)
+	m := mockfs.NewMockFile(ctrl)
+	m.EXPECT().Stat().Return(setupFileInfo(ctrl, "file", size, 0644), nil)
+	f := &memFile{File: m, data: make([]byte, size), reads: make(map[int64]int)}
+	fh := MakeFileHandle(t, ctrl, f, fsfuse.Readahead(512<<10, 0), fsfuse.WriteBehind(64<<10))
+
+	// The write is buffered while the sequential reads before it prefetch
+	// the old data of the backend.
+	if _, errno := fh.Write(t.Context(), []byte("fresh"), 200<<10); errno != 0 {
+		t.Fatalf("Write failed: %v", errno)
+	}
+	dest := make([]byte, 4096)
+	for off := int64(0); off < 200<<10; off += 4096 {
+		if _, errno := fh.Read(t.Context(), dest, off); errno != 0 {
+			t.Fatalf("Read(%d) failed: %v", off, errno)
+		}
+	}
+	if f.prefetched(4096) == 0 {
+		t.Fatal("nothing prefetched")
+	}
+
+	res, errno := fh.Read(t.Context(), dest, 200<<10)
+	if errno != 0 {
+		t.Fatalf("Read failed: %v", errno)
+	}
+	if d, _ := res.Bytes(dest); string(d[:5]) != "fresh" {
+		t.Errorf("Read after the buffered write = %q, want fresh", d[:5])
+	}
+	_ = fh.Release(t.Context())
+}
+
+func TestFileHandle_WriteBehind(t *testing.T) {
+	open := func(t *testing.T) (filehandle, *mock.MockFullFile) {
+		t.Helper()
+		ctrl := gomock.NewController(t)
+		m := mock.NewMockFullFile(ctrl)
+		return MakeFileHandle(t, ctrl, m, fsfuse.WriteBehind(8)), m
+	}
+	write := func(t *testing.T, fh filehandle, data string, off int64) syscall.Errno {
+		t.Helper()
+		n, errno := fh.Write(t.Context(), []byte(data), off)
+		if errno == 0 && int(n) != len(data) {
+			t.Errorf("Write(%q) = %d, want %d", data, n, len(data))
+		}
+		return errno
+	}
+
+	t.Run("Coalesce", func(t *testing.T) {
+		fh, m := open(t)
+		for i, data := range []string{"ab", "cd", "ef"} {
+			if errno := write(t, fh, data, int64(2*i)); errno != 0 {
+				t.Fatalf("Write failed: %v", errno)
+			}
+		}
+		m.EXPECT().WriteAt([]byte("abcdef"), int64(0)).Return(6, nil)
+		if errno := fh.Flush(t.Context()); errno != 0 {
+			t.Errorf("Flush failed: %v", errno)
+		}
+		if errno := fh.Flush(t.Context()); errno != 0 {
+			t.Errorf("second Flush failed: %v", errno)
+		}
+	})
+
+	t.Run("NotAdjacent", func(t *testing.T) {
+		fh, m := open(t)
+		gomock.InOrder(
+			m.EXPECT().WriteAt([]byte("ab"), int64(0)).Return(2, nil),
+			m.EXPECT().WriteAt([]byte("xy"), int64(10)).Return(2, nil),
+			m.EXPECT().Close().Return(nil),
+		)
+		_ = write(t, fh, "ab", 0)
+		_ = write(t, fh, "xy", 10)
+		if errno := fh.Release(t.Context()); errno != 0 {
+			t.Errorf("Release failed: %v", errno)
+		}
+	})
+
+	t.Run("Threshold", func(t *testing.T) {
+		fh, m := open(t)
+		m.EXPECT().WriteAt([]byte("abcdefgh"), int64(0)).Return(8, nil)
+		m.EXPECT().WriteAt([]byte("0123456789"), int64(8)).Return(10, nil)
+		_ = write(t, fh, "abcd", 0)
+		_ = write(t, fh, "efgh", 4)
+		_ = write(t, fh, "0123456789", 8)
+	})
+
+	t.Run("DeferredError", func(t *testing.T) {
+		fh, m := open(t)
+		m.EXPECT().WriteAt([]byte("abcdefgh"), int64(0)).Return(0, syscall.ENOSPC)
+		_ = write(t, fh, "abcd", 0)
+		if errno := write(t, fh, "efgh", 4); errno != 0 {
+			t.Errorf("Write filling the buffer = %v, want it accepted", errno)
+		}
+		if errno := write(t, fh, "ij", 8); errno != syscall.ENOSPC {
+			t.Errorf("next Write = %v, want the deferred ENOSPC", errno)
+		}
+		if errno := fh.Flush(t.Context()); errno != 0 {
+			t.Errorf("Flush = %v, want the error reported only once", errno)
+		}
+	})
+
+	t.Run("ErrorOnClose", func(t *testing.T) {
+		fh, m := open(t)
+		m.EXPECT().WriteAt([]byte("ab"), int64(0)).Return(0, syscall.EDQUOT)
+		_ = write(t, fh, "ab", 0)
+		if errno := fh.Flush(t.Context()); errno != syscall.EDQUOT {
+			t.Errorf("Flush = %v, want EDQUOT", errno)
+		}
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		fh, m := open(t)
+		_ = write(t, fh, "ab", 0)
+		gomock.InOrder(
+			m.EXPECT().WriteAt([]byte("ab"), int64(0)).Return(2, nil),
+			m.EXPECT().ReadAt(gomock.Any(), int64(0)).DoAndReturn(func(b []byte, _ int64) (int, error) {
+				return copy(b, "ab"), io.EOF
+			}),
+		)
+		if _, errno := fh.Read(t.Context(), make([]byte, 4), 0); errno != 0 {
+			t.Errorf("Read failed: %v", errno)
+		}
+	})
+
+	t.Run("Fsync", func(t *testing.T) {
+		fh, m := open(t)
+		_ = write(t, fh, "ab", 0)
+		m.EXPECT().WriteAt([]byte("ab"), int64(0)).Return(2, nil)
+		if errno := fh.(fs.FileFsyncer).Fsync(t.Context(), 0); errno != 0 {
+			t.Errorf("Fsync failed: %v", errno)
+		}
+	})
+
+	t.Run("Getattr", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mfs := cmockfs.NewMockFileSystem(ctrl)
+		mfi := setupFileInfo(ctrl, "file", 4, 0644)
+		mfs.EXPECT().Lstat(gomock.Any(), "file").Return(mfi, nil).AnyTimes()
+		m := mock.NewMockFullFile(ctrl)
+		m.EXPECT().Stat().Return(mfi, nil).AnyTimes()
+		mfs.EXPECT().OpenFile(gomock.Any(), "file", gomock.Any(), gomock.Any()).Return(m, nil)
+		node := MakeNode(t, mfs, "file", fsfuse.WriteBehind(8))
+		f, _, errno := node.Open(t.Context(), uint32(os.O_WRONLY))
+		if errno != 0 {
+			t.Fatalf("Open failed: %v", errno)
+		}
+		fh := f.(filehandle)
+		_ = write(t, fh, "abc", 4)
+
+		var out fuse.AttrOut
+		if errno := node.Getattr(t.Context(), nil, &out); errno != 0 || out.Size != 7 {
+			t.Errorf("Getattr = (%d, %v), want the buffered size 7", out.Size, errno)
+		}
+		// Truncating writes the buffer first.
+		m.EXPECT().WriteAt([]byte("abc"), int64(4)).Return(3, nil)
+		mfs.EXPECT().Truncate(gomock.Any(), "file", int64(2)).Return(nil)
+		in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: 2}}
+		if errno := node.Setattr(t.Context(), nil, in, &out); errno != 0 {
+			t.Errorf("Setattr failed: %v", errno)
+		}
+		m.EXPECT().Close().Return(nil)
+		_ = fh.Release(t.Context())
+		if errno := node.Getattr(t.Context(), nil, &out); errno != 0 || out.Size != 4 {
+			t.Errorf("Getattr after Release = (%d, %v), want 4", out.Size, errno)
+		}
+	})
+}
+
+// barrierFile is a file whose reads and writes at an offset wait until n of
+// them are in progress, or fail after a second.
+type barrierFile struct {
+	fsx.File
+	n       int
+	mu      sync.Mutex
+	pending int
+	ready   chan struct{}
+}
+
+func (f *barrierFile) wait() error {
+	f.mu.Lock()
+	f.pending++
+	if f.pending == f.n {
+		close(f.ready)
+	}
+	f.mu.Unlock()
+	select {
+	case <-f.ready:
+		return nil
+	case <-time.After(time.Second):
+		return syscall.EDEADLK
+	}
+}
+
+func (f *barrierFile) ReadAt(b []byte, off int64) (int, error) {
+	return len(b), f.wait()
+}
+
+func (f *barrierFile) WriteAt(b []byte, off int64) (int, error) {
+	return len(b), f.wait()
+}
+
+func TestFileHandle_Parallel(t *testing.T) {
+	const n = 4
+	tests := []struct {
+		name string
+		op   func(context.Context, filehandle, int64) syscall.Errno
+	}{
+		{"Read", func(ctx context.Context, fh filehandle, off int64) syscall.Errno {
+			_, errno := fh.Read(ctx, make([]byte, 4096), off)
+			return errno
+		}},
+		{"Write", func(ctx context.Context, fh filehandle, off int64) syscall.Errno {
+			_, errno := fh.Write(ctx, make([]byte, 4096), off)
+			return errno
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			m := mockfs.NewMockFile(ctrl)
+			m.EXPECT().Stat().Return(setupFileInfo(ctrl, "file", 0, 0644), nil)
+			fh := MakeFileHandle(t, ctrl, &barrierFile{File: m, n: n, ready: make(chan struct{})})
+
+			var wg sync.WaitGroup
+			errnos := make([]syscall.Errno, n)
+			for i := range n {
+				wg.Go(func() {
+					errnos[i] = tt.op(t.Context(), fh, int64(i)*4096)
+				})
+			}
+			wg.Wait()
+			for i, errno := range errnos {
+				if errno != 0 {
+					t.Errorf("%s %d = %v, want all of them in parallel", tt.name, i, errno)
+				}
+			}
+		})
+	}
+}
+
+func TestFileHandle_ReadAfterWrite(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := mockfs.NewMockFile(ctrl)
+	m.EXPECT().Stat().Return(setupFileInfo(ctrl, "file", 1<<20, 0644), nil)
+	f := &memFile{File: m, data: make([]byte, 1<<20), reads: make(map[int64]int), hold: make(chan struct{})}
+	fh := MakeFileHandle(t, ctrl, f, fsfuse.Readahead(512<<10, 0))
+	read := func(off int64) string {
+		t.Helper()
+		dest := make([]byte, 5)
+		res, errno := fh.Read(t.Context(), dest, off)
+		if errno != 0 {
+			t.Fatalf("Read(%d) failed: %v", off, errno)
+		}
+		d, _ := res.Bytes(dest)
+		return string(d)
+	}
+	read(0)
+	read(4096)
+
+	// A sequential read prefetches the old data while the write is in
+	// progress.
+	written := make(chan syscall.Errno)
+	go func() {
+		_, errno := fh.Write(t.Context(), []byte("fresh"), 8192)
+		written <- errno
+	}()
+	for f.held.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	f.mu.Lock()
+	clear(f.reads)
+	f.mu.Unlock()
+	read(8192)
+	for f.prefetched(4096) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(f.hold)
+	if errno := <-written; errno != 0 {
+		t.Fatalf("Write failed: %v", errno)
+	}
+
+	// Reads after the write has returned see its data.
+	if got := read(8192); got != "fresh" {
+		t.Errorf("Read after Write = %q, want fresh", got)
+	}
+	_ = fh.Release(t.Context())
+}
+
+// appendFile is a file with an append operation.
+type appendFile struct {
+	*mock.MockFullFile
+	appended []byte
+}
+
+func (f *appendFile) Append(p []byte) (int, error) {
+	f.appended = append(f.appended, p...)
+	return len(p), nil
+}
+
+// extendFile is a stream which can skip ahead, failing with err.
+type extendFile struct {
+	*mockfs.MockFile
+	err      error
+	extended []int64
+}
+
+func (f *extendFile) Extend(off int64) error {
+	f.extended = append(f.extended, off)
+	return f.err
+}
+
+// writerAtFile is a stream which can also be written at an offset.
+type writerAtFile struct {
+	*mockfs.MockFile
+	off int64
+	buf []byte
+}
+
+func (f *writerAtFile) WriteAt(p []byte, off int64) (int, error) {
+	f.off, f.buf = off, append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestFileHandle_Append(t *testing.T) {
+	const flags = os.O_WRONLY | os.O_APPEND
+	write := func(t *testing.T, fh filehandle) {
+		t.Helper()
+		// The kernel's idea of the end of the file is stale.
+		n, errno := fh.Write(t.Context(), []byte("log\n"), 3)
+		if errno != 0 || n != 4 {
+			t.Errorf("Write = (%d, %v), want (4, 0)", n, errno)
+		}
+	}
+
+	t.Run("Appender", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		f := &appendFile{MockFullFile: mock.NewMockFullFile(ctrl)}
+		f.EXPECT().Stat().Return(nil, syscall.ENOSYS)
+		fh := OpenFileHandle(t, ctrl, f, flags)
+		write(t, fh)
+		if string(f.appended) != "log\n" {
+			t.Errorf("appended %q, want log", f.appended)
+		}
+	})
+
+	t.Run("Seeker", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		m := mock.NewMockFullFile(ctrl)
+		fh := OpenFileHandle(t, ctrl, m, flags)
+		gomock.InOrder(
+			m.EXPECT().Seek(int64(0), io.SeekEnd).Return(int64(100), nil),
+			m.EXPECT().Write([]byte("log\n")).Return(4, nil),
+		)
+		write(t, fh)
+	})
+
+	t.Run("WriterAt", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		f := &writerAtFile{MockFile: mockfs.NewMockFile(ctrl)}
+		f.EXPECT().Stat().Return(nil, syscall.ENOSYS)
+		fh := OpenFileHandle(t, ctrl, f, flags)
+		f.EXPECT().Stat().Return(setupFileInfo(ctrl, "file", 100, 0644), nil)
+		write(t, fh)
+		if f.off != 100 || string(f.buf) != "log\n" {
+			t.Errorf("wrote %q at %d, want log at 100", f.buf, f.off)
+		}
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		m := mockfs.NewMockFile(ctrl)
+		fh := OpenFileHandle(t, ctrl, m, flags)
+		// Written as is, without padding up to the offset.
+		m.EXPECT().Write([]byte("log\n")).Return(4, nil)
+		write(t, fh)
+	})
+
+	t.Run("WriteBehind", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		m := mock.NewMockFullFile(ctrl)
+		fh := OpenFileHandle(t, ctrl, m, flags, fsfuse.WriteBehind(64))
+		write(t, fh)
+		if _, errno := fh.Write(t.Context(), []byte("log\n"), 7); errno != 0 {
+			t.Fatalf("Write failed: %v", errno)
+		}
+		gomock.InOrder(
+			m.EXPECT().Seek(int64(0), io.SeekEnd).Return(int64(100), nil),
+			m.EXPECT().Write([]byte("log\nlog\n")).Return(8, nil),
+		)
+		if errno := fh.Flush(t.Context()); errno != 0 {
+			t.Errorf("Flush failed: %v", errno)
+		}
+	})
+
+	t.Run("SeekError", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		m := mock.NewMockFullFile(ctrl)
+		fh := OpenFileHandle(t, ctrl, m, flags)
+		m.EXPECT().Seek(int64(0), io.SeekEnd).Return(int64(0), syscall.ESPIPE)
+		if _, errno := fh.Write(t.Context(), []byte("log\n"), 3); errno != syscall.ESPIPE {
+			t.Errorf("Write = %v, want ESPIPE", errno)
+		}
+	})
+}
+
 func TestFileHandle_Flush_Release(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -503,3 +1776,108 @@ func TestFileHandle_Flush_Release(t *testing.T) {
 		t.Errorf("Release failed: %v", errno)
 	}
 }
+
+func TestFileHandle_Atime(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	tests := []struct {
+		name   string
+		opts   []fsfuse.Option
+		read   bool
+		atime  time.Time
+		mtime  time.Time
+		update bool
+	}{
+		{"Disabled", nil, true, old, old, false},
+		{"NoAtime", []fsfuse.Option{fsfuse.Atime(fsfuse.NoAtime)}, true, old, old, false},
+		{"NotRead", []fsfuse.Option{fsfuse.Atime(fsfuse.StrictAtime)}, false, old, old, false},
+		{"Strict", []fsfuse.Option{fsfuse.Atime(fsfuse.StrictAtime)}, true, now, old, true},
+		{"Relatime_Recent", []fsfuse.Option{fsfuse.Atime(fsfuse.RelAtime)}, true, now, old, false},
+		{"Relatime_Modified", []fsfuse.Option{fsfuse.Atime(fsfuse.RelAtime)}, true, old, now, true},
+		{"Relatime_Stale", []fsfuse.Option{fsfuse.Atime(fsfuse.RelAtime)}, true, old, old.Add(-time.Hour), true},
+		{"ZeroPolicy_Recent", []fsfuse.Option{fsfuse.Atime(fsfuse.AtimePolicy(0))}, true, now, old, false},
+		{"ZeroPolicy_Stale", []fsfuse.Option{fsfuse.Atime(fsfuse.AtimePolicy(0))}, true, old, old.Add(-time.Hour), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ctx := t.Context()
+			mfs := cmockfs.NewMockFileSystem(ctrl)
+			mfi := mockfs.NewMockFileInfo(ctrl)
+			mfi.EXPECT().Name().Return("file").AnyTimes()
+			mfi.EXPECT().Size().Return(int64(4)).AnyTimes()
+			mfi.EXPECT().Mode().Return(iofs.FileMode(0644)).AnyTimes()
+			mfi.EXPECT().ModTime().Return(tt.mtime).AnyTimes()
+			mfi.EXPECT().IsDir().Return(false).AnyTimes()
+			mfi.EXPECT().Sys().Return(nil).AnyTimes()
+			mfi.EXPECT().AccessTime().Return(tt.atime).AnyTimes()
+			mfi.EXPECT().ChangeTime().Return(tt.mtime).AnyTimes()
+			mfi.EXPECT().Owner().Return("1000").AnyTimes()
+			mfi.EXPECT().Group().Return("1000").AnyTimes()
+			mfs.EXPECT().Lstat(gomock.Any(), "file").Return(mfi, nil).AnyTimes()
+
+			m := mock.NewMockFullFile(ctrl)
+			m.EXPECT().Stat().Return(mfi, nil)
+			mfs.EXPECT().OpenFile(gomock.Any(), "file", gomock.Any(), gomock.Any()).Return(m, nil)
+			node := MakeNode(t, mfs, "file", tt.opts...)
+			f, _, errno := node.Open(ctx, uint32(os.O_RDONLY))
+			if errno != 0 {
+				t.Fatalf("Open failed: %v", errno)
+			}
+			fh := f.(filehandle)
+
+			if tt.read {
+				m.EXPECT().ReadAt(gomock.Any(), int64(0)).Return(4, nil).Times(2)
+				for range 2 {
+					if _, errno := fh.Read(ctx, make([]byte, 4), 0); errno != 0 {
+						t.Fatalf("Read failed: %v", errno)
+					}
+				}
+			}
+
+			m.EXPECT().Close().Return(nil)
+			if tt.update {
+				mfs.EXPECT().Chtimes(gomock.Any(), "file", gomock.Any(), tt.mtime).DoAndReturn(func(_ context.Context, _ string, atime, _ time.Time) error {
+					if atime.Before(now) {
+						t.Errorf("Chtimes: atime %v is older than the read", atime)
+					}
+					return nil
+				})
+			}
+			if errno := fh.Release(ctx); errno != 0 {
+				t.Errorf("Release failed: %v", errno)
+			}
+		})
+	}
+}
+
+func TestFileHandle_AtimeCreated(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ctx := t.Context()
+	mfs := cmockfs.NewMockFileSystem(ctrl)
+	root := MakeNode(t, mfs, ".", fsfuse.Atime(fsfuse.StrictAtime))
+
+	mfi := setupFileInfo(ctrl, "new", 4, 0644)
+	m := mock.NewMockFullFile(ctrl)
+	mfs.EXPECT().OpenFile(gomock.Any(), "new", gomock.Any(), gomock.Any()).Return(m, nil)
+	m.EXPECT().Stat().Return(mfi, nil)
+	_, f, _, errno := root.Create(ctx, "new", uint32(os.O_RDWR), 0644, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Create failed: %v", errno)
+	}
+	fh := f.(filehandle)
+	m.EXPECT().ReadAt(gomock.Any(), int64(0)).Return(4, nil)
+	if _, errno := fh.Read(ctx, make([]byte, 4), 0); errno != 0 {
+		t.Fatalf("Read failed: %v", errno)
+	}
+
+	// The access time of the created file is updated, not the one of its
+	// directory.
+	m.EXPECT().Close().Return(nil)
+	mfs.EXPECT().Lstat(gomock.Any(), "new").Return(mfi, nil)
+	mfs.EXPECT().Chtimes(gomock.Any(), "new", gomock.Any(), gomock.Any()).Return(nil)
+	if errno := fh.Release(ctx); errno != 0 {
+		t.Errorf("Release failed: %v", errno)
+	}
+}
@@ -4,16 +4,146 @@
 package fsfuse
 
 import (
+	"context"
+	iofs "io/fs"
 	"log/slog"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gwangyi/fsx/contextual"
 	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 type config struct {
 	// logger is the sink for all internal errors and diagnostic messages.
 	// It defaults to slog.Default() if not provided via options.
 	logger *slog.Logger
+
+	// directIO lists glob patterns of paths which are always opened with
+	// FOPEN_DIRECT_IO, bypassing the kernel page cache.
+	directIO []string
+
+	// cachePolicy, if set, makes the final decision on the FOPEN_* flags
+	// returned by Open and Create.
+	cachePolicy CachePolicy
+
+	// errorTranslators are consulted in order before the default error
+	// mapping of toErrno.
+	errorTranslators []ErrorTranslator
+
+	// hide lists glob patterns of paths hidden from the mount.
+	hide []string
+	// hideFuncs are predicates on paths hidden from the mount.
+	hideFuncs []func(name string) bool
+	// hiddenErrno is returned when creating an entry with a hidden name.
+	hiddenErrno syscall.Errno
+
+	// caseInsensitive makes name lookups ignore case.
+	caseInsensitive bool
+	// casePreserving keeps the case of new names in case-insensitive mode.
+	casePreserving bool
+	// collision decides how entries differing only in case are handled.
+	collision CollisionPolicy
+	// normalization is the Unicode form names are converted to, if non-zero.
+	normalization NormalizationForm
+
+	// root is the path of the directory of the backend exposed as the root
+	// of the mount. It is "." unless Subtree is given.
+	root string
+
+	// symlinks is the policy for symbolic links.
+	symlinks SymlinkPolicy
+
+	// atime is the policy for updating access times.
+	atime AtimePolicy
+
+	// maxNameLen and maxPathLen limit the length of names and backend
+	// paths. Zero means no limit.
+	maxNameLen int
+	maxPathLen int
+
+	// logPolicy decides how failures are logged; nil means
+	// DefaultLogPolicy.
+	logPolicy LogPolicy
+	// logBurst and logInterval configure the sampling of identical log
+	// records. Zero logBurst disables sampling.
+	logBurst    int
+	logInterval time.Duration
+	sampler     logSampler
+
+	// fsName, timeouts and fuseOptions configure Mount. A nil timeouts
+	// means the defaults.
+	fsName      string
+	timeouts    *[3]time.Duration
+	fuseOptions []func(*fs.Options)
+
+	// readOnly rejects modifications with EROFS.
+	readOnly bool
+	// ownerMapper and groupMapper change the presented owner and group.
+	ownerMapper func(context.Context, string) string
+	groupMapper func(context.Context, string) string
+	// fmask and dmask are cleared from the permissions of files and
+	// directories.
+	fmask iofs.FileMode
+	dmask iofs.FileMode
+
+	// replaySize is the size of the buffer serving backward reads on
+	// streams. Zero disables it.
+	replaySize int
+
+	// stageWrites stages writes to streams in temporary files in stageDir.
+	stageWrites bool
+	stageDir    string
+	// spoolReads copies streams read into temporary files in spoolDir.
+	spoolReads bool
+	spoolDir   string
+
+	// readahead configures prefetching; nil disables it.
+	readahead *readaheadConfig
+
+	// writeBehind is the size of the write buffer of handles; zero disables
+	// buffering.
+	writeBehind int
+
+	// maxZeroFill is the largest gap filled with zeros in streams; negative
+	// values do not limit it.
+	maxZeroFill int64
+
+	// resumeAttempts is the number of times a failed read is retried on a
+	// reopened file; zero disables resuming.
+	resumeAttempts int
+}
+
+// hidden reports whether the given backend path is hidden from the mount.
+// Hide patterns and HideFunc functions see the path relative to the
+// filesystem root, which differs from the backend path under Subtree.
+func (c *config) hidden(name string) bool {
+	name = c.mountPath(name)
+	if matchPath(c.hide, name) {
+		return true
+	}
+	for _, f := range c.hideFuncs {
+		if f(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// toErrno converts err into a syscall.Errno, giving the configured
+// ErrorTranslators a chance before falling back to the default mapping.
+func (c *config) toErrno(err error) syscall.Errno {
+	if err == nil {
+		return 0
+	}
+	for _, t := range c.errorTranslators {
+		if errno := t(err); errno != 0 {
+			return errno
+		}
+	}
+	return toErrno(err)
 }
 
 // Option configures the FUSE filesystem behavior.
@@ -29,23 +159,221 @@ func Logger(l *slog.Logger) Option {
 	}
 }
 
+// CachePolicy decides the FOPEN_* flags returned to the kernel when a file is
+// opened or created.
+// It receives the path of the file relative to the filesystem root, the
+// open(2) flags, the attributes of the opened file (nil if they could not be
+// retrieved) and the flags fsfuse would return on its own.
+// The returned value is passed to the kernel as is.
+type CachePolicy func(ctx context.Context, name string, flags uint32, fi iofs.FileInfo, def uint32) uint32
+
+// DirectIO makes files whose path matches any of the given glob patterns
+// bypass the kernel page cache (FOPEN_DIRECT_IO).
+// Patterns use path.Match syntax. A pattern containing a slash is matched
+// against the full path relative to the filesystem root; otherwise it is
+// matched against the base name only.
+// Files opened with O_DIRECT always bypass the page cache.
+func DirectIO(patterns ...string) Option {
+	return func(c *config) {
+		c.directIO = append(c.directIO, patterns...)
+	}
+}
+
+// CacheControl installs a callback which makes the final decision on the
+// FOPEN_* flags returned when a file is opened.
+// This allows custom caching decisions on top of the default policy, which
+// keeps the page cache only if the size and modification time of the file are
+// unchanged since it was last opened.
+func CacheControl(p CachePolicy) Option {
+	return func(c *config) {
+		c.cachePolicy = p
+	}
+}
+
+// ErrorTranslator converts an error returned by the backend into the errno
+// reported to the kernel.
+// It returns 0 if it does not recognize the error, in which case the next
+// translator or the default mapping is used.
+type ErrorTranslator func(err error) syscall.Errno
+
+// TranslateErrors registers an ErrorTranslator for backends with their own
+// error types. Translators are consulted in the order they are registered,
+// before the default mapping of io/fs, fsx, context and syscall errors.
+func TranslateErrors(t ErrorTranslator) Option {
+	return func(c *config) {
+		c.errorTranslators = append(c.errorTranslators, t)
+	}
+}
+
+// MessageErrors is an ErrorTranslator for backends which lose the type of
+// their errors, e.g. across the network. An error in the chain whose message
+// is the description of a well-known errno, such as "directory not empty",
+// is mapped to that errno. Messages are not a contract, so it is only used
+// if registered with TranslateErrors.
+func MessageErrors(err error) syscall.Errno {
+	errno, _ := errnoFromMessage(err)
+	return errno
+}
+
+// Hide keeps backend entries whose path matches any of the given glob
+// patterns out of the mount.
+// Patterns follow the same rules as DirectIO. Hidden entries are left out of
+// directory listings, cannot be looked up, and cannot be created or renamed
+// into; see HiddenErrno.
+func Hide(patterns ...string) Option {
+	return func(c *config) {
+		c.hide = append(c.hide, patterns...)
+	}
+}
+
+// HideFunc is like Hide, but hides entries for which f returns true.
+// f receives the path of the entry relative to the filesystem root.
+func HideFunc(f func(name string) bool) Option {
+	return func(c *config) {
+		c.hideFuncs = append(c.hideFuncs, f)
+	}
+}
+
+// HiddenErrno sets the errno returned when creating, making a directory,
+// symlinking or renaming into a hidden name. It defaults to EPERM.
+// Operations on existing hidden entries always fail with ENOENT, as they do
+// not exist as far as the mount is concerned.
+func HiddenErrno(errno syscall.Errno) Option {
+	return func(c *config) {
+		c.hiddenErrno = errno
+	}
+}
+
+// Subtree exposes only the given directory of the backend, rather than its
+// root. dir is a slash-separated path as accepted by fs.ValidPath, with an
+// optional trailing slash, and must be an existing directory.
+//
+// NewContext and Mount check dir up front and fail if it is not valid. New
+// cannot report errors, so it defers them to the operations on the
+// filesystem: with an invalid path, such as an absolute one or one climbing
+// with "..", they all fail with EINVAL and log the error, and with a missing
+// directory they fail as the backend reports.
+//
+// Unless another SymlinkPolicy is chosen, symbolic links whose target is
+// absolute or climbs above dir can neither be created nor read through the
+// mount, so that the rest of the backend cannot be reached from it.
+func Subtree(dir string) Option {
+	return func(c *config) {
+		if len(dir) > 1 {
+			dir = strings.TrimSuffix(dir, "/")
+		}
+		c.root = dir
+	}
+}
+
 // New creates a new FUSE root node that serves the given contextual filesystem.
 // The returned InodeEmbedder can be passed to fs.Mount to mount the filesystem.
 // The resulting FUSE filesystem delegates operations to the provided fsys,
 // handling translation between FUSE operations and fsx interface methods.
 //
 // New accepts optional configuration functions (Option) to customize behavior,
-// such as setting a custom logger.
+// such as setting a custom logger. Errors in the configuration are reported
+// by the operations on the filesystem; use NewContext to have them reported
+// up front.
 func New(fsys contextual.FS, opts ...Option) fs.InodeEmbedder {
-	cfg := config{
-		logger: slog.Default(),
+	cfg := newConfig(opts)
+	if err := cfg.checkRoot(); err != nil {
+		return &invalidRoot{logger: cfg.logger, err: err}
+	}
+	return newRoot(fsys, cfg)
+}
+
+// invalidRoot is the root of a filesystem created by New with an invalid
+// configuration. Its operations fail with EINVAL and log err, which New
+// could not report; nothing reaches the backend.
+type invalidRoot struct {
+	fs.Inode
+	logger *slog.Logger
+	err    error
+}
+
+var _ fs.NodeGetattrer = &invalidRoot{}
+var _ fs.NodeLookuper = &invalidRoot{}
+var _ fs.NodeOpendirer = &invalidRoot{}
+var _ fs.NodeReaddirer = &invalidRoot{}
+
+// fail logs the configuration error for op and returns EINVAL.
+func (r *invalidRoot) fail(op string) syscall.Errno {
+	r.logger.Error("Invalid configuration", "op", op, "error", r.err)
+	return syscall.EINVAL
+}
+
+func (r *invalidRoot) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	return r.fail("Getattr")
+}
+
+func (r *invalidRoot) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return nil, r.fail("Lookup")
+}
+
+func (r *invalidRoot) Opendir(ctx context.Context) syscall.Errno {
+	return r.fail("Opendir")
+}
+
+func (r *invalidRoot) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	return nil, r.fail("Readdir")
+}
+
+// NewContext is like New, but also validates the configuration against the
+// backend. In particular, it checks that the directory given to Subtree
+// exists and is a directory.
+func NewContext(ctx context.Context, fsys contextual.FS, opts ...Option) (fs.InodeEmbedder, error) {
+	root, err := newCheckedRoot(ctx, fsys, newConfig(opts))
+	if err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// newCheckedRoot creates the root node after validating its directory.
+func newCheckedRoot(ctx context.Context, fsys contextual.FS, cfg *config) (*node, error) {
+	if err := cfg.checkRoot(); err != nil {
+		return nil, err
+	}
+	fi, err := contextual.Lstat(ctx, fsys, cfg.root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, &iofs.PathError{Op: "subtree", Path: cfg.root, Err: syscall.ENOTDIR}
+	}
+	return newRoot(fsys, cfg), nil
+}
+
+// checkRoot checks that the directory given to Subtree is a valid path.
+func (c *config) checkRoot() error {
+	if !iofs.ValidPath(c.root) {
+		return &iofs.PathError{Op: "subtree", Path: c.root, Err: iofs.ErrInvalid}
+	}
+	return nil
+}
+
+// newConfig builds a config from the defaults and the given options.
+func newConfig(opts []Option) *config {
+	cfg := &config{
+		logger:      slog.Default(),
+		hiddenErrno: syscall.EPERM,
+		root:        ".",
+		maxZeroFill: -1,
+		atime:       NoAtime,
 	}
 	for _, opt := range opts {
-		opt(&cfg)
+		opt(cfg)
 	}
+	return cfg
+}
+
+// newRoot creates the root node of the filesystem.
+func newRoot(fsys contextual.FS, cfg *config) *node {
 	return &node{
 		fsys:   fsys,
-		path:   ".",
+		path:   cfg.root,
 		logger: cfg.logger,
+		cfg:    cfg,
 	}
 }
@@ -1,9 +1,11 @@
 package fsfuse_test
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/gwangyi/fsfuse"
 	"github.com/gwangyi/fsx/contextual"
@@ -147,3 +149,42 @@ func TestE2E(t *testing.T) {
 		}
 	}
 }
+
+func TestE2E_Mount(t *testing.T) {
+	if _, err := os.Stat("/dev/fuse"); os.IsNotExist(err) {
+		t.Skip("skipping e2e test: /dev/fuse not found")
+	}
+
+	srcDir := t.TempDir()
+	mntDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "hello.txt"), []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backing, err := osfs.New(srcDir)
+	if err != nil {
+		t.Fatalf("osfs.New failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	m, err := fsfuse.Mount(ctx, mntDir, contextual.ToContextual(backing))
+	if err != nil {
+		t.Fatalf("Mount failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(mntDir, "hello.txt"))
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("ReadFile = (%q, %v), want hello world", data, err)
+	}
+
+	// Canceling the context unmounts the filesystem.
+	cancel()
+	select {
+	case <-m.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("filesystem still mounted after cancel")
+	}
+	if _, err := os.Stat(filepath.Join(mntDir, "hello.txt")); !os.IsNotExist(err) {
+		t.Errorf("Stat after unmount: expected not exist, got %v", err)
+	}
+}
@@ -1,12 +1,18 @@
 package fsfuse
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
+	"os"
 	"os/user"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -14,6 +20,7 @@ import (
 	"github.com/gwangyi/fsx"
 	"github.com/gwangyi/fsx/mockfs"
 	cmockfs "github.com/gwangyi/fsx/mockfs/contextual"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"go.uber.org/mock/gomock"
 )
@@ -86,6 +93,18 @@ func TestUtil_toErrno(t *testing.T) {
 		{errors.New("generic error"), syscall.EIO},
 		{syscall.ENOTDIR, syscall.ENOTDIR},
 		{errors.ErrUnsupported, syscall.ENOSYS},
+		{fs.ErrClosed, syscall.EBADF},
+		{fsx.ErrNotEmpty, syscall.ENOTEMPTY},
+		{fsx.ErrNotDir, syscall.ENOTDIR},
+		{fsx.ErrIsDir, syscall.EISDIR},
+		{&fs.PathError{Op: "remove", Path: "a", Err: fsx.ErrNotEmpty}, syscall.ENOTEMPTY},
+		{&fs.PathError{Op: "rename", Path: "a", Err: syscall.EXDEV}, syscall.EXDEV},
+		// Messages are only recognized by MessageErrors.
+		{&fs.PathError{Op: "write", Path: "a", Err: errors.New("no space left on device")}, syscall.EIO},
+		{context.Canceled, syscall.EINTR},
+		{context.DeadlineExceeded, syscall.ETIMEDOUT},
+		{os.ErrDeadlineExceeded, syscall.ETIMEDOUT},
+		{fmt.Errorf("op: %w", timeoutError{}), syscall.ETIMEDOUT},
 	}
 
 	for _, tt := range tests {
@@ -96,6 +115,81 @@ func TestUtil_toErrno(t *testing.T) {
 	}
 }
 
+func TestMessageErrors(t *testing.T) {
+	tests := []struct {
+		err  error
+		want syscall.Errno
+	}{
+		{errors.New("generic error"), 0},
+		{&fs.PathError{Op: "write", Path: "a", Err: errors.New("no space left on device")}, syscall.ENOSPC},
+		{fmt.Errorf("wrapped: %w", &fs.PathError{Op: "open", Path: "a", Err: errors.New("file name too long")}), syscall.ENAMETOOLONG},
+		{errors.Join(errors.New("other"), errors.New("read-only file system")), syscall.EROFS},
+		{errors.New("disk quota exceeded"), syscall.EDQUOT},
+		{errors.New("no space left on device, retrying"), 0},
+	}
+
+	for _, tt := range tests {
+		if got := MessageErrors(tt.err); got != tt.want {
+			t.Errorf("MessageErrors(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+
+	// Registered, it takes precedence over the default mapping.
+	cfg := newConfig([]Option{TranslateErrors(MessageErrors)})
+	if got := cfg.toErrno(errors.New("directory not empty")); got != syscall.ENOTEMPTY {
+		t.Errorf("toErrno(directory not empty) = %v, want ENOTEMPTY", got)
+	}
+}
+
+func TestUtil_matchPath(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		want     bool
+	}{
+		{nil, "a/b", false},
+		{[]string{"b"}, "a/b", true},
+		{[]string{"*.log"}, "a/b.log", true},
+		{[]string{"a/*"}, "a/b", true},
+		{[]string{"a/*"}, "c/a/b", false},
+		{[]string{"x", "[", "b*"}, "a/b", true},
+		{[]string{"["}, "a/b", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchPath(tt.patterns, tt.path); got != tt.want {
+			t.Errorf("matchPath(%q, %q) = %v, want %v", tt.patterns, tt.path, got, tt.want)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "timeout" }
+func (timeoutError) Timeout() bool { return true }
+
+func TestConfig_toErrno(t *testing.T) {
+	errCustom := errors.New("custom")
+	cfg := config{}
+	TranslateErrors(func(err error) syscall.Errno { return 0 })(&cfg)
+	TranslateErrors(func(err error) syscall.Errno {
+		if errors.Is(err, errCustom) {
+			return syscall.ENOSPC
+		}
+		return 0
+	})(&cfg)
+
+	if got := cfg.toErrno(nil); got != 0 {
+		t.Errorf("toErrno(nil) = %v, want 0", got)
+	}
+	if got := cfg.toErrno(fmt.Errorf("wrapped: %w", errCustom)); got != syscall.ENOSPC {
+		t.Errorf("toErrno(custom) = %v, want ENOSPC", got)
+	}
+	if got := cfg.toErrno(fs.ErrNotExist); got != syscall.ENOENT {
+		t.Errorf("toErrno(ErrNotExist) = %v, want ENOENT", got)
+	}
+}
+
 func TestUtil_fillFromStat(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -361,3 +455,425 @@ func TestUtil_toFuseMode(t *testing.T) {
 		}
 	}
 }
+
+func TestNewContext(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ctx := t.Context()
+	mfs := cmockfs.NewMockFileSystem(ctrl)
+
+	dir := mockfs.NewMockFileInfo(ctrl)
+	dir.EXPECT().IsDir().Return(true).AnyTimes()
+	file := mockfs.NewMockFileInfo(ctrl)
+	file.EXPECT().IsDir().Return(false).AnyTimes()
+
+	mfs.EXPECT().Lstat(ctx, "projects/foo").Return(dir, nil)
+	root, err := NewContext(ctx, mfs, Subtree("projects/foo/"))
+	if err != nil {
+		t.Fatalf("NewContext failed: %v", err)
+	}
+	if p := root.(*node).path; p != "projects/foo" {
+		t.Errorf("root path = %q, want %q", p, "projects/foo")
+	}
+
+	mfs.EXPECT().Lstat(ctx, ".").Return(dir, nil)
+	if _, err := NewContext(ctx, mfs); err != nil {
+		t.Errorf("NewContext without subtree failed: %v", err)
+	}
+
+	mfs.EXPECT().Lstat(ctx, "missing").Return(nil, fs.ErrNotExist)
+	if _, err := NewContext(ctx, mfs, Subtree("missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	mfs.EXPECT().Lstat(ctx, "file").Return(file, nil)
+	if _, err := NewContext(ctx, mfs, Subtree("file")); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("expected ENOTDIR, got %v", err)
+	}
+
+	for _, dir := range []string{"/abs", "../up", "a/../b", "a/./b", "a//b", "/", ""} {
+		if _, err := NewContext(ctx, mfs, Subtree(dir)); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("Subtree(%q): expected ErrInvalid, got %v", dir, err)
+		}
+		// New reports the error through the operations instead.
+		root := New(mfs, Subtree(dir), Logger(slog.New(slog.DiscardHandler)))
+		if errno := root.(fusefs.NodeGetattrer).Getattr(ctx, nil, &fuse.AttrOut{}); errno != syscall.EINVAL {
+			t.Errorf("Getattr with Subtree(%q) = %v, want EINVAL", dir, errno)
+		}
+		if _, errno := root.(fusefs.NodeLookuper).Lookup(ctx, "a", &fuse.EntryOut{}); errno != syscall.EINVAL {
+			t.Errorf("Lookup with Subtree(%q) = %v, want EINVAL", dir, errno)
+		}
+	}
+}
+
+func TestConfig_escapes(t *testing.T) {
+	tests := []struct {
+		root     string
+		linkPath string
+		target   string
+		want     bool
+	}{
+		{".", "a/link", "b", false},
+		{".", "a/link", "../b", false},
+		{".", "a/link", "../../b", true},
+		{".", "link", "/etc/passwd", true},
+		{"projects/foo", "projects/foo/link", "bar", false},
+		{"projects/foo", "projects/foo/link", "../bar", true},
+		{"projects/foo", "projects/foo/a/link", "../b/../c", false},
+		{"projects/foo", "projects/foo/a/link", "../../foo/c", true},
+		{"projects/foo", "projects/foo/a/link", "..", false},
+	}
+
+	for _, tt := range tests {
+		cfg := newConfig([]Option{Subtree(tt.root)})
+		if got := cfg.escapes(tt.linkPath, tt.target); got != tt.want {
+			t.Errorf("escapes(%q, %q) with root %q = %v, want %v", tt.linkPath, tt.target, tt.root, got, tt.want)
+		}
+	}
+}
+
+func TestConfig_linkTarget(t *testing.T) {
+	tests := []struct {
+		policy    SymlinkPolicy
+		root      string
+		linkPath  string
+		target    string
+		want      string
+		wantErrno syscall.Errno
+	}{
+		{SymlinkDefault, ".", "a/link", "/etc/passwd", "/etc/passwd", 0},
+		{SymlinkDefault, "projects/foo", "projects/foo/link", "/etc/passwd", "", syscall.EPERM},
+		{SymlinkPassThrough, "projects/foo", "projects/foo/link", "/etc/passwd", "/etc/passwd", 0},
+		{SymlinkRejectEscaping, ".", "a/link", "../../b", "", syscall.EPERM},
+		{SymlinkRejectEscaping, ".", "a/link", "../b", "../b", 0},
+		{SymlinkRewriteAbsolute, ".", "a/b/link", "/a/c/d", "../c/d", 0},
+		{SymlinkRewriteAbsolute, ".", "link", "/x", "x", 0},
+		{SymlinkRewriteAbsolute, ".", "a/link", "/", "..", 0},
+		{SymlinkRewriteAbsolute, ".", "a/link", "../../b", "../../b", 0},
+		{SymlinkRewriteAbsolute, "projects/foo", "projects/foo/a/link", "/b", "../b", 0},
+		{SymlinkRewriteAbsolute, "projects/foo", "projects/foo/a/link", "../../b", "", syscall.EPERM},
+	}
+
+	for _, tt := range tests {
+		cfg := newConfig([]Option{Subtree(tt.root), Symlinks(tt.policy)})
+		got, errno := cfg.linkTarget(tt.linkPath, tt.target)
+		if got != tt.want || errno != tt.wantErrno {
+			t.Errorf("linkTarget(%q, %q) with policy %v and root %q = (%q, %v), want (%q, %v)",
+				tt.linkPath, tt.target, tt.policy, tt.root, got, errno, tt.want, tt.wantErrno)
+		}
+	}
+}
+
+func TestUtil_relPath(t *testing.T) {
+	tests := []struct {
+		from, to, want string
+	}{
+		{".", "a/b", "a/b"},
+		{"a", "a/b", "b"},
+		{"a/b", "a", ".."},
+		{"a/b", "c/d", "../../c/d"},
+		{"a", "a", "."},
+		{"a", ".", ".."},
+	}
+
+	for _, tt := range tests {
+		if got := relPath(tt.from, tt.to); got != tt.want {
+			t.Errorf("relPath(%q, %q) = %q, want %q", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestLogSampler(t *testing.T) {
+	var s logSampler
+	key := logKey{"Mkdir", syscall.EEXIST, "Mkdir failed"}
+	other := logKey{"Mkdir", syscall.EACCES, "Mkdir failed"}
+	start := time.Now()
+
+	for i := range 2 {
+		if ok, suppressed := s.allow(key, start, 2, time.Minute); !ok || suppressed != 0 {
+			t.Errorf("allow #%d = (%v, %d), want (true, 0)", i, ok, suppressed)
+		}
+	}
+	for i := range 3 {
+		if ok, _ := s.allow(key, start.Add(time.Second), 2, time.Minute); ok {
+			t.Errorf("allow #%d over the burst = true, want false", i+2)
+		}
+	}
+	if ok, _ := s.allow(other, start.Add(time.Second), 2, time.Minute); !ok {
+		t.Error("allow for another errno = false, want true")
+	}
+	if ok, suppressed := s.allow(key, start.Add(time.Minute), 2, time.Minute); !ok || suppressed != 3 {
+		t.Errorf("allow in the next interval = (%v, %d), want (true, 3)", ok, suppressed)
+	}
+}
+
+func TestConfig_logFailure(t *testing.T) {
+	var records []slog.Record
+	logger := slog.New(recordHandler(func(r slog.Record) { records = append(records, r) }))
+	cfg := newConfig([]Option{
+		LogLevels(func(op string, errno syscall.Errno) (slog.Level, bool) {
+			if errno == syscall.EEXIST {
+				return 0, false
+			}
+			return slog.LevelWarn, true
+		}),
+		LogSampling(1, time.Hour),
+	})
+
+	ctx := t.Context()
+	cfg.logFailure(ctx, logger, "Mkdir", syscall.EEXIST, "Mkdir failed")
+	cfg.logFailure(ctx, logger, "Mkdir", syscall.EACCES, "Mkdir failed")
+	cfg.logFailure(ctx, logger, "Mkdir", syscall.EACCES, "Mkdir failed")
+
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	if records[0].Level != slog.LevelWarn || records[0].Message != "Mkdir failed" {
+		t.Errorf("record = (%v, %q), want (WARN, %q)", records[0].Level, records[0].Message, "Mkdir failed")
+	}
+
+	if level, ok := DefaultLogPolicy("Lookup", syscall.ENOENT); ok {
+		t.Errorf("DefaultLogPolicy(Lookup, ENOENT) = (%v, true), want not logged", level)
+	}
+	if level, ok := DefaultLogPolicy("Mkdir", syscall.ENOENT); !ok || level != slog.LevelError {
+		t.Errorf("DefaultLogPolicy(Mkdir, ENOENT) = (%v, %v), want (ERROR, true)", level, ok)
+	}
+}
+
+// recordHandler is a slog.Handler passing every record to a function.
+type recordHandler func(slog.Record)
+
+func (h recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h(r)
+	return nil
+}
+func (h recordHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h recordHandler) WithGroup(string) slog.Handler      { return h }
+
+func TestConfig_mountOptions(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		opts := newConfig(nil).mountOptions()
+		if opts.FsName != "fsfuse" || opts.Name != "fsfuse" {
+			t.Errorf("names = (%q, %q), want (fsfuse, fsfuse)", opts.FsName, opts.Name)
+		}
+		if *opts.EntryTimeout != time.Second || *opts.AttrTimeout != time.Second || *opts.NegativeTimeout != time.Second {
+			t.Errorf("timeouts = (%v, %v, %v), want 1s each", *opts.EntryTimeout, *opts.AttrTimeout, *opts.NegativeTimeout)
+		}
+	})
+
+	t.Run("Derived", func(t *testing.T) {
+		opts := newConfig([]Option{Subtree("projects/foo"), CaseInsensitive(true, CollisionExact)}).mountOptions()
+		if opts.FsName != "fsfuse:projects/foo" {
+			t.Errorf("FsName = %q, want %q", opts.FsName, "fsfuse:projects/foo")
+		}
+		if *opts.NegativeTimeout != 0 {
+			t.Errorf("NegativeTimeout = %v, want 0", *opts.NegativeTimeout)
+		}
+	})
+
+	t.Run("Explicit", func(t *testing.T) {
+		opts := newConfig([]Option{
+			FsName("backend"),
+			Timeouts(time.Minute, 2*time.Minute, 3*time.Minute),
+			FuseOptions(func(o *fusefs.Options) { o.AllowOther = true }),
+		}).mountOptions()
+		if opts.FsName != "backend" || !opts.AllowOther {
+			t.Errorf("(FsName, AllowOther) = (%q, %v), want (backend, true)", opts.FsName, opts.AllowOther)
+		}
+		if *opts.EntryTimeout != time.Minute || *opts.AttrTimeout != 2*time.Minute || *opts.NegativeTimeout != 3*time.Minute {
+			t.Errorf("timeouts = (%v, %v, %v), want (1m, 2m, 3m)", *opts.EntryTimeout, *opts.AttrTimeout, *opts.NegativeTimeout)
+		}
+	})
+}
+
+func TestRetryUnmount(t *testing.T) {
+	delays := []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond}
+
+	t.Run("Busy", func(t *testing.T) {
+		calls := 0
+		err := retryUnmount(func() error {
+			calls++
+			if calls < 3 {
+				return syscall.EBUSY
+			}
+			return nil
+		}, nil, delays)
+		if err != nil || calls != 3 {
+			t.Errorf("retryUnmount = %v after %d calls, want success after 3", err, calls)
+		}
+	})
+
+	t.Run("Exhausted", func(t *testing.T) {
+		calls := 0
+		err := retryUnmount(func() error {
+			calls++
+			return syscall.EBUSY
+		}, nil, delays)
+		if !errors.Is(err, syscall.EBUSY) || calls != len(delays)+1 {
+			t.Errorf("retryUnmount = %v after %d calls, want EBUSY after %d", err, calls, len(delays)+1)
+		}
+	})
+
+	t.Run("Unmounted", func(t *testing.T) {
+		done := make(chan struct{})
+		close(done)
+		err := retryUnmount(func() error { return syscall.EBUSY }, done, []time.Duration{time.Hour})
+		if err != nil {
+			t.Errorf("retryUnmount = %v, want success once unmounted externally", err)
+		}
+	})
+}
+
+func TestReplayBuffer(t *testing.T) {
+	r := newReplayBuffer(5)
+	replay := func(back int) string {
+		p := make([]byte, 3)
+		return string(p[:r.ReplayAt(p, back)])
+	}
+
+	_, _ = r.Write([]byte("abc"))
+	if r.Len() != 3 || replay(3) != "abc" || replay(2) != "bc" {
+		t.Errorf("after abc: len %d, replay %q", r.Len(), replay(3))
+	}
+	_, _ = r.Write([]byte("defg"))
+	if r.Len() != 5 || replay(5) != "cde" || replay(2) != "fg" {
+		t.Errorf("after defg: len %d, replay %q %q", r.Len(), replay(5), replay(2))
+	}
+	_, _ = r.Write([]byte("0123456"))
+	if r.Len() != 5 || replay(5) != "234" || replay(3) != "456" {
+		t.Errorf("after 0123456: len %d, replay %q %q", r.Len(), replay(5), replay(3))
+	}
+	r.Reset()
+	if r.Len() != 0 {
+		t.Errorf("after Reset: len %d", r.Len())
+	}
+}
+
+func TestMemBudget(t *testing.T) {
+	b := memBudget{limit: 10}
+	if !b.acquire(6) || b.acquire(6) || !b.acquire(4) {
+		t.Fatal("acquire does not honor the limit")
+	}
+	b.release(6)
+	if !b.acquire(5) || b.used.Load() != 9 {
+		t.Errorf("used = %d after release and acquire, want 9", b.used.Load())
+	}
+
+	unlimited := memBudget{}
+	if !unlimited.acquire(1 << 40) {
+		t.Error("acquire failed without a limit")
+	}
+}
+
+// waitReleased waits for up to a second for the fetches of a readahead to
+// return their memory to b.
+func waitReleased(b *memBudget) {
+	deadline := time.Now().Add(time.Second)
+	for b.used.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReadahead_Budget(t *testing.T) {
+	cfg := &readaheadConfig{window: 8 * readaheadChunk, budget: memBudget{limit: 2 * readaheadChunk}}
+	r := newReadahead(cfg, bytes.NewReader(make([]byte, 16*readaheadChunk)))
+	for off := int64(0); off < 4*readaheadChunk; off += 4096 {
+		if _, err := r.read(t.Context(), make([]byte, 4096), off); err != nil {
+			t.Fatalf("read(%d) failed: %v", off, err)
+		}
+		if used := cfg.budget.used.Load(); used > cfg.budget.limit {
+			t.Fatalf("%d bytes used, over the limit of %d", used, cfg.budget.limit)
+		}
+	}
+	r.close()
+	// The fetches in progress return their memory when they end.
+	waitReleased(&cfg.budget)
+	if used := cfg.budget.used.Load(); used != 0 {
+		t.Errorf("%d bytes still used after close", used)
+	}
+}
+
+// gatedReaderAt serves data, holding the result of each read until gate is
+// closed.
+type gatedReaderAt struct {
+	gate     chan struct{}
+	inFlight atomic.Int32
+
+	mu   sync.Mutex
+	data []byte
+}
+
+func (g *gatedReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	g.inFlight.Add(1)
+	defer g.inFlight.Add(-1)
+	g.mu.Lock()
+	n, err := bytes.NewReader(g.data).ReadAt(b, off)
+	g.mu.Unlock()
+	<-g.gate
+	return n, err
+}
+
+func TestReadahead_Close(t *testing.T) {
+	g := &gatedReaderAt{gate: make(chan struct{}), data: make([]byte, 8*readaheadChunk)}
+	cfg := &readaheadConfig{window: 4 * readaheadChunk, budget: memBudget{limit: 8 * readaheadChunk}}
+	r := newReadahead(cfg, g)
+	r.mu.Lock()
+	r.observe(0, 0)
+	r.prefetch(0)
+	r.mu.Unlock()
+
+	closed := make(chan struct{})
+	go func() {
+		r.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close waited for the fetches in progress")
+	}
+
+	// A fetch which has not read yet does not read at all; it would block
+	// on the gate otherwise.
+	c := &chunk{off: 4 * readaheadChunk, done: make(chan struct{})}
+	c.refs.Store(1)
+	cfg.budget.acquire(readaheadChunk)
+	r.fetch(c)
+	if !errors.Is(c.err, context.Canceled) {
+		t.Errorf("fetch after close: err = %v, want context.Canceled", c.err)
+	}
+
+	close(g.gate)
+	waitReleased(&cfg.budget)
+	if used := cfg.budget.used.Load(); used != 0 {
+		t.Errorf("%d bytes still used after the fetches ended", used)
+	}
+}
+
+func TestReadahead_StaleEOF(t *testing.T) {
+	g := &gatedReaderAt{gate: make(chan struct{}), data: make([]byte, readaheadChunk/2)}
+	cfg := &readaheadConfig{window: 2 * readaheadChunk, budget: memBudget{limit: 2 * readaheadChunk}}
+	r := newReadahead(cfg, g)
+	r.mu.Lock()
+	r.observe(0, 0)
+	r.prefetch(0)
+	r.mu.Unlock()
+
+	// The file grows after the fetches have read its old end.
+	for g.inFlight.Load() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	r.invalidate()
+	g.mu.Lock()
+	g.data = make([]byte, 4*readaheadChunk)
+	g.mu.Unlock()
+	close(g.gate)
+	waitReleased(&cfg.budget)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.eof != -1 {
+		t.Errorf("eof = %d after the file grew, want -1", r.eof)
+	}
+}
@@ -0,0 +1,74 @@
+package fsfuse
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+)
+
+// MaxZeroFill limits the gap, in bytes, that a write to a stream may skip
+// when the backend cannot leave a hole there. Such gaps are filled by
+// writing zeros, which is slow for large sparse offsets and takes up space
+// on the backend; writes skipping more than size bytes fail with EFBIG
+// instead.
+//
+// Gaps are left as holes without writing zeros when the file can seek, or
+// when it implements Extender. Negative values, the default, never fail;
+// zero never writes zeros.
+func MaxZeroFill(size int64) Option {
+	return func(c *config) {
+		c.maxZeroFill = size
+	}
+}
+
+// Extender is implemented by backend streams which can skip ahead without
+// writing, such as uploads to stores supporting sparse objects.
+//
+// Writes skipping ahead in a stream which cannot seek use Extend, if the file
+// implements it, rather than writing zeros. Truncate is not used instead, as
+// streams need not continue writing at their new end once truncated. There
+// is no need to punch holes, as the gap has never been written.
+type Extender interface {
+	// Extend moves the position of the stream forward to off, leaving a
+	// hole which reads as zeros, as if zeros had been written up to off.
+	Extend(off int64) error
+}
+
+// zeros is written to fill gaps in streams. It is shared and must not be
+// modified.
+var zeros = make([]byte, 64<<10)
+
+// skipTo moves the position of the stream forward to off, leaving the gap
+// as a hole if the file is an Extender, and filling it with zeros otherwise.
+// fh.mu must be held.
+func (fh *fileHandle) skipTo(ctx context.Context, off int64) syscall.Errno {
+	if e, ok := fh.f.(Extender); ok && !fh.noExtend {
+		err := e.Extend(off)
+		if err == nil {
+			fh.offset = off
+			return 0
+		}
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return fh.fail(ctx, "Write", "Extend failed", err, "offset", fh.offset, "size", off)
+		}
+		fh.noExtend = true
+	}
+
+	gap := off - fh.offset
+	if limit := fh.cfg.maxZeroFill; limit >= 0 && gap > limit {
+		return fh.fail(ctx, "Write", "Gap too large to fill with zeros", syscall.EFBIG, "offset", fh.offset, "gap", gap)
+	}
+	w := fh.f.(io.Writer)
+	for fh.offset < off {
+		n, err := w.Write(zeros[:min(off-fh.offset, int64(len(zeros)))])
+		fh.offset += int64(n)
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return fh.fail(ctx, "Write", "Write zeros (padding) failed", err, "offset", fh.offset)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,150 @@
+// Package cli holds the pieces shared by the fsfuse command-line tools:
+// opening backends, parsing mount options and running in the background.
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gwangyi/fsx/contextual"
+	"github.com/gwangyi/fsx/osfs"
+)
+
+// Backend opens the backends of a type. It is shared by mount sources and
+// configuration files.
+type Backend struct {
+	// Open opens a backend from its params, a JSON object.
+	Open func(params json.RawMessage) (contextual.FS, error)
+	// Param is the key of the params set by the parameter of a mount source
+	// "name:param", such as the root directory of osfs. Without it, the
+	// parameter must be the params themselves.
+	Param string
+}
+
+var (
+	backendsMu sync.RWMutex
+	// backends are the backend types by name.
+	backends = map[string]Backend{
+		"osfs": {Open: openOSFS, Param: "root"},
+	}
+)
+
+// RegisterBackend makes the backend type name available. It panics if name
+// is already registered.
+func RegisterBackend(name string, b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if _, ok := backends[name]; ok {
+		panic("cli: backend type " + name + " registered twice")
+	}
+	backends[name] = b
+}
+
+// LookupBackend returns the backend type name.
+func LookupBackend(name string) (Backend, bool) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	b, ok := backends[name]
+	return b, ok
+}
+
+// Backends returns the names of the backend types.
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParamError reports an invalid param of a backend.
+type ParamError struct {
+	Key string
+	Err error
+}
+
+func (e *ParamError) Error() string {
+	return e.Key + ": " + e.Err.Error()
+}
+
+func (e *ParamError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeParams decodes the params of a backend into v, rejecting unknown
+// keys.
+func DecodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// osfsParams are the params of osfs backends.
+type osfsParams struct {
+	// Root is the local directory to serve.
+	Root string `json:"root"`
+}
+
+// openOSFS opens a local directory.
+func openOSFS(params json.RawMessage) (contextual.FS, error) {
+	var p osfsParams
+	if err := DecodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Root == "" {
+		return nil, &ParamError{Key: "root", Err: errors.New("missing root directory")}
+	}
+	root, err := filepath.Abs(p.Root)
+	if err != nil {
+		return nil, &ParamError{Key: "root", Err: err}
+	}
+	fsys, err := osfs.New(root)
+	if err != nil {
+		return nil, &ParamError{Key: "root", Err: fmt.Errorf("%s: %w", root, err)}
+	}
+	return contextual.ToContextual(fsys), nil
+}
+
+// OpenBackend opens a backend of type name from the parameter of a mount
+// source: the params themselves if it is a JSON object, and the value of the
+// Param of the type otherwise.
+func OpenBackend(name, param string) (contextual.FS, error) {
+	b, ok := LookupBackend(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q (known: %s)", name, strings.Join(Backends(), ", "))
+	}
+	var params json.RawMessage
+	switch {
+	case strings.HasPrefix(param, "{"):
+		params = json.RawMessage(param)
+	case b.Param != "":
+		params, _ = json.Marshal(map[string]string{b.Param: param})
+	default:
+		return nil, fmt.Errorf("backend %q takes a JSON object of params", name)
+	}
+	return b.Open(params)
+}
+
+// OpenSource opens the backend described by a mount source of the form
+// "backend:param". A source without a known backend prefix is a local
+// directory.
+func OpenSource(source string) (contextual.FS, error) {
+	if name, param, ok := strings.Cut(source, ":"); ok {
+		if _, known := LookupBackend(name); known {
+			return OpenBackend(name, param)
+		}
+	}
+	return OpenBackend("osfs", source)
+}
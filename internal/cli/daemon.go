@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// daemonEnv is set in the environment of the background process started by
+// Daemonize to the descriptor it reports its status through.
+const daemonEnv = "FSFUSE_DAEMON_FD"
+
+// readyMessage is reported by a background process which mounted
+// successfully.
+const readyMessage = "ok"
+
+// IsDaemon reports whether the process is the background process started by
+// Daemonize.
+func IsDaemon() bool {
+	return os.Getenv(daemonEnv) != ""
+}
+
+// Daemonize starts the current program again with the same arguments in the
+// background, in a new session and detached from the terminal, and waits
+// until it calls NotifyReady. It returns the error reported by the
+// background process, if any.
+func Daemonize() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	// The write end is the first extra file, i.e. descriptor 3.
+	cmd.Env = append(os.Environ(), daemonEnv+"=3")
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	_ = cmd.Process.Release()
+
+	status, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	switch msg := string(status); msg {
+	case readyMessage:
+		return nil
+	case "":
+		return errors.New("background process exited before mounting")
+	default:
+		return errors.New(msg)
+	}
+}
+
+// NotifyReady reports the outcome of mounting to the process waiting in
+// Daemonize. It does nothing if the process is not running in the
+// background.
+func NotifyReady(mountErr error) {
+	fd, err := strconv.Atoi(os.Getenv(daemonEnv))
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "status")
+	if f == nil {
+		return
+	}
+	defer f.Close()
+	msg := readyMessage
+	if mountErr != nil {
+		msg = mountErr.Error()
+	}
+	fmt.Fprint(f, msg)
+}
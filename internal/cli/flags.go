@@ -0,0 +1,193 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gwangyi/fsfuse"
+)
+
+// RegisterFlags defines flags for every field of o in fs. Mount options in
+// the mount(8) syntax are accepted by -o as well.
+func (o *MountOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.Func("o", "comma-separated mount options, as for mount.fsfuse", func(s string) error {
+		for opt := range strings.SplitSeq(s, ",") {
+			if opt == "" {
+				continue
+			}
+			if err := o.Set(opt); err != nil {
+				return fmt.Errorf("%s: %w", opt, err)
+			}
+		}
+		return nil
+	})
+	fs.BoolVar(&o.ReadOnly, "ro", false, "mount read-only")
+	fs.BoolVar(&o.AllowOther, "allow-other", false, "allow other users to access the mount")
+	fs.BoolVar(&o.DefaultPermissions, "default-permissions", false, "let the kernel check permissions")
+	fs.StringVar(&o.UID, "uid", "", "present every file as owned by this user")
+	fs.StringVar(&o.GID, "gid", "", "present every file as owned by this group")
+	fs.BoolVar(&o.MirrorOwner, "mirror-owner", false, "present files as owned by the user accessing them")
+	fs.Func("uid-map", "map backend UIDs to presented ones, as from:to[,from:to...]", idMapFlag(&o.UIDMap))
+	fs.Func("gid-map", "map backend GIDs to presented ones, as from:to[,from:to...]", idMapFlag(&o.GIDMap))
+	fs.Func("fmask", "octal permission bits to clear from files", maskFlag(&o.FMask))
+	fs.Func("dmask", "octal permission bits to clear from directories", maskFlag(&o.DMask))
+	fs.Func("entry-timeout", "kernel entry cache timeout (default 1s)", durationFlag(&o.EntryTimeout))
+	fs.Func("attr-timeout", "kernel attribute cache timeout (default 1s)", durationFlag(&o.AttrTimeout))
+	fs.Func("negative-timeout", "kernel negative lookup cache timeout (default 1s)", durationFlag(&o.NegativeTimeout))
+	fs.Func("atime", "access time policy: noatime, relatime or strictatime", func(s string) error {
+		p, err := ParseEnum(AtimePolicies, s)
+		o.Atime = &p
+		return err
+	})
+	fs.StringVar(&o.FsName, "fsname", "", "filesystem name shown by mount and df")
+	fs.StringVar(&o.Subtree, "subtree", "", "backend directory to mount instead of its root")
+	fs.Func("direct-io", "bypass the page cache for paths matching this pattern (repeatable)", func(s string) error {
+		o.DirectIO = append(o.DirectIO, s)
+		return nil
+	})
+	fs.Func("hide", "hide paths matching this pattern (repeatable)", func(s string) error {
+		o.Hide = append(o.Hide, s)
+		return nil
+	})
+	fs.BoolVar(&o.CaseInsensitive, "case-insensitive", false, "resolve names regardless of case")
+	fs.BoolVar(&o.CasePreserving, "case-preserving", true, "keep the case of new names in case-insensitive mode")
+	fs.Func("collision", "case collision policy: exact, first or error", enumFlag(&o.Collision, CollisionPolicies))
+	fs.Func("normalize", "Unicode normalization of names: nfc or nfd", enumFlag(&o.Normalization, NormalizationForms))
+	fs.Func("symlinks", "symbolic link policy: pass, rewrite, reject or follow", enumFlag(&o.Symlinks, SymlinkPolicies))
+	fs.IntVar(&o.MaxNameLen, "max-name-len", 0, "maximum name length in bytes (0 for no limit)")
+	fs.IntVar(&o.MaxPathLen, "max-path-len", 0, "maximum backend path length in bytes (0 for no limit)")
+	fs.IntVar(&o.LogBurst, "log-burst", 0, "log at most this many identical failures per -log-interval (0 for no limit)")
+	fs.DurationVar(&o.LogInterval, "log-interval", 0, "interval for -log-burst")
+	fs.BoolVar(&o.StageWrites, "stage-writes", false, "stage writes to streams in temporary files, uploading them on close")
+	fs.StringVar(&o.StageDir, "stage-dir", "", "directory for -stage-writes (implies it; default the system temporary directory)")
+	fs.BoolVar(&o.SpoolReads, "spool-reads", false, "copy streams into temporary files as they are read, for random access")
+	fs.StringVar(&o.SpoolDir, "spool-dir", "", "directory for -spool-reads (implies it; default the system temporary directory)")
+	fs.Func("readahead", "prefetch up to this many bytes ahead of sequential readers, e.g. 4M (0 to disable)", sizeFlag(&o.Readahead))
+	fs.Func("readahead-memory", "cap on the data prefetched by all readers (0 for no cap)", sizeFlag(&o.ReadaheadMemory))
+	fs.Func("write-behind", "buffer up to this many bytes of adjacent writes per handle, e.g. 1M (0 to disable)", sizeFlag(&o.WriteBehind))
+	fs.IntVar(&o.ResumeReads, "resume-reads", 0, "retry failed reads of read-only files this many times on a reopened file (0 to disable)")
+	fs.Func("max-zero-fill", "largest gap in streams filled with zeros when it cannot be left as a hole, e.g. 1G (unlimited by default)", func(s string) (err error) {
+		o.MaxZeroFill, err = parseSizePtr(s)
+		return err
+	})
+	fs.Func("replay-buffer", "bytes of streams kept for backward reads, e.g. 256K (0 to disable)", sizeFlag(&o.ReplayBuffer))
+}
+
+// idMapFlag parses a list of from:to ID pairs into m.
+func idMapFlag(m *map[string]string) func(string) error {
+	return func(s string) error {
+		if *m == nil {
+			*m = make(map[string]string)
+		}
+		for pair := range strings.SplitSeq(s, ",") {
+			from, to, ok := strings.Cut(pair, ":")
+			if !ok || from == "" || to == "" {
+				return fmt.Errorf("invalid ID mapping %q", pair)
+			}
+			(*m)[from] = to
+		}
+		return nil
+	}
+}
+
+// sizeFlag parses a number of bytes into n.
+func sizeFlag(n *int) func(string) error {
+	return func(s string) (err error) {
+		*n, err = ParseSize(s)
+		return err
+	}
+}
+
+// maskFlag parses an octal permission mask into m.
+func maskFlag(m *iofs.FileMode) func(string) error {
+	return func(s string) (err error) {
+		*m, err = ParseMask(s)
+		return err
+	}
+}
+
+// Names of the values of the fsfuse enumerations, as used on command lines
+// and in configuration files.
+var (
+	AtimePolicies = map[string]fsfuse.AtimePolicy{
+		"noatime": fsfuse.NoAtime, "relatime": fsfuse.RelAtime, "strictatime": fsfuse.StrictAtime,
+	}
+	CollisionPolicies = map[string]fsfuse.CollisionPolicy{
+		"exact": fsfuse.CollisionExact, "first": fsfuse.CollisionFirst, "error": fsfuse.CollisionError,
+	}
+	NormalizationForms = map[string]fsfuse.NormalizationForm{
+		"nfc": fsfuse.NFC, "nfd": fsfuse.NFD,
+	}
+	SymlinkPolicies = map[string]fsfuse.SymlinkPolicy{
+		"pass": fsfuse.SymlinkPassThrough, "rewrite": fsfuse.SymlinkRewriteAbsolute,
+		"reject": fsfuse.SymlinkRejectEscaping, "follow": fsfuse.SymlinkFollow,
+	}
+)
+
+// ParseEnum looks s up in values, as defined above.
+func ParseEnum[T any](values map[string]T, s string) (T, error) {
+	v, ok := values[s]
+	if !ok {
+		return v, fmt.Errorf("unknown value %q (known: %s)", s, strings.Join(slices.Sorted(maps.Keys(values)), ", "))
+	}
+	return v, nil
+}
+
+// durationFlag parses a duration into d.
+func durationFlag(d **time.Duration) func(string) error {
+	return func(s string) error {
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		if v < 0 {
+			return fmt.Errorf("negative duration %s", s)
+		}
+		*d = &v
+		return nil
+	}
+}
+
+// enumFlag parses one of the names in values into v.
+func enumFlag[T any](v *T, values map[string]T) func(string) error {
+	return func(s string) (err error) {
+		*v, err = ParseEnum(values, s)
+		return err
+	}
+}
+
+// LogOptions configure the logger of a command.
+type LogOptions struct {
+	Level  slog.Level
+	Format string
+}
+
+// RegisterFlags defines the -log-level and -log-format flags in fs.
+func (o *LogOptions) RegisterFlags(fs *flag.FlagSet) {
+	o.Level = slog.LevelWarn
+	o.Format = "text"
+	fs.TextVar(&o.Level, "log-level", o.Level, "log level: debug, info, warn or error")
+	fs.Func("log-format", "log format: text or json (default text)", func(s string) error {
+		if s != "text" && s != "json" {
+			return fmt.Errorf("unknown format %q", s)
+		}
+		o.Format = s
+		return nil
+	})
+}
+
+// Logger returns a logger writing to w as configured by o.
+func (o *LogOptions) Logger(w io.Writer) *slog.Logger {
+	hopts := &slog.HandlerOptions{Level: o.Level}
+	if o.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, hopts))
+	}
+	return slog.New(slog.NewTextHandler(w, hopts))
+}
@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/gwangyi/fsfuse"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestMountOptions_RegisterFlags(t *testing.T) {
+	var o MountOptions
+	var lo LogOptions
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	o.RegisterFlags(fs)
+	lo.RegisterFlags(fs)
+	err := fs.Parse([]string{
+		"-ro", "-o", "allow_other,uid=1000",
+		"-gid-map", "100:200,300:400",
+		"-fmask", "022",
+		"-attr-timeout", "5s",
+		"-atime", "strictatime",
+		"-hide", ".git", "-hide", "*.lock",
+		"-case-insensitive", "-collision", "first",
+		"-normalize", "nfd", "-symlinks", "follow",
+		"-max-name-len", "255",
+		"-log-level", "debug", "-log-format", "json",
+	})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if !o.ReadOnly || !o.AllowOther || o.UID != "1000" || o.FMask != 0022 {
+		t.Errorf("basic options = %+v", o)
+	}
+	if o.GIDMap["100"] != "200" || o.GIDMap["300"] != "400" {
+		t.Errorf("GIDMap = %v", o.GIDMap)
+	}
+	if o.AttrTimeout == nil || *o.AttrTimeout != 5*time.Second || o.Atime == nil || *o.Atime != fsfuse.StrictAtime {
+		t.Errorf("(AttrTimeout, Atime) = (%v, %v)", o.AttrTimeout, o.Atime)
+	}
+	if len(o.Hide) != 2 || !o.CaseInsensitive || !o.CasePreserving || o.Collision != fsfuse.CollisionFirst {
+		t.Errorf("name options = %+v", o)
+	}
+	if o.Normalization != fsfuse.NFD || o.Symlinks != fsfuse.SymlinkFollow || o.MaxNameLen != 255 {
+		t.Errorf("(Normalization, Symlinks, MaxNameLen) = (%v, %v, %v)", o.Normalization, o.Symlinks, o.MaxNameLen)
+	}
+	if lo.Level != slog.LevelDebug || lo.Format != "json" {
+		t.Errorf("LogOptions = %+v", lo)
+	}
+	if got := len(o.Options()); got != 11 {
+		t.Errorf("len(Options()) = %d, want 11", got)
+	}
+}
+
+func TestIDMapper(t *testing.T) {
+	ctx := fuse.NewContext(t.Context(), &fuse.Caller{Owner: fuse.Owner{Uid: 42}})
+	ids := map[string]string{"1": "2"}
+
+	if m := idMapper("", false, fsfuse.MirrorOwner(), nil); m != nil {
+		t.Error("idMapper without settings is not nil")
+	}
+	if got := idMapper("7", true, fsfuse.MirrorOwner(), ids)(ctx, "1"); got != "7" {
+		t.Errorf("fixed mapper = %q, want 7", got)
+	}
+	if got := idMapper("", true, fsfuse.MirrorOwner(), ids)(ctx, "1"); got != "42" {
+		t.Errorf("mirror mapper = %q, want 42", got)
+	}
+	m := idMapper("", false, fsfuse.MirrorOwner(), ids)
+	if got := m(context.Background(), "1"); got != "2" {
+		t.Errorf("map mapper(1) = %q, want 2", got)
+	}
+	if got := m(context.Background(), "3"); got != "" {
+		t.Errorf("map mapper(3) = %q, want unchanged", got)
+	}
+}
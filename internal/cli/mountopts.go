@@ -0,0 +1,346 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	iofs "io/fs"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gwangyi/fsfuse"
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// MountOptions are the settings of a mount expressed by command-line tools,
+// as opposed to the fsfuse.Option values they turn into.
+type MountOptions struct {
+	ReadOnly           bool
+	AllowOther         bool
+	DefaultPermissions bool
+	// UID and GID, if not empty, are the user and group presented as the
+	// owner of every file.
+	UID string
+	GID string
+	// FMask and DMask are cleared from the permissions of files and
+	// directories.
+	FMask iofs.FileMode
+	DMask iofs.FileMode
+	// EntryTimeout, AttrTimeout and NegativeTimeout override the kernel
+	// cache timeouts if not nil.
+	EntryTimeout    *time.Duration
+	AttrTimeout     *time.Duration
+	NegativeTimeout *time.Duration
+	// Atime enables access time updates with its policy if not nil.
+	Atime   *fsfuse.AtimePolicy
+	FsName  string
+	Subtree string
+
+	// MirrorOwner presents files as owned by the user and group accessing
+	// them, unless UID or GID is given.
+	MirrorOwner bool
+	// UIDMap and GIDMap map IDs found on the backend to the ones presented.
+	UIDMap map[string]string
+	GIDMap map[string]string
+
+	DirectIO        []string
+	Hide            []string
+	CaseInsensitive bool
+	CasePreserving  bool
+	Collision       fsfuse.CollisionPolicy
+	Normalization   fsfuse.NormalizationForm
+	Symlinks        fsfuse.SymlinkPolicy
+	MaxNameLen      int
+	MaxPathLen      int
+	LogBurst        int
+	LogInterval     time.Duration
+	// ReplayBuffer is the number of bytes kept for backward reads on
+	// streams.
+	ReplayBuffer int
+	// StageWrites stages writes to streams in temporary files in StageDir.
+	StageWrites bool
+	StageDir    string
+	// SpoolReads copies streams read into temporary files in SpoolDir.
+	SpoolReads bool
+	SpoolDir   string
+	// Readahead is the maximal window of prefetched data per handle, and
+	// ReadaheadMemory the cap on the data prefetched by all handles.
+	Readahead       int
+	ReadaheadMemory int
+	// WriteBehind is the size of the write buffer of handles.
+	WriteBehind int
+	// MaxZeroFill is the largest gap filled with zeros in streams; nil does
+	// not limit it.
+	MaxZeroFill *int
+	// ResumeReads is the number of times a failed read is retried on a
+	// reopened file.
+	ResumeReads int
+}
+
+// ignoredMountOptions are generic mount(8) options which do not concern the
+// filesystem itself.
+var ignoredMountOptions = map[string]bool{
+	"defaults": true, "rw": true, "auto": true, "noauto": true,
+	"user": true, "nouser": true, "users": true, "owner": true,
+	"_netdev": true, "nofail": true, "dev": true, "nodev": true,
+	"suid": true, "nosuid": true, "exec": true, "noexec": true,
+	"async": true, "atime": true, "nodiratime": true, "diratime": true,
+}
+
+// ParseMountOptions parses a comma-separated list of mount options as given
+// with -o to mount(8). Unknown options are errors, unless sloppy is set.
+func ParseMountOptions(s string, sloppy bool) (*MountOptions, error) {
+	o := &MountOptions{}
+	for opt := range strings.SplitSeq(s, ",") {
+		if opt == "" {
+			continue
+		}
+		if err := o.Set(opt); err != nil {
+			if sloppy && err == errUnknownOption {
+				continue
+			}
+			return nil, fmt.Errorf("option %q: %w", opt, err)
+		}
+	}
+	return o, nil
+}
+
+// errUnknownOption is returned by Set for unknown options.
+var errUnknownOption = fmt.Errorf("unknown option")
+
+// Set applies a single mount option, either a flag such as "ro" or a
+// key=value pair such as "uid=1000".
+func (o *MountOptions) Set(opt string) error {
+	key, value, hasValue := strings.Cut(opt, "=")
+	if !hasValue {
+		switch key {
+		case "ro":
+			o.ReadOnly = true
+		case "allow_other":
+			o.AllowOther = true
+		case "default_permissions":
+			o.DefaultPermissions = true
+		case "noatime", "relatime", "strictatime":
+			p := AtimePolicies[key]
+			o.Atime = &p
+		case "stage_writes":
+			o.StageWrites = true
+		case "spool_reads":
+			o.SpoolReads = true
+		default:
+			if ignoredMountOptions[key] || strings.HasPrefix(key, "x-") {
+				return nil
+			}
+			return errUnknownOption
+		}
+		return nil
+	}
+
+	var err error
+	switch key {
+	case "uid":
+		o.UID = value
+	case "gid":
+		o.GID = value
+	case "fmask":
+		o.FMask, err = ParseMask(value)
+	case "dmask":
+		o.DMask, err = ParseMask(value)
+	case "umask":
+		o.FMask, err = ParseMask(value)
+		o.DMask = o.FMask
+	case "entry_timeout":
+		o.EntryTimeout, err = parseSeconds(value)
+	case "attr_timeout":
+		o.AttrTimeout, err = parseSeconds(value)
+	case "negative_timeout":
+		o.NegativeTimeout, err = parseSeconds(value)
+	case "fsname":
+		o.FsName = value
+	case "subtree":
+		o.Subtree = value
+	case "replay_buffer":
+		o.ReplayBuffer, err = ParseSize(value)
+	case "stage_dir":
+		o.StageWrites, o.StageDir = true, value
+	case "spool_dir":
+		o.SpoolReads, o.SpoolDir = true, value
+	case "readahead":
+		o.Readahead, err = ParseSize(value)
+	case "readahead_memory":
+		o.ReadaheadMemory, err = ParseSize(value)
+	case "write_behind":
+		o.WriteBehind, err = ParseSize(value)
+	case "max_zero_fill":
+		o.MaxZeroFill, err = parseSizePtr(value)
+	case "resume_reads":
+		var n uint64
+		n, err = strconv.ParseUint(value, 10, 31)
+		if err != nil {
+			err = fmt.Errorf("invalid number of attempts %q", value)
+		}
+		o.ResumeReads = int(n)
+	default:
+		if strings.HasPrefix(key, "x-") || key == "comment" {
+			return nil
+		}
+		return errUnknownOption
+	}
+	return err
+}
+
+// ParseMask parses an octal permission mask.
+func ParseMask(s string) (iofs.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mask %q", s)
+	}
+	if m > uint64(iofs.ModePerm) {
+		return 0, fmt.Errorf("mask %q out of range", s)
+	}
+	return iofs.FileMode(m), nil
+}
+
+// ParseSize parses a number of bytes, optionally followed by one of the
+// binary suffixes K, M and G.
+func ParseSize(s string) (int, error) {
+	digits, shift := s, 0
+	if i := len(s) - 1; i > 0 {
+		switch s[i] {
+		case 'K', 'k':
+			digits, shift = s[:i], 10
+		case 'M', 'm':
+			digits, shift = s[:i], 20
+		case 'G', 'g':
+			digits, shift = s[:i], 30
+		}
+	}
+	n, err := strconv.ParseUint(digits, 10, 31-shift)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int(n << shift), nil
+}
+
+// parseSizePtr parses a size, for options where nil means unset.
+func parseSizePtr(s string) (*int, error) {
+	n, err := ParseSize(s)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// parseSeconds parses a possibly fractional number of seconds.
+func parseSeconds(s string) (*time.Duration, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return nil, fmt.Errorf("invalid number of seconds %q", s)
+	}
+	d := time.Duration(f * float64(time.Second))
+	return &d, nil
+}
+
+// Options converts o into fsfuse options.
+func (o *MountOptions) Options() []fsfuse.Option {
+	var opts []fsfuse.Option
+	if o.ReadOnly {
+		opts = append(opts, fsfuse.ReadOnly())
+	}
+	if o.AllowOther || o.DefaultPermissions {
+		allowOther, defaultPermissions := o.AllowOther, o.DefaultPermissions
+		opts = append(opts, fsfuse.FuseOptions(func(fo *fs.Options) {
+			fo.AllowOther = fo.AllowOther || allowOther
+			if defaultPermissions {
+				fo.Options = append(fo.Options, "default_permissions")
+			}
+		}))
+	}
+	owner := idMapper(o.UID, o.MirrorOwner, fsfuse.MirrorOwner(), o.UIDMap)
+	group := idMapper(o.GID, o.MirrorOwner, fsfuse.MirrorGroup(), o.GIDMap)
+	if owner != nil || group != nil {
+		opts = append(opts, fsfuse.MapOwners(owner, group))
+	}
+	if o.FMask != 0 || o.DMask != 0 {
+		opts = append(opts, fsfuse.PermissionMasks(o.FMask, o.DMask))
+	}
+	if o.EntryTimeout != nil || o.AttrTimeout != nil || o.NegativeTimeout != nil {
+		orDefault := func(d *time.Duration) time.Duration {
+			if d == nil {
+				return time.Second
+			}
+			return *d
+		}
+		opts = append(opts, fsfuse.Timeouts(orDefault(o.EntryTimeout), orDefault(o.AttrTimeout), orDefault(o.NegativeTimeout)))
+	}
+	if o.Atime != nil {
+		opts = append(opts, fsfuse.Atime(*o.Atime))
+	}
+	if o.FsName != "" {
+		opts = append(opts, fsfuse.FsName(o.FsName))
+	}
+	if o.Subtree != "" {
+		opts = append(opts, fsfuse.Subtree(o.Subtree))
+	}
+	if len(o.DirectIO) > 0 {
+		opts = append(opts, fsfuse.DirectIO(o.DirectIO...))
+	}
+	if len(o.Hide) > 0 {
+		opts = append(opts, fsfuse.Hide(o.Hide...))
+	}
+	if o.CaseInsensitive {
+		opts = append(opts, fsfuse.CaseInsensitive(o.CasePreserving, o.Collision))
+	}
+	if o.Normalization != 0 {
+		opts = append(opts, fsfuse.NormalizeNames(o.Normalization))
+	}
+	if o.Symlinks != fsfuse.SymlinkDefault {
+		opts = append(opts, fsfuse.Symlinks(o.Symlinks))
+	}
+	if o.MaxNameLen > 0 {
+		opts = append(opts, fsfuse.MaxNameLen(o.MaxNameLen))
+	}
+	if o.MaxPathLen > 0 {
+		opts = append(opts, fsfuse.MaxPathLen(o.MaxPathLen))
+	}
+	if o.LogBurst > 0 {
+		opts = append(opts, fsfuse.LogSampling(o.LogBurst, o.LogInterval))
+	}
+	if o.ReplayBuffer > 0 {
+		opts = append(opts, fsfuse.ReplayBuffer(o.ReplayBuffer))
+	}
+	if o.StageWrites || o.StageDir != "" {
+		opts = append(opts, fsfuse.StageWrites(o.StageDir))
+	}
+	if o.SpoolReads || o.SpoolDir != "" {
+		opts = append(opts, fsfuse.SpoolReads(o.SpoolDir))
+	}
+	if o.Readahead > 0 {
+		opts = append(opts, fsfuse.Readahead(o.Readahead, o.ReadaheadMemory))
+	}
+	if o.WriteBehind > 0 {
+		opts = append(opts, fsfuse.WriteBehind(o.WriteBehind))
+	}
+	if o.MaxZeroFill != nil {
+		opts = append(opts, fsfuse.MaxZeroFill(int64(*o.MaxZeroFill)))
+	}
+	if o.ResumeReads > 0 {
+		opts = append(opts, fsfuse.ResumeReads(o.ResumeReads))
+	}
+	return opts
+}
+
+// idMapper returns the mapper presenting a fixed ID if one is given, the ID
+// of the caller if mirror is set, or the ID mapped by ids. It returns nil if
+// IDs are presented unchanged.
+func idMapper(fixed string, mirror bool, mirrorMapper func(context.Context, string) string, ids map[string]string) func(context.Context, string) string {
+	switch {
+	case fixed != "":
+		return func(context.Context, string) string { return fixed }
+	case mirror:
+		return mirrorMapper
+	case len(ids) > 0:
+		return func(_ context.Context, id string) string { return ids[id] }
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gwangyi/fsfuse"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	o, err := ParseMountOptions("defaults,ro,allow_other,uid=1000,gid=users,umask=022,fmask=133,entry_timeout=1.5,relatime,x-systemd.automount,fsname=src", false)
+	if err != nil {
+		t.Fatalf("ParseMountOptions failed: %v", err)
+	}
+	if !o.ReadOnly || !o.AllowOther || o.UID != "1000" || o.GID != "users" {
+		t.Errorf("flags = %+v", o)
+	}
+	if o.FMask != 0133 || o.DMask != 0022 {
+		t.Errorf("masks = (%o, %o), want (133, 22)", o.FMask, o.DMask)
+	}
+	if o.EntryTimeout == nil || *o.EntryTimeout != 1500*time.Millisecond || o.AttrTimeout != nil {
+		t.Errorf("timeouts = (%v, %v), want (1.5s, nil)", o.EntryTimeout, o.AttrTimeout)
+	}
+	if o.Atime == nil || *o.Atime != fsfuse.RelAtime || o.FsName != "src" {
+		t.Errorf("(Atime, FsName) = (%v, %q), want (RelAtime, src)", o.Atime, o.FsName)
+	}
+	if got := len(o.Options()); got != 7 {
+		t.Errorf("len(Options()) = %d, want 7", got)
+	}
+}
+
+func TestParseMountOptions_Streams(t *testing.T) {
+	o, err := ParseMountOptions("max_zero_fill=0,resume_reads=3", false)
+	if err != nil {
+		t.Fatalf("ParseMountOptions failed: %v", err)
+	}
+	if o.MaxZeroFill == nil || *o.MaxZeroFill != 0 {
+		t.Errorf("MaxZeroFill = %v, want 0", o.MaxZeroFill)
+	}
+	if o.ResumeReads != 3 {
+		t.Errorf("ResumeReads = %d, want 3", o.ResumeReads)
+	}
+	if got := len(o.Options()); got != 2 {
+		t.Errorf("len(Options()) = %d, want 2", got)
+	}
+}
+
+func TestParseMountOptions_Errors(t *testing.T) {
+	for _, s := range []string{"bogus", "uid", "fmask=9", "fmask=7777", "attr_timeout=-1", "entry_timeout=soon", "replay_buffer=1T", "max_zero_fill=all", "resume_reads=-1"} {
+		if _, err := ParseMountOptions(s, false); err == nil {
+			t.Errorf("ParseMountOptions(%q) succeeded, want error", s)
+		}
+	}
+	if _, err := ParseMountOptions("bogus,ro", true); err != nil {
+		t.Errorf("ParseMountOptions with sloppy failed: %v", err)
+	}
+	if _, err := ParseMountOptions("fmask=9", true); err == nil {
+		t.Error("ParseMountOptions with sloppy accepted an invalid value")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"65536", 65536, true},
+		{"256K", 256 << 10, true},
+		{"4m", 4 << 20, true},
+		{"1G", 1 << 30, true},
+		{"2G", 0, false},
+		{"K", 0, false},
+		{"-1", 0, false},
+		{"1.5M", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.s)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseSize(%q) = (%d, %v), want %d, ok %v", tt.s, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestOpenSource(t *testing.T) {
+	if _, err := OpenSource(t.TempDir()); err != nil {
+		t.Errorf("OpenSource(dir) failed: %v", err)
+	}
+	if _, err := OpenSource("osfs:" + t.TempDir()); err != nil {
+		t.Errorf("OpenSource(osfs:dir) failed: %v", err)
+	}
+	if _, err := OpenSource(`osfs:{"root": "` + t.TempDir() + `"}`); err != nil {
+		t.Errorf("OpenSource(osfs:{root}) failed: %v", err)
+	}
+	var e *ParamError
+	if _, err := OpenSource("osfs:{}"); !errors.As(err, &e) || e.Key != "root" {
+		t.Errorf("OpenSource(osfs:{}) = %v, want an error at root", err)
+	}
+	if _, err := OpenSource(`osfs:{"root": "/", "extra": 1}`); err == nil {
+		t.Error("OpenSource with an unknown param succeeded, want error")
+	}
+	if _, err := OpenBackend("nope", ""); err == nil {
+		t.Error("OpenBackend(nope) succeeded, want error")
+	}
+}
@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/gwangyi/fsfuse/internal/unmount"
+)
+
+// FsType is the filesystem type of fsfuse mounts in the mount table.
+const FsType = "fuse.fsfuse"
+
+// MountInfo describes an entry of the mount table.
+type MountInfo struct {
+	Source     string
+	Mountpoint string
+	FsType     string
+	Options    string
+}
+
+// Mounts returns the fsfuse mounts listed in /proc/self/mounts.
+func Mounts() ([]MountInfo, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMounts(f)
+}
+
+// parseMounts reads the fsfuse mounts of a mount table in the fstab format.
+func parseMounts(r io.Reader) ([]MountInfo, error) {
+	var mounts []MountInfo
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 || fields[2] != FsType {
+			continue
+		}
+		mounts = append(mounts, MountInfo{
+			Source:     unescapeMountField(fields[0]),
+			Mountpoint: unescapeMountField(fields[1]),
+			FsType:     fields[2],
+			Options:    fields[3],
+		})
+	}
+	return mounts, s.Err()
+}
+
+// unescapeMountField decodes the octal escapes (e.g. \040 for a space) of a
+// mount table field.
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Stale reports whether the FUSE mount at mountpoint has lost its server.
+func Stale(mountpoint string) bool {
+	_, err := os.Stat(mountpoint)
+	return errors.Is(err, syscall.ENOTCONN)
+}
+
+// Unmount unmounts the FUSE filesystem at mountpoint. With lazy, it is
+// detached even if busy. Unprivileged processes go through fusermount.
+func Unmount(mountpoint string, lazy bool) error {
+	return unmount.Unmount(mountpoint, lazy)
+}
@@ -0,0 +1,27 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMounts(t *testing.T) {
+	table := `proc /proc proc rw,nosuid 0 0
+/srv/data /mnt/data fuse.fsfuse rw,nosuid,nodev,relatime,user_id=0,group_id=0 0 0
+/srv/my\040data /mnt/my\040data fuse.fsfuse ro 0 0
+sshfs#host: /mnt/remote fuse.sshfs rw 0 0
+`
+	mounts, err := parseMounts(strings.NewReader(table))
+	if err != nil {
+		t.Fatalf("parseMounts failed: %v", err)
+	}
+	if len(mounts) != 2 {
+		t.Fatalf("got %d mounts, want 2: %+v", len(mounts), mounts)
+	}
+	if mounts[0].Mountpoint != "/mnt/data" || mounts[0].Source != "/srv/data" {
+		t.Errorf("mounts[0] = %+v", mounts[0])
+	}
+	if mounts[1].Mountpoint != "/mnt/my data" || mounts[1].Source != "/srv/my data" || mounts[1].Options != "ro" {
+		t.Errorf("mounts[1] = %+v", mounts[1])
+	}
+}
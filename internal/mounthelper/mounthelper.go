@@ -0,0 +1,153 @@
+// Package mounthelper implements the mount(8) helpers of fsfuse,
+// mount.fsfuse and mount.fuse.fsfuse, which differ only in name.
+//
+// The source is a local directory, or "backend:param" for another backend.
+// Besides the generic mount options, the helpers accept the mount options of
+// cli.ParseMountOptions. They return once the filesystem is mounted, leaving
+// a background process serving it, unless -f is given. Exit codes follow
+// mount(8): 1 for invalid invocations and 32 for mount failures.
+package mounthelper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/gwangyi/fsfuse"
+	"github.com/gwangyi/fsfuse/internal/cli"
+)
+
+// Exit codes defined by mount(8).
+const (
+	exitUsage   = 1
+	exitFailure = 32
+)
+
+// usage is the usage message, formatted with the name of the helper.
+const usage = "usage: %s <source> <mountpoint> [-f] [-s] [-v] [-n] [-o options] [-t type]"
+
+// types are the filesystem types served by the helpers: "fsfuse" for
+// mount.fsfuse, and "fuse.fsfuse", the type listed in the mount table, for
+// mount.fuse.fsfuse.
+var types = []string{"fsfuse", cli.FsType}
+
+// invocation is the parsed command line.
+type invocation struct {
+	source, mountpoint string
+	options            string
+	foreground         bool
+	sloppy             bool
+	verbose            bool
+}
+
+// parseArgs parses the command line as passed by mount(8), where options may
+// follow the positional arguments.
+func parseArgs(args []string) (*invocation, error) {
+	inv := &invocation{}
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-o":
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("-o requires an argument")
+			}
+			i++
+			inv.addOptions(args[i])
+		case strings.HasPrefix(arg, "-o"):
+			inv.addOptions(arg[2:])
+		case arg == "-f":
+			inv.foreground = true
+		case arg == "-s":
+			inv.sloppy = true
+		case arg == "-v":
+			inv.verbose = true
+		case arg == "-n":
+			// There is no mtab to skip writing to.
+		case arg == "-t":
+			// mount(8) passes the type to helpers of fuse subtypes.
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("-t requires an argument")
+			}
+			i++
+			if !slices.Contains(types, args[i]) {
+				return nil, fmt.Errorf("unsupported type %s", args[i])
+			}
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			return nil, fmt.Errorf("unknown flag %s", arg)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) != 2 {
+		return nil, fmt.Errorf("expected a source and a mountpoint")
+	}
+	inv.source, inv.mountpoint = positional[0], positional[1]
+	return inv, nil
+}
+
+// addOptions appends a comma-separated list of options.
+func (inv *invocation) addOptions(s string) {
+	if inv.options != "" {
+		inv.options += ","
+	}
+	inv.options += s
+}
+
+// Run mounts the filesystem as the helper named name, with the command line
+// args passed by mount(8), and returns the exit code.
+func Run(name string, args []string, stderr io.Writer) int {
+	inv, err := parseArgs(args)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n"+usage+"\n", name, err, name)
+		return exitUsage
+	}
+	mo, err := cli.ParseMountOptions(inv.options, inv.sloppy)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", name, err)
+		return exitUsage
+	}
+	if mo.FsName == "" {
+		mo.FsName = inv.source
+	}
+
+	if !inv.foreground && !cli.IsDaemon() {
+		if err := cli.Daemonize(); err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", name, err)
+			return exitFailure
+		}
+		return 0
+	}
+
+	level := slog.LevelWarn
+	if inv.verbose {
+		level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: level}))
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	m, err := mount(ctx, inv, mo, logger)
+	cli.NotifyReady(err)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", name, err)
+		return exitFailure
+	}
+	m.Wait()
+	return 0
+}
+
+// mount opens the backend and mounts it.
+func mount(ctx context.Context, inv *invocation, mo *cli.MountOptions, logger *slog.Logger) (*fsfuse.MountHandle, error) {
+	fsys, err := cli.OpenSource(inv.source)
+	if err != nil {
+		return nil, err
+	}
+	return fsfuse.Mount(ctx, inv.mountpoint, fsys, append(mo.Options(), fsfuse.Logger(logger))...)
+}
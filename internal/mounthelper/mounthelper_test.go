@@ -0,0 +1,41 @@
+package mounthelper
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	inv, err := parseArgs([]string{"/src", "/mnt", "-o", "ro", "-n", "-oallow_other", "-f", "-s"})
+	if err != nil {
+		t.Fatalf("parseArgs failed: %v", err)
+	}
+	if inv.source != "/src" || inv.mountpoint != "/mnt" || inv.options != "ro,allow_other" || !inv.foreground || !inv.sloppy {
+		t.Errorf("parseArgs = %+v", inv)
+	}
+
+	// mount(8) passes the type to mount.fuse.fsfuse.
+	inv, err = parseArgs([]string{"/src", "/mnt", "-o", "ro", "-t", "fuse.fsfuse"})
+	if err != nil || inv.options != "ro" {
+		t.Errorf("parseArgs with -t fuse.fsfuse = (%+v, %v)", inv, err)
+	}
+
+	for _, args := range [][]string{{"/src"}, {"/src", "/mnt", "-o"}, {"/src", "/mnt", "-x"}, {"/src", "/mnt", "-t"}, {"/src", "/mnt", "-t", "fuse.sshfs"}} {
+		if _, err := parseArgs(args); err == nil {
+			t.Errorf("parseArgs(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func TestRun_Usage(t *testing.T) {
+	var stderr strings.Builder
+	if code := Run("mount.fuse.fsfuse", []string{"/src"}, &stderr); code != exitUsage {
+		t.Errorf("run = %d, want %d", code, exitUsage)
+	}
+	if code := Run("mount.fuse.fsfuse", []string{"/src", "/mnt", "-o", "bogus"}, &stderr); code != exitUsage {
+		t.Errorf("run with a bad option = %d, want %d", code, exitUsage)
+	}
+	if !strings.Contains(stderr.String(), "usage: mount.fuse.fsfuse ") {
+		t.Errorf("stderr = %q, want usage", stderr.String())
+	}
+}
@@ -0,0 +1,39 @@
+// Package unmount unmounts FUSE filesystems, for the library and the
+// command-line tools alike.
+package unmount
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Unmount unmounts the FUSE filesystem at mountpoint. With lazy, it is
+// detached even if busy. Unprivileged processes go through fusermount.
+func Unmount(mountpoint string, lazy bool) error {
+	flags := 0
+	if lazy {
+		flags = syscall.MNT_DETACH
+	}
+	err := syscall.Unmount(mountpoint, flags)
+	if err == nil || !errors.Is(err, syscall.EPERM) {
+		return err
+	}
+	args := []string{"-u"}
+	if lazy {
+		args = append(args, "-z")
+	}
+	args = append(args, mountpoint)
+	for _, bin := range []string{"fusermount3", "fusermount"} {
+		if _, lookErr := exec.LookPath(bin); lookErr != nil {
+			continue
+		}
+		out, runErr := exec.Command(bin, args...).CombinedOutput()
+		if runErr != nil {
+			return errors.New(strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	return err
+}
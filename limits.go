@@ -0,0 +1,62 @@
+package fsfuse
+
+import (
+	"context"
+	"path"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// defaultNameLen is the maximum name length reported by statfs when
+// MaxNameLen is not given.
+const defaultNameLen = 255
+
+var _ fs.NodeStatfser = &node{}
+
+// MaxNameLen limits the length of names in bytes, as backends such as object
+// stores do. Longer names fail with ENAMETOOLONG instead of an opaque error
+// from the backend, and the limit is reported through statfs.
+// Zero means no limit.
+func MaxNameLen(n int) Option {
+	return func(c *config) {
+		c.maxNameLen = n
+	}
+}
+
+// MaxPathLen limits the length in bytes of the paths passed to the backend,
+// including the Subtree directory, if any. Longer paths fail with
+// ENAMETOOLONG. Zero means no limit.
+func MaxPathLen(n int) Option {
+	return func(c *config) {
+		c.maxPathLen = n
+	}
+}
+
+// checkLen fails with ENAMETOOLONG if the backend path p or its last element
+// exceeds the configured limits.
+func (c *config) checkLen(p string) syscall.Errno {
+	if c.maxNameLen > 0 && len(path.Base(p)) > c.maxNameLen {
+		return syscall.ENAMETOOLONG
+	}
+	if c.maxPathLen > 0 && len(p) > c.maxPathLen {
+		return syscall.ENAMETOOLONG
+	}
+	return 0
+}
+
+// Statfs reports filesystem statistics.
+// The backend does not expose any capacity, so only the block size and the
+// maximum name length are filled in.
+func (n *node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	// Every request is numbered, even those which do not reach the backend.
+	_ = n.startRequest(ctx, "Statfs")
+	out.Bsize = 4096
+	out.Frsize = 4096
+	out.NameLen = defaultNameLen
+	if n.cfg.maxNameLen > 0 {
+		out.NameLen = uint32(n.cfg.maxNameLen)
+	}
+	return 0
+}
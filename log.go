@@ -0,0 +1,136 @@
+package fsfuse
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LogPolicy decides whether and at which level a failed operation is logged.
+// op is the name of the FUSE operation, as the method of the go-fuse
+// interface implementing it, e.g. "Lookup", "Mkdir" or "Read"; errno is the
+// error returned to the kernel. If ok is false, the failure is not logged.
+type LogPolicy func(op string, errno syscall.Errno) (level slog.Level, ok bool)
+
+// DefaultLogPolicy logs every failure at slog.LevelError, except for ENOENT
+// from Getattr and Lookup, which are part of normal operation.
+func DefaultLogPolicy(op string, errno syscall.Errno) (slog.Level, bool) {
+	if errno == syscall.ENOENT && (op == "Getattr" || op == "Lookup") {
+		return 0, false
+	}
+	return slog.LevelError, true
+}
+
+// LogLevels sets the policy deciding how failed operations are logged.
+// The default is DefaultLogPolicy.
+func LogLevels(p LogPolicy) Option {
+	return func(c *config) {
+		c.logPolicy = p
+	}
+}
+
+// LogSampling limits repeated failures to burst log records per interval.
+// Failures are considered the same if they share the operation, the errno and
+// the message. The number of records suppressed in the meantime is reported
+// in the "suppressed" attribute of the next record logged for the same
+// failure.
+func LogSampling(burst int, interval time.Duration) Option {
+	return func(c *config) {
+		c.logBurst = burst
+		c.logInterval = interval
+	}
+}
+
+// logKey identifies failures which are sampled together.
+type logKey struct {
+	op    string
+	errno syscall.Errno
+	msg   string
+}
+
+// logWindow counts the records of a failure within the current interval.
+type logWindow struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// logSampler rate-limits identical log records.
+type logSampler struct {
+	mu      sync.Mutex
+	windows map[logKey]*logWindow
+}
+
+// allow reports whether a record for key may be logged at now, given burst
+// records per interval. If so, it also returns the number of records which
+// were suppressed since the last one logged.
+func (s *logSampler) allow(key logKey, now time.Time, burst int, interval time.Duration) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.windows == nil {
+		s.windows = make(map[logKey]*logWindow)
+	}
+	w, ok := s.windows[key]
+	if !ok {
+		w = &logWindow{start: now}
+		s.windows[key] = w
+	}
+	if now.Sub(w.start) >= interval {
+		w.start = now
+		w.count = 0
+	}
+	if w.count >= burst {
+		w.suppressed++
+		return false, 0
+	}
+	w.count++
+	suppressed := w.suppressed
+	w.suppressed = 0
+	return true, suppressed
+}
+
+// logFailure logs msg with args through logger for the operation op which
+// failed with errno, according to the LogPolicy and sampling.
+// The Request served with ctx, if any, is logged as the "request" group.
+func (c *config) logFailure(ctx context.Context, logger *slog.Logger, op string, errno syscall.Errno, msg string, args ...any) {
+	policy := c.logPolicy
+	if policy == nil {
+		policy = DefaultLogPolicy
+	}
+	level, ok := policy(op, errno)
+	if !ok || !logger.Enabled(ctx, level) {
+		return
+	}
+	if c.logBurst > 0 {
+		allowed, suppressed := c.sampler.allow(logKey{op, errno, msg}, time.Now(), c.logBurst, c.logInterval)
+		if !allowed {
+			return
+		}
+		if suppressed > 0 {
+			args = append(args, "suppressed", suppressed)
+		}
+	}
+	if r, ok := RequestFromContext(ctx); ok {
+		args = append(args, slog.Any("request", r))
+	}
+	logger.Log(ctx, level, msg, args...)
+}
+
+// fail logs err, which made the operation op fail, and returns the errno
+// reported to the kernel.
+func (n *node) fail(ctx context.Context, op, msg string, err error, args ...any) syscall.Errno {
+	errno := n.cfg.toErrno(err)
+	n.cfg.logFailure(ctx, n.logger, op, errno, msg, append(args, "error", err)...)
+	return errno
+}
+
+// fail logs err, which made the operation op fail, and returns the errno
+// reported to the kernel.
+func (fh *fileHandle) fail(ctx context.Context, op, msg string, err error, args ...any) syscall.Errno {
+	errno := fh.cfg.toErrno(err)
+	fh.cfg.logFailure(ctx, fh.logger, op, errno, msg, append(args, "error", err)...)
+	return errno
+}
@@ -0,0 +1,201 @@
+package fsfuse
+
+import (
+	"context"
+	"errors"
+	iofs "io/fs"
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/gwangyi/fsfuse/internal/unmount"
+	"github.com/gwangyi/fsx/contextual"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// defaultTimeout is the default time the kernel caches entries and
+// attributes for.
+const defaultTimeout = time.Second
+
+// FsName sets the name of the filesystem shown as its source by mount and
+// df when mounted with Mount. The default is "fsfuse", followed by the
+// Subtree directory, if any.
+func FsName(name string) Option {
+	return func(c *config) {
+		c.fsName = name
+	}
+}
+
+// Timeouts sets how long the kernel caches entries, attributes and failed
+// lookups when mounted with Mount. The defaults are one second each, except
+// for failed lookups with CaseInsensitive or NormalizeNames, which are not
+// cached, as a name not found says nothing about its other spellings.
+func Timeouts(entry, attr, negative time.Duration) Option {
+	return func(c *config) {
+		c.timeouts = &[3]time.Duration{entry, attr, negative}
+	}
+}
+
+// FuseOptions adjusts the fs.Options used by Mount after the defaults are
+// applied, e.g. to allow other users to access the mount.
+func FuseOptions(f func(*fs.Options)) Option {
+	return func(c *config) {
+		c.fuseOptions = append(c.fuseOptions, f)
+	}
+}
+
+// mountOptions derives the fs.Options for mounting the filesystem.
+func (c *config) mountOptions() *fs.Options {
+	entry, attr, negative := defaultTimeout, defaultTimeout, defaultTimeout
+	if c.fuzzyNames() {
+		negative = 0
+	}
+	if c.timeouts != nil {
+		entry, attr, negative = c.timeouts[0], c.timeouts[1], c.timeouts[2]
+	}
+
+	fsName := c.fsName
+	if fsName == "" {
+		fsName = "fsfuse"
+		if c.root != "." {
+			fsName += ":" + c.root
+		}
+	}
+
+	opts := &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName: fsName,
+			Name:   "fsfuse",
+		},
+		EntryTimeout:    &entry,
+		AttrTimeout:     &attr,
+		NegativeTimeout: &negative,
+	}
+	if c.readOnly {
+		opts.Options = append(opts.Options, "ro")
+	}
+	for _, f := range c.fuseOptions {
+		f(opts)
+	}
+	return opts
+}
+
+// MountHandle is a filesystem mounted with Mount.
+type MountHandle struct {
+	mountpoint string
+	server     *fuse.Server
+	done       chan struct{}
+}
+
+// Mount mounts fsys at mountpoint and serves it in the background until it
+// is unmounted, either through the returned handle, externally (e.g. with
+// fusermount -u), or by canceling ctx. If it is still in use when ctx is
+// canceled, unmounting is retried for a few seconds, after which it is
+// detached, to be unmounted once it is no longer in use.
+//
+// The root of the filesystem is validated as by NewContext. A stale mount
+// left at mountpoint by a crashed process is cleaned up first.
+func Mount(ctx context.Context, mountpoint string, fsys contextual.FS, opts ...Option) (*MountHandle, error) {
+	cfg := newConfig(opts)
+	root, err := newCheckedRoot(ctx, fsys, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(mountpoint); errors.Is(err, syscall.ENOTCONN) {
+		cfg.logger.Warn("Cleaning up stale mount", "mountpoint", mountpoint)
+		if err := unmount.Unmount(mountpoint, true); err != nil {
+			return nil, &iofs.PathError{Op: "mount", Path: mountpoint, Err: err}
+		}
+	}
+
+	server, err := fs.Mount(mountpoint, root, cfg.mountOptions())
+	if err != nil {
+		return nil, &iofs.PathError{Op: "mount", Path: mountpoint, Err: err}
+	}
+
+	m := &MountHandle{
+		mountpoint: mountpoint,
+		server:     server,
+		done:       make(chan struct{}),
+	}
+	go func() {
+		server.Wait()
+		close(m.done)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			m.unmountCanceled(cfg.logger)
+		case <-m.done:
+		}
+	}()
+	return m, nil
+}
+
+// unmountDelays are the delays between the attempts to unmount a filesystem
+// whose context is canceled while it is in use. It is detached once they are
+// exhausted.
+var unmountDelays = []time.Duration{
+	100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+	800 * time.Millisecond, 1600 * time.Millisecond,
+}
+
+// unmountCanceled unmounts the filesystem after its context is canceled.
+func (m *MountHandle) unmountCanceled(logger *slog.Logger) {
+	err := retryUnmount(m.Unmount, m.done, unmountDelays)
+	if err != nil {
+		logger.Warn("Unmount failed, detaching the filesystem", "mountpoint", m.mountpoint, "error", err)
+		err = unmount.Unmount(m.mountpoint, true)
+	}
+	if err != nil {
+		logger.Error("Unmount failed", "mountpoint", m.mountpoint, "error", err)
+	}
+}
+
+// retryUnmount calls unmount until it succeeds or done is closed, waiting
+// each of delays in turn between the attempts, and returns the last error.
+// The filesystem may be busy only briefly, e.g. while a shell leaves it.
+func retryUnmount(unmount func() error, done <-chan struct{}, delays []time.Duration) error {
+	err := unmount()
+	for _, d := range delays {
+		if err == nil {
+			break
+		}
+		select {
+		case <-time.After(d):
+		case <-done:
+			return nil
+		}
+		err = unmount()
+	}
+	return err
+}
+
+// Mountpoint returns the directory the filesystem is mounted at.
+func (m *MountHandle) Mountpoint() string {
+	return m.mountpoint
+}
+
+// Unmount unmounts the filesystem. It fails with EBUSY if the filesystem is
+// still in use.
+func (m *MountHandle) Unmount() error {
+	select {
+	case <-m.done:
+		return nil
+	default:
+	}
+	return m.server.Unmount()
+}
+
+// Wait blocks until the filesystem is unmounted.
+func (m *MountHandle) Wait() {
+	<-m.done
+}
+
+// Done returns a channel which is closed once the filesystem is unmounted.
+func (m *MountHandle) Done() <-chan struct{} {
+	return m.done
+}
@@ -0,0 +1,296 @@
+package fsfuse
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/gwangyi/fsx/contextual"
+	"golang.org/x/text/unicode/norm"
+)
+
+// CollisionPolicy decides how names which differ only in case are handled
+// in case-insensitive mode.
+type CollisionPolicy int
+
+const (
+	// CollisionExact lists all colliding entries. A lookup matching an
+	// entry exactly resolves to it; other lookups resolve to the lexically
+	// first of the colliding entries.
+	CollisionExact CollisionPolicy = iota
+	// CollisionFirst only exposes the lexically first of the colliding
+	// entries, both in listings and lookups. Every lookup reads the
+	// directory to find it.
+	CollisionFirst
+	// CollisionError lists all colliding entries, but fails lookups which
+	// do not match any of them exactly with EIO.
+	CollisionError
+)
+
+// NormalizationForm is a Unicode normalization form applied to names.
+type NormalizationForm int
+
+const (
+	// NFC is the canonical composition form, used by Linux and Windows
+	// tools in practice.
+	NFC NormalizationForm = iota + 1
+	// NFD is the canonical decomposition form, produced by macOS.
+	NFD
+)
+
+// form returns the norm.Form corresponding to f.
+func (f NormalizationForm) form() norm.Form {
+	if f == NFD {
+		return norm.NFD
+	}
+	return norm.NFC
+}
+
+// errAmbiguousName is returned when a name matches several entries and the
+// CollisionPolicy does not allow choosing one.
+var errAmbiguousName = errors.New("ambiguous name")
+
+// CaseInsensitive makes names case-insensitive, as on the filesystems of
+// Windows and macOS. Names are resolved against directory listings when the
+// backend does not have an exact match, which costs an extra backend call;
+// so do all names under CollisionFirst, and the names of new entries, which
+// must not collide with existing ones.
+//
+// If preserving is true, new entries keep the case they are created with;
+// otherwise their names are converted to lower case. Creating, making a
+// directory, symlinking or renaming to a name differing only in case from an
+// existing entry acts on that entry, as a case-insensitive filesystem would.
+// policy decides what happens when the backend has several entries whose
+// names differ only in case.
+func CaseInsensitive(preserving bool, policy CollisionPolicy) Option {
+	return func(c *config) {
+		c.caseInsensitive = true
+		c.casePreserving = preserving
+		c.collision = policy
+	}
+}
+
+// NormalizeNames converts names to the given Unicode normalization form, both
+// when they are passed to the backend for new entries and when they are
+// listed to the kernel.
+// Lookups tolerate either form on the backend, so entries created in another
+// form remain reachable, and creating an entry whose name only differs in
+// normalization from an existing one acts on the existing entry.
+func NormalizeNames(form NormalizationForm) Option {
+	return func(c *config) {
+		c.normalization = form
+	}
+}
+
+// fuzzyNames reports whether names need to be resolved against directory
+// listings, rather than being used as is.
+func (c *config) fuzzyNames() bool {
+	return c.caseInsensitive || c.normalization != 0
+}
+
+// nameKey returns the key under which two names are considered the same.
+func (c *config) nameKey(name string) string {
+	if c.normalization != 0 {
+		name = norm.NFC.String(name)
+	}
+	if c.caseInsensitive {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+// newName converts a name supplied by the kernel for a new entry into the
+// name it is created with on the backend.
+func (c *config) newName(name string) string {
+	if c.caseInsensitive && !c.casePreserving {
+		name = strings.ToLower(name)
+	}
+	return c.listName(name)
+}
+
+// listName converts a backend name into the name presented to the kernel.
+func (c *config) listName(name string) string {
+	if c.normalization != 0 {
+		name = c.normalization.form().String(name)
+	}
+	return name
+}
+
+// nameForms returns name followed by its other normalization forms, if
+// normalization is enabled. The configured form comes first.
+func (c *config) nameForms(name string) []string {
+	forms := []string{name}
+	if c.normalization == 0 {
+		return forms
+	}
+	for _, f := range []NormalizationForm{c.normalization, NFC + NFD - c.normalization} {
+		if alt := f.form().String(name); !slices.Contains(forms, alt) {
+			forms = append(forms, alt)
+		}
+	}
+	return forms
+}
+
+// preferName reports whether a is preferred over b when several backend
+// entries are equivalent: names already in the listed form win, then the
+// lexically first one.
+func (c *config) preferName(a, b string) bool {
+	aListed, bListed := c.listName(a) == a, c.listName(b) == b
+	if aListed != bListed {
+		return aListed
+	}
+	return a < b
+}
+
+// findName looks for the entry of the directory n which name refers to once
+// the configured name equivalence is applied, following the CollisionPolicy.
+// It returns fs.ErrNotExist if there is none. Hidden entries are ignored.
+//
+// Without case-insensitivity, the normalization forms of name are probed
+// directly instead of reading the directory.
+func (n *node) findName(ctx context.Context, name string) (string, error) {
+	if !n.cfg.caseInsensitive {
+		actual, _, err := n.probeName(ctx, name)
+		return actual, err
+	}
+	entries, err := contextual.ReadDir(ctx, n.fsys, n.path)
+	if err != nil {
+		return "", err
+	}
+	key := n.cfg.nameKey(name)
+	var matches []string
+	for _, entry := range entries {
+		if n.cfg.nameKey(entry.Name()) == key && !n.cfg.hidden(path.Join(n.path, entry.Name())) {
+			matches = append(matches, entry.Name())
+		}
+	}
+	switch {
+	case len(matches) == 0:
+		return "", fs.ErrNotExist
+	case n.cfg.collision != CollisionFirst && slices.Contains(matches, name):
+		return name, nil
+	case len(matches) > 1 && n.cfg.collision == CollisionError:
+		return "", errAmbiguousName
+	}
+	return slices.MinFunc(matches, func(a, b string) int {
+		if n.cfg.preferName(a, b) {
+			return -1
+		}
+		return 1
+	}), nil
+}
+
+// probeName stats the normalization forms of name in turn and returns the
+// first existing one along with its attributes.
+func (n *node) probeName(ctx context.Context, name string) (string, fs.FileInfo, error) {
+	var err error
+	for _, alt := range n.cfg.nameForms(name) {
+		childPath := path.Join(n.path, alt)
+		if n.cfg.hidden(childPath) {
+			continue
+		}
+		var fi fs.FileInfo
+		fi, err = contextual.Lstat(ctx, n.fsys, childPath)
+		if err == nil || n.cfg.toErrno(err) != syscall.ENOENT {
+			return alt, fi, err
+		}
+	}
+	if err == nil {
+		err = fs.ErrNotExist
+	}
+	return "", nil, err
+}
+
+// lookupName resolves name within the directory n and stats the entry.
+// It returns the backend name of the entry along with its attributes.
+// The name is tried as is first, unless the CollisionPolicy requires reading
+// the directory anyway.
+func (n *node) lookupName(ctx context.Context, name string) (string, fs.FileInfo, error) {
+	if !n.cfg.caseInsensitive {
+		return n.probeName(ctx, name)
+	}
+	if n.cfg.collision != CollisionFirst {
+		fi, err := contextual.Lstat(ctx, n.fsys, path.Join(n.path, name))
+		if err == nil || n.cfg.toErrno(err) != syscall.ENOENT {
+			return name, fi, err
+		}
+	}
+	actual, err := n.findName(ctx, name)
+	if err != nil {
+		return "", nil, err
+	}
+	fi, err := contextual.Lstat(ctx, n.fsys, path.Join(n.path, actual))
+	return actual, fi, err
+}
+
+// exactName reports whether the directory n has an entry named name exactly,
+// in case-insensitive mode, where such an entry is the one name refers to
+// unless the CollisionPolicy is CollisionFirst. It spares reading the
+// directory for names used with their case on the backend.
+func (n *node) exactName(ctx context.Context, name string) bool {
+	if !n.cfg.caseInsensitive || n.cfg.collision == CollisionFirst {
+		return false
+	}
+	_, err := contextual.Lstat(ctx, n.fsys, path.Join(n.path, name))
+	return err == nil
+}
+
+// existingName returns the backend name of the existing entry which name
+// refers to. If it cannot be resolved, name is returned as is and the backend
+// reports the error.
+func (n *node) existingName(ctx context.Context, name string) string {
+	if !n.cfg.fuzzyNames() || n.exactName(ctx, name) {
+		return name
+	}
+	if actual, err := n.findName(ctx, name); err == nil {
+		return actual
+	}
+	return name
+}
+
+// variantName returns the backend name of an existing entry which is
+// equivalent to, but not the same as, the new name.
+// It returns an empty string if there is no such entry.
+func (n *node) variantName(ctx context.Context, name string) (string, error) {
+	if !n.cfg.fuzzyNames() || n.exactName(ctx, name) {
+		return "", nil
+	}
+	actual, err := n.findName(ctx, name)
+	if err != nil {
+		if n.cfg.toErrno(err) == syscall.ENOENT {
+			return "", nil
+		}
+		return "", err
+	}
+	if actual == name {
+		return "", nil
+	}
+	return actual, nil
+}
+
+// listNames drops the entries which must not be listed: under
+// CollisionFirst, all but the preferred one of the colliding entries, and
+// with normalization, all but one of the entries listed under the same name.
+func (n *node) listNames(entries []fs.DirEntry) []fs.DirEntry {
+	group := n.cfg.listName
+	switch {
+	case n.cfg.caseInsensitive && n.cfg.collision == CollisionFirst:
+		group = n.cfg.nameKey
+	case n.cfg.normalization == 0:
+		return entries
+	}
+	keep := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		key := group(entry.Name())
+		if cur, ok := keep[key]; !ok || n.cfg.preferName(entry.Name(), cur) {
+			keep[key] = entry.Name()
+		}
+	}
+	return slices.DeleteFunc(slices.Clone(entries), func(entry fs.DirEntry) bool {
+		return keep[group(entry.Name())] != entry.Name()
+	})
+}
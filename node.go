@@ -2,9 +2,14 @@ package fsfuse
 
 import (
 	"context"
+	"io"
+	iofs "io/fs"
 	"log/slog"
 	"path"
+	"slices"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -18,6 +23,17 @@ type node struct {
 	fsys   contextual.FS
 	path   string
 	logger *slog.Logger
+	cfg    *config
+
+	// cache tracks the attributes seen by the last Open to decide whether
+	// the kernel page cache may be kept.
+	cache cacheState
+	// staged is the latest handle staging writes to the file, if any, whose
+	// content is presented until it is released.
+	staged atomic.Pointer[fileHandle]
+	// writers are the handles buffering writes to the file.
+	writersMu sync.Mutex
+	writers   map[*fileHandle]struct{}
 }
 
 // Ensure node implements various FUSE node interfaces.
@@ -34,52 +50,100 @@ var _ fs.NodeReadlinker = &node{}
 var _ fs.NodeRenamer = &node{}
 var _ fs.NodeSetattrer = &node{}
 
+// newChild creates a node for the given path sharing the configuration of n.
+func (n *node) newChild(childPath string) *node {
+	return &node{
+		fsys:   n.fsys,
+		path:   childPath,
+		logger: n.logger,
+		cfg:    n.cfg,
+	}
+}
+
+// newFileHandle wraps a file of this node opened with flags into a
+// fileHandle.
+func (n *node) newFileHandle(f contextual.File, flags uint32) *fileHandle {
+	fh := &fileHandle{f: f, flags: flags, logger: n.logger, cfg: n.cfg, node: n, id: lastHandleID.Add(1)}
+	_, fh.readerAt = f.(io.ReaderAt)
+	if fh.readerAt && n.cfg.readahead != nil {
+		// The readahead reads through the handle, whose file may be
+		// reopened.
+		fh.readahead = newReadahead(n.cfg.readahead, readerAtFunc(fh.readAt))
+	}
+	if n.cfg.writeBehind > 0 {
+		fh.wb = &writeBuffer{}
+		n.addWriter(fh)
+	}
+	return fh
+}
+
 // Getattr retrieves the attributes of the node.
 // It tries to use the open file handle if available to get the most up-to-date
-// stats. Otherwise, it calls Lstat on the underlying filesystem.
+// stats. While writes to the file are staged, the staged size is presented,
+// and buffered writes are included in the size.
+// Otherwise, it calls Lstat on the underlying filesystem.
 func (n *node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	if f != nil {
-		if fh, ok := f.(*fileHandle); ok {
-			fi, err := fh.f.Stat()
-			if err == nil {
-				statToAttr(fi, &out.Attr)
-				return 0
-			}
+	return n.getattr(n.startRequest(ctx, "Getattr"), f, out)
+}
+
+// getattr is Getattr within the request served with ctx.
+func (n *node) getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fh, _ := f.(*fileHandle)
+	if fh != nil && fh.stage == nil {
+		fi, err := fh.stat()
+		if err == nil {
+			n.fillAttr(ctx, fi, &out.Attr)
+			n.addBuffered(&out.Attr)
+			return 0
 		}
 	}
+	if fh == nil || fh.stage == nil {
+		fh = n.staged.Load()
+	}
+	if fh != nil {
+		return fh.stagedAttr(ctx, &out.Attr)
+	}
 
 	fi, err := contextual.Lstat(ctx, n.fsys, n.path)
 	if err != nil {
-		errno := toErrno(err)
-		if errno != syscall.ENOENT {
-			n.logger.Error("Getattr failed", "path", n.path, "error", err)
-		}
-		return errno
+		return n.fail(ctx, "Getattr", "Getattr failed", err, "path", n.path)
 	}
-	statToAttr(fi, &out.Attr)
+	n.fillAttr(ctx, fi, &out.Attr)
+	n.addBuffered(&out.Attr)
 	return 0
 }
 
 // Lookup finds a child node with the given name within the current directory.
 // It returns a new node representing the child.
+// In case-insensitive mode, the name is resolved to the matching backend entry.
+// In SymlinkFollow mode, a link resolves to the node of its target.
 func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ctx = n.startRequest(ctx, "Lookup")
 	childPath := path.Join(n.path, name)
-	fi, err := contextual.Lstat(ctx, n.fsys, childPath)
+	if errno := n.cfg.checkLen(childPath); errno != 0 {
+		return nil, errno
+	}
+	if n.cfg.hidden(childPath) {
+		return nil, syscall.ENOENT
+	}
+	name, fi, err := n.lookupName(ctx, name)
 	if err != nil {
-		errno := toErrno(err)
-		if errno != syscall.ENOENT {
-			n.logger.Error("Lookup failed", "path", childPath, "error", err)
+		return nil, n.fail(ctx, "Lookup", "Lookup failed", err, "path", childPath)
+	}
+	childPath = path.Join(n.path, name)
+	if n.cfg.hidden(childPath) {
+		return nil, syscall.ENOENT
+	}
+	if fi.Mode()&iofs.ModeSymlink != 0 && n.cfg.symlinkPolicy() == SymlinkFollow {
+		childPath, fi, err = n.resolve(ctx, name)
+		if err != nil {
+			return nil, n.fail(ctx, "Lookup", "Lookup failed", err, "path", path.Join(n.path, name))
 		}
-		return nil, errno
 	}
 
-	statToAttr(fi, &out.Attr)
+	n.fillAttr(ctx, fi, &out.Attr)
 
-	child := &node{
-		fsys:   n.fsys,
-		path:   childPath,
-		logger: n.logger,
-	}
+	child := n.newChild(childPath)
 
 	id := fs.StableAttr{
 		Mode: toFuseMode(fi.Mode()),
@@ -90,20 +154,35 @@ func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs
 }
 
 // Readdir reads the contents of the directory.
-// It returns a stream of directory entries.
+// It returns a stream of directory entries, leaving out hidden ones and
+// those not exposed under the CollisionPolicy. In SymlinkFollow mode, links
+// are listed as the type of their target, or left out if unresolvable.
 func (n *node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	ctx = n.startRequest(ctx, "Readdir")
 	entries, err := contextual.ReadDir(ctx, n.fsys, n.path)
 	if err != nil {
-		n.logger.Error("Readdir failed", "path", n.path, "error", err)
-		return nil, toErrno(err)
+		return nil, n.fail(ctx, "Readdir", "Readdir failed", err, "path", n.path)
 	}
 
+	entries = slices.DeleteFunc(entries, func(entry iofs.DirEntry) bool {
+		return n.cfg.hidden(path.Join(n.path, entry.Name()))
+	})
+	entries = n.listNames(entries)
+
+	follow := n.cfg.symlinkPolicy() == SymlinkFollow
 	r := make([]fuse.DirEntry, 0, len(entries))
 	for _, entry := range entries {
 		d := fuse.DirEntry{
-			Name: entry.Name(),
+			Name: n.cfg.listName(entry.Name()),
 			Mode: uint32(entry.Type()),
 		}
+		if follow && entry.Type()&iofs.ModeSymlink != 0 {
+			_, fi, err := n.resolve(ctx, entry.Name())
+			if err != nil {
+				continue
+			}
+			d.Mode = uint32(fi.Mode().Type())
+		}
 		r = append(r, d)
 	}
 	return fs.NewListDirStream(r), 0
@@ -111,70 +190,128 @@ func (n *node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 
 // Open opens the file associated with this node.
 // It returns a FileHandle that wraps the underlying file.
+// The kernel page cache is kept only if the file is unchanged since it was
+// last opened; see openFlags for the details.
 func (n *node) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	ctx = n.startRequest(ctx, "Open")
+	if n.cfg.readOnly && flags&writeFlags != 0 {
+		return nil, 0, syscall.EROFS
+	}
 	f, err := contextual.OpenFile(ctx, n.fsys, n.path, int(flags), 0)
 	if err != nil {
-		n.logger.Error("Open failed", "path", n.path, "error", err)
-		return nil, 0, toErrno(err)
+		return nil, 0, n.fail(ctx, "Open", "Open failed", err, "path", n.path)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		// Not fatal; the page cache is just not kept.
+		fi = nil
 	}
-	return &fileHandle{f: f, logger: n.logger}, fuse.FOPEN_KEEP_CACHE, 0
+	fh := n.newFileHandle(f, flags)
+	fh.resumeReads(flags, fi)
+	errno := n.stageWrites(ctx, "Open", fh, flags, fi, false)
+	if errno == 0 {
+		errno = n.spoolReads(ctx, fh, flags)
+	}
+	if errno != 0 {
+		_ = f.Close()
+		return nil, 0, errno
+	}
+	return fh, n.openFlags(ctx, flags, fi, false), 0
 }
 
 // Create creates a new file in the directory and opens it.
 // It handles mode conversion from FUSE to Go.
+// In case-insensitive mode, an existing entry differing only in case is opened
+// instead, or EEXIST is returned if O_EXCL is given.
 func (n *node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	ctx = n.startRequest(ctx, "Create")
+	if n.cfg.readOnly {
+		return nil, nil, 0, syscall.EROFS
+	}
+	name = n.cfg.newName(name)
 	childPath := path.Join(n.path, name)
+	if errno := n.cfg.checkLen(childPath); errno != 0 {
+		return nil, nil, 0, errno
+	}
+	if n.cfg.hidden(childPath) {
+		return nil, nil, 0, n.cfg.hiddenErrno
+	}
+	variant, err := n.variantName(ctx, name)
+	if err != nil {
+		return nil, nil, 0, n.fail(ctx, "Create", "Create: name resolution failed", err, "path", childPath)
+	}
+	if variant != "" {
+		if flags&syscall.O_EXCL != 0 {
+			return nil, nil, 0, syscall.EEXIST
+		}
+		childPath = path.Join(n.path, variant)
+	}
 	f, err := contextual.OpenFile(ctx, n.fsys, childPath, int(flags)|syscall.O_CREAT, toFileMode(mode))
 	if err != nil {
-		n.logger.Error("Create failed", "path", childPath, "error", err)
-		return nil, nil, 0, toErrno(err)
+		return nil, nil, 0, n.fail(ctx, "Create", "Create failed", err, "path", childPath)
 	}
 
 	fi, err := f.Stat()
 	if err != nil {
-		n.logger.Error("Create: stat failed", "path", childPath, "error", err)
 		_ = f.Close()
-		return nil, nil, 0, toErrno(err)
+		return nil, nil, 0, n.fail(ctx, "Create", "Create: stat failed", err, "path", childPath)
 	}
 
-	statToAttr(fi, &out.Attr)
+	n.fillAttr(ctx, fi, &out.Attr)
 
-	child := &node{
-		fsys:   n.fsys,
-		path:   childPath,
-		logger: n.logger,
-	}
+	child := n.newChild(childPath)
 
 	id := fs.StableAttr{
 		Mode: toFuseMode(fi.Mode()),
 		Ino:  out.Ino,
 	}
 
-	return n.NewInode(ctx, child, id), &fileHandle{f: f, logger: n.logger}, fuse.FOPEN_KEEP_CACHE, 0
+	inode := n.NewInode(ctx, child, id)
+	if existing, ok := inode.Operations().(*node); ok {
+		// The file was already known.
+		child = existing
+	}
+	// Without O_EXCL, an existing file may have been opened, whose content
+	// must be preserved and whose cached pages may be stale.
+	fresh := flags&syscall.O_EXCL != 0
+	fh := child.newFileHandle(f, flags)
+	if errno := child.stageWrites(ctx, "Create", fh, flags, fi, fresh); errno != 0 {
+		_ = f.Close()
+		return nil, nil, 0, errno
+	}
+	return inode, fh, child.openFlags(ctx, flags, fi, fresh), 0
 }
 
 // Mkdir creates a new directory.
 func (n *node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ctx = n.startRequest(ctx, "Mkdir")
+	if n.cfg.readOnly {
+		return nil, syscall.EROFS
+	}
+	name = n.cfg.newName(name)
 	childPath := path.Join(n.path, name)
+	if errno := n.cfg.checkLen(childPath); errno != 0 {
+		return nil, errno
+	}
+	if n.cfg.hidden(childPath) {
+		return nil, n.cfg.hiddenErrno
+	}
+	if errno := n.checkVariant(ctx, "Mkdir", name); errno != 0 {
+		return nil, errno
+	}
 	err := contextual.Mkdir(ctx, n.fsys, childPath, toFileMode(mode))
 	if err != nil {
-		n.logger.Error("Mkdir failed", "path", childPath, "error", err)
-		return nil, toErrno(err)
+		return nil, n.fail(ctx, "Mkdir", "Mkdir failed", err, "path", childPath)
 	}
 
 	fi, err := contextual.Lstat(ctx, n.fsys, childPath)
 	if err != nil {
-		n.logger.Error("Mkdir: lstat failed", "path", childPath, "error", err)
-		return nil, toErrno(err)
+		return nil, n.fail(ctx, "Mkdir", "Mkdir: lstat failed", err, "path", childPath)
 	}
 
-	statToAttr(fi, &out.Attr)
+	n.fillAttr(ctx, fi, &out.Attr)
 
-	child := &node{
-		fsys:   n.fsys,
-		path:   childPath,
-		logger: n.logger,
-	}
+	child := n.newChild(childPath)
 
 	id := fs.StableAttr{
 		Mode: toFuseMode(fi.Mode()),
@@ -184,48 +321,88 @@ func (n *node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 	return n.NewInode(ctx, child, id), 0
 }
 
+// checkVariant fails with EEXIST if an entry equivalent to the new name
+// already exists in case-insensitive mode. op is the operation on whose behalf
+// failures are logged.
+func (n *node) checkVariant(ctx context.Context, op, name string) syscall.Errno {
+	variant, err := n.variantName(ctx, name)
+	if err != nil {
+		return n.fail(ctx, op, "Name resolution failed", err, "path", path.Join(n.path, name))
+	}
+	if variant != "" {
+		return syscall.EEXIST
+	}
+	return 0
+}
+
 // Unlink removes a file.
 func (n *node) Unlink(ctx context.Context, name string) syscall.Errno {
-	target := path.Join(n.path, name)
+	ctx = n.startRequest(ctx, "Unlink")
+	if n.cfg.readOnly {
+		return syscall.EROFS
+	}
+	target := path.Join(n.path, n.existingName(ctx, name))
+	if n.cfg.hidden(target) {
+		return syscall.ENOENT
+	}
 	err := contextual.Remove(ctx, n.fsys, target)
 	if err != nil {
-		n.logger.Error("Unlink failed", "path", target, "error", err)
+		return n.fail(ctx, "Unlink", "Unlink failed", err, "path", target)
 	}
-	return toErrno(err)
+	return 0
 }
 
 // Rmdir removes a directory.
 func (n *node) Rmdir(ctx context.Context, name string) syscall.Errno {
-	target := path.Join(n.path, name)
+	ctx = n.startRequest(ctx, "Rmdir")
+	if n.cfg.readOnly {
+		return syscall.EROFS
+	}
+	target := path.Join(n.path, n.existingName(ctx, name))
+	if n.cfg.hidden(target) {
+		return syscall.ENOENT
+	}
 	err := contextual.Remove(ctx, n.fsys, target)
 	if err != nil {
-		n.logger.Error("Rmdir failed", "path", target, "error", err)
+		return n.fail(ctx, "Rmdir", "Rmdir failed", err, "path", target)
 	}
-	return toErrno(err)
+	return 0
 }
 
 // Symlink creates a symbolic link.
+// The target is checked against the SymlinkPolicy.
 func (n *node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ctx = n.startRequest(ctx, "Symlink")
+	if n.cfg.readOnly {
+		return nil, syscall.EROFS
+	}
+	name = n.cfg.newName(name)
 	childPath := path.Join(n.path, name)
+	if errno := n.cfg.checkLen(childPath); errno != 0 {
+		return nil, errno
+	}
+	if n.cfg.hidden(childPath) {
+		return nil, n.cfg.hiddenErrno
+	}
+	if errno := n.cfg.newLinkTarget(childPath, target); errno != 0 {
+		return nil, errno
+	}
+	if errno := n.checkVariant(ctx, "Symlink", name); errno != 0 {
+		return nil, errno
+	}
 	err := contextual.Symlink(ctx, n.fsys, target, childPath)
 	if err != nil {
-		n.logger.Error("Symlink failed", "path", childPath, "target", target, "error", err)
-		return nil, toErrno(err)
+		return nil, n.fail(ctx, "Symlink", "Symlink failed", err, "path", childPath, "target", target)
 	}
 
 	fi, err := contextual.Lstat(ctx, n.fsys, childPath)
 	if err != nil {
-		n.logger.Error("Symlink: lstat failed", "path", childPath, "error", err)
-		return nil, toErrno(err)
+		return nil, n.fail(ctx, "Symlink", "Symlink: lstat failed", err, "path", childPath)
 	}
 
-	statToAttr(fi, &out.Attr)
+	n.fillAttr(ctx, fi, &out.Attr)
 
-	child := &node{
-		fsys:   n.fsys,
-		path:   childPath,
-		logger: n.logger,
-	}
+	child := n.newChild(childPath)
 
 	id := fs.StableAttr{
 		Mode: toFuseMode(fi.Mode()),
@@ -236,17 +413,30 @@ func (n *node) Symlink(ctx context.Context, target, name string, out *fuse.Entry
 }
 
 // Readlink reads the target of a symbolic link.
+// The target is presented according to the SymlinkPolicy.
 func (n *node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	ctx = n.startRequest(ctx, "Readlink")
+	if n.cfg.symlinkPolicy() == SymlinkFollow {
+		// Links are never presented as such.
+		return nil, syscall.EINVAL
+	}
 	link, err := contextual.ReadLink(ctx, n.fsys, n.path)
 	if err != nil {
-		n.logger.Error("Readlink failed", "path", n.path, "error", err)
-		return nil, toErrno(err)
+		return nil, n.fail(ctx, "Readlink", "Readlink failed", err, "path", n.path)
+	}
+	link, errno := n.cfg.linkTarget(n.path, link)
+	if errno != 0 {
+		return nil, errno
 	}
 	return []byte(link), 0
 }
 
 // Rename renames a file or directory.
 func (n *node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	ctx = n.startRequest(ctx, "Rename")
+	if n.cfg.readOnly {
+		return syscall.EROFS
+	}
 	// flags are from RENAME_EXCHANGE, RENAME_NOREPLACE (Linux 3.15+)
 	// fsx.Rename doesn't support flags yet.
 	if flags != 0 {
@@ -258,19 +448,48 @@ func (n *node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedd
 		return syscall.EXDEV
 	}
 
-	oldPath := path.Join(n.path, name)
+	oldPath := path.Join(n.path, n.existingName(ctx, name))
+	newName = n.cfg.newName(newName)
 	newPath := path.Join(targetNode.path, newName)
+	if errno := n.cfg.checkLen(newPath); errno != 0 {
+		return errno
+	}
+	if n.cfg.hidden(oldPath) {
+		return syscall.ENOENT
+	}
+	if n.cfg.hidden(newPath) {
+		return n.cfg.hiddenErrno
+	}
+
+	// An existing entry equivalent to newName is replaced, unless it is the
+	// entry being renamed, and then takes newName.
+	variant, err := targetNode.variantName(ctx, newName)
+	if err != nil {
+		return n.fail(ctx, "Rename", "Rename: name resolution failed", err, "newPath", newPath)
+	}
+	if variant != "" && path.Join(targetNode.path, variant) != oldPath {
+		variantPath := path.Join(targetNode.path, variant)
+		err := contextual.Rename(ctx, n.fsys, oldPath, variantPath)
+		if err != nil {
+			return n.fail(ctx, "Rename", "Rename failed", err, "oldPath", oldPath, "newPath", variantPath)
+		}
+		oldPath = variantPath
+	}
 
-	err := contextual.Rename(ctx, n.fsys, oldPath, newPath)
+	err = contextual.Rename(ctx, n.fsys, oldPath, newPath)
 	if err != nil {
-		n.logger.Error("Rename failed", "oldPath", oldPath, "newPath", newPath, "error", err)
+		return n.fail(ctx, "Rename", "Rename failed", err, "oldPath", oldPath, "newPath", newPath)
 	}
-	return toErrno(err)
+	return 0
 }
 
 // Setattr changes the attributes of the file (chmod, chown, utimes, truncate).
 // It supports updating mode, ownership, size, and timestamps.
 func (n *node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	ctx = n.startRequest(ctx, "Setattr")
+	if n.cfg.readOnly {
+		return syscall.EROFS
+	}
 	if errno := n.chmod(ctx, in); errno != 0 {
 		return errno
 	}
@@ -280,10 +499,10 @@ func (n *node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn,
 	if errno := n.chtimes(ctx, in); errno != 0 {
 		return errno
 	}
-	if errno := n.truncate(ctx, in); errno != 0 {
+	if errno := n.truncate(ctx, f, in); errno != 0 {
 		return errno
 	}
-	return n.Getattr(ctx, f, out)
+	return n.getattr(ctx, f, out)
 }
 
 func (n *node) chmod(ctx context.Context, in *fuse.SetAttrIn) syscall.Errno {
@@ -293,9 +512,9 @@ func (n *node) chmod(ctx context.Context, in *fuse.SetAttrIn) syscall.Errno {
 	}
 	err := contextual.Chmod(ctx, n.fsys, n.path, toFileMode(mode))
 	if err != nil {
-		n.logger.Error("Chmod failed", "path", n.path, "error", err)
+		return n.fail(ctx, "Setattr", "Chmod failed", err, "path", n.path)
 	}
-	return toErrno(err)
+	return 0
 }
 
 func (n *node) chown(ctx context.Context, in *fuse.SetAttrIn) syscall.Errno {
@@ -316,9 +535,9 @@ func (n *node) chown(ctx context.Context, in *fuse.SetAttrIn) syscall.Errno {
 	}
 	err := contextual.Lchown(ctx, n.fsys, n.path, uStr, gStr)
 	if err != nil {
-		n.logger.Error("Chown failed", "path", n.path, "error", err)
+		return n.fail(ctx, "Setattr", "Chown failed", err, "path", n.path)
 	}
-	return toErrno(err)
+	return 0
 }
 
 func (n *node) chtimes(ctx context.Context, in *fuse.SetAttrIn) syscall.Errno {
@@ -340,8 +559,7 @@ func (n *node) chtimes(ctx context.Context, in *fuse.SetAttrIn) syscall.Errno {
 	if !mtimeOk || !atimeOk {
 		fi, err := contextual.Lstat(ctx, n.fsys, n.path)
 		if err != nil {
-			n.logger.Error("Chtimes: lstat failed", "path", n.path, "error", err)
-			return toErrno(err)
+			return n.fail(ctx, "Setattr", "Chtimes: lstat failed", err, "path", n.path)
 		}
 		if !mtimeOk {
 			mt = fi.ModTime()
@@ -354,19 +572,29 @@ func (n *node) chtimes(ctx context.Context, in *fuse.SetAttrIn) syscall.Errno {
 
 	err := contextual.Chtimes(ctx, n.fsys, n.path, at, mt)
 	if err != nil {
-		n.logger.Error("Chtimes failed", "path", n.path, "error", err)
+		return n.fail(ctx, "Setattr", "Chtimes failed", err, "path", n.path)
 	}
-	return toErrno(err)
+	return 0
 }
 
-func (n *node) truncate(ctx context.Context, in *fuse.SetAttrIn) syscall.Errno {
+// truncate changes the size of the file, or of the staged content if f or
+// another handle stages writes.
+func (n *node) truncate(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn) syscall.Errno {
 	size, ok := in.GetSize()
 	if !ok {
 		return 0
 	}
+	fh, _ := f.(*fileHandle)
+	if fh == nil || fh.stage == nil {
+		fh = n.staged.Load()
+	}
+	if fh != nil {
+		return fh.truncateStaged(ctx, int64(size))
+	}
+	n.flushWriters(ctx)
 	err := contextual.Truncate(ctx, n.fsys, n.path, int64(size))
 	if err != nil {
-		n.logger.Error("Truncate failed", "path", n.path, "error", err)
+		return n.fail(ctx, "Setattr", "Truncate failed", err, "path", n.path)
 	}
-	return toErrno(err)
+	return 0
 }
@@ -1,15 +1,23 @@
 package fsfuse_test
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	iofs "io/fs"
+	"log/slog"
+	"maps"
 	"os"
+	"path"
+	"slices"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/gwangyi/fsfuse"
 	"github.com/gwangyi/fsfuse/internal/mock"
+	"github.com/gwangyi/fsx"
 	"github.com/gwangyi/fsx/contextual"
 	"github.com/gwangyi/fsx/mockfs"
 	cmockfs "github.com/gwangyi/fsx/mockfs/contextual"
@@ -32,11 +40,12 @@ type nodeOperations interface {
 	fs.NodeReadlinker
 	fs.NodeRenamer
 	fs.NodeSetattrer
+	fs.NodeStatfser
 }
 
-func MakeNode(t *testing.T, fsys contextual.FS, path string) nodeOperations {
+func MakeNode(t *testing.T, fsys contextual.FS, path string, opts ...fsfuse.Option) nodeOperations {
 	t.Helper()
-	root := fsfuse.New(fsys)
+	root := fsfuse.New(fsys, opts...)
 	_ = fs.NewNodeFS(root, &fs.Options{})
 	if path == "." || path == "" {
 		return root.(nodeOperations)
@@ -68,7 +77,7 @@ func TestNode_Basic(t *testing.T) {
 	mfi.EXPECT().Owner().Return("1000").AnyTimes()
 	mfi.EXPECT().Group().Return("1000").AnyTimes()
 
-	mfs.EXPECT().Lstat(ctx, "hello.txt").Return(mfi, nil).Times(2)
+	mfs.EXPECT().Lstat(gomock.Any(), "hello.txt").Return(mfi, nil).Times(2)
 
 	node := MakeNode(t, mfs, "hello.txt")
 
@@ -83,7 +92,8 @@ func TestNode_Basic(t *testing.T) {
 
 	// Test Open and Read
 	mf := mockfs.NewMockFile(ctrl)
-	mfs.EXPECT().OpenFile(ctx, "hello.txt", syscall.O_RDONLY, iofs.FileMode(0)).Return(mf, nil)
+	mfs.EXPECT().OpenFile(gomock.Any(), "hello.txt", syscall.O_RDONLY, iofs.FileMode(0)).Return(mf, nil)
+	mf.EXPECT().Stat().Return(mfi, nil)
 
 	handle, _, errno := node.Open(ctx, uint32(syscall.O_RDONLY))
 	if errno != 0 {
@@ -124,7 +134,7 @@ func TestNode_Readdir(t *testing.T) {
 	ent2.EXPECT().Name().Return("b").AnyTimes()
 	ent2.EXPECT().Type().Return(iofs.FileMode(0644)).AnyTimes()
 
-	mfs.EXPECT().ReadDir(ctx, ".").Return([]iofs.DirEntry{ent1, ent2}, nil)
+	mfs.EXPECT().ReadDir(gomock.Any(), ".").Return([]iofs.DirEntry{ent1, ent2}, nil)
 
 	node := MakeNode(t, mfs, ".")
 
@@ -157,7 +167,7 @@ func TestNode_Operations(t *testing.T) {
 		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(mfiRoot, nil)
 		node := MakeNode(t, mfs, "root")
 
-		mfs.EXPECT().Remove(ctx, "root/file").Return(nil)
+		mfs.EXPECT().Remove(gomock.Any(), "root/file").Return(nil)
 		errno := node.Unlink(ctx, "file")
 		if errno != 0 {
 			t.Errorf("Unlink failed: %v", errno)
@@ -173,7 +183,7 @@ func TestNode_Operations(t *testing.T) {
 		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(mfiRoot, nil)
 		node := MakeNode(t, mfs, "root")
 
-		mfs.EXPECT().Remove(ctx, "root/dir").Return(nil)
+		mfs.EXPECT().Remove(gomock.Any(), "root/dir").Return(nil)
 		errno := node.Rmdir(ctx, "dir")
 		if errno != 0 {
 			t.Errorf("Rmdir failed: %v", errno)
@@ -189,7 +199,7 @@ func TestNode_Operations(t *testing.T) {
 		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(mfiRoot, nil)
 		node := MakeNode(t, mfs, "root")
 
-		mfs.EXPECT().ReadLink(ctx, "root").Return("target", nil)
+		mfs.EXPECT().ReadLink(gomock.Any(), "root").Return("target", nil)
 		link, errno := node.Readlink(ctx)
 		if errno != 0 {
 			t.Errorf("Readlink failed: %v", errno)
@@ -209,7 +219,7 @@ func TestNode_Operations(t *testing.T) {
 		node := MakeNode(t, mfs, "root")
 
 		targetNode := MakeNode(t, mfs, "root")
-		mfs.EXPECT().Rename(ctx, "root/old", "root/new").Return(nil)
+		mfs.EXPECT().Rename(gomock.Any(), "root/old", "root/new").Return(nil)
 		errno := node.Rename(ctx, "old", targetNode, "new", 0)
 		if errno != 0 {
 			t.Errorf("Rename failed: %v", errno)
@@ -261,28 +271,28 @@ func TestNode_Operations(t *testing.T) {
 		in := &fuse.SetAttrIn{}
 		in.Valid |= fuse.FATTR_MODE
 		in.Mode = 0600
-		mfs.EXPECT().Chmod(ctx, "root", iofs.FileMode(0600)).Return(nil)
+		mfs.EXPECT().Chmod(gomock.Any(), "root", iofs.FileMode(0600)).Return(nil)
 
 		// Test Chown
 		in.Valid |= fuse.FATTR_UID | fuse.FATTR_GID
 		in.Uid = 1001
 		in.Gid = 1001
-		mfs.EXPECT().Lchown(ctx, "root", "1001", "1001").Return(nil)
+		mfs.EXPECT().Lchown(gomock.Any(), "root", "1001", "1001").Return(nil)
 
 		// Test Truncate
 		in.Valid |= fuse.FATTR_SIZE
 		in.Size = 123
-		mfs.EXPECT().Truncate(ctx, "root", int64(123)).Return(nil)
+		mfs.EXPECT().Truncate(gomock.Any(), "root", int64(123)).Return(nil)
 
 		// Test Chtimes (Mtime/Atime)
 		in.Valid |= fuse.FATTR_MTIME | fuse.FATTR_ATIME
 		in.Mtime = 1000
 		in.Atime = 2000
-		mfs.EXPECT().Chtimes(ctx, "root", gomock.Any(), gomock.Any()).Return(nil)
+		mfs.EXPECT().Chtimes(gomock.Any(), "root", gomock.Any(), gomock.Any()).Return(nil)
 
 		// Expect Getattr at the end
 		mfi := setupFileInfo(ctrl, "root", 123, 0600)
-		mfs.EXPECT().Lstat(ctx, "root").Return(mfi, nil)
+		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(mfi, nil)
 
 		var out fuse.AttrOut
 		if errno := node.Setattr(ctx, nil, in, &out); errno != 0 {
@@ -304,8 +314,8 @@ func TestNode_Operations(t *testing.T) {
 		in.Mtime = 1234
 
 		mfi := setupFileInfo(ctrl, "root", 0, 0644)
-		mfs.EXPECT().Lstat(ctx, "root").Return(mfi, nil).Times(2) // One for current times, one for Getattr result
-		mfs.EXPECT().Chtimes(ctx, "root", gomock.Any(), gomock.Any()).Return(nil)
+		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(mfi, nil).Times(2) // One for current times, one for Getattr result
+		mfs.EXPECT().Chtimes(gomock.Any(), "root", gomock.Any(), gomock.Any()).Return(nil)
 
 		var out fuse.AttrOut
 		if errno := node.Setattr(ctx, nil, in, &out); errno != 0 {
@@ -325,9 +335,9 @@ func TestNode_Operations(t *testing.T) {
 		in := &fuse.SetAttrIn{}
 		in.Valid = fuse.FATTR_UID
 		in.Uid = 1001
-		mfs.EXPECT().Lchown(ctx, "root", "1001", "").Return(nil)
+		mfs.EXPECT().Lchown(gomock.Any(), "root", "1001", "").Return(nil)
 		mfi := setupFileInfo(ctrl, "root", 0, 0644)
-		mfs.EXPECT().Lstat(ctx, "root").Return(mfi, nil)
+		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(mfi, nil)
 		var out fuse.AttrOut
 		if errno := node.Setattr(ctx, nil, in, &out); errno != 0 {
 			t.Errorf("Setattr failed: %v", errno)
@@ -347,7 +357,7 @@ func TestNode_Operations(t *testing.T) {
 		in := &fuse.SetAttrIn{}
 		in.Valid = fuse.FATTR_MODE
 		in.Mode = 0644
-		mfs.EXPECT().Chmod(ctx, "root", iofs.FileMode(0644)).Return(errors.New("fail"))
+		mfs.EXPECT().Chmod(gomock.Any(), "root", iofs.FileMode(0644)).Return(errors.New("fail"))
 
 		var out fuse.AttrOut
 		if errno := node.Setattr(ctx, nil, in, &out); errno != syscall.EIO {
@@ -358,7 +368,7 @@ func TestNode_Operations(t *testing.T) {
 		in = &fuse.SetAttrIn{}
 		in.Valid = fuse.FATTR_UID
 		in.Uid = 1000
-		mfs.EXPECT().Lchown(ctx, "root", "1000", "").Return(errors.New("fail"))
+		mfs.EXPECT().Lchown(gomock.Any(), "root", "1000", "").Return(errors.New("fail"))
 		if errno := node.Setattr(ctx, nil, in, &out); errno != syscall.EIO {
 			t.Errorf("expected EIO for Chown, got %v", errno)
 		}
@@ -367,7 +377,7 @@ func TestNode_Operations(t *testing.T) {
 		in = &fuse.SetAttrIn{}
 		in.Valid = fuse.FATTR_SIZE
 		in.Size = 123
-		mfs.EXPECT().Truncate(ctx, "root", int64(123)).Return(errors.New("fail"))
+		mfs.EXPECT().Truncate(gomock.Any(), "root", int64(123)).Return(errors.New("fail"))
 		if errno := node.Setattr(ctx, nil, in, &out); errno != syscall.EIO {
 			t.Errorf("expected EIO for Truncate, got %v", errno)
 		}
@@ -377,7 +387,7 @@ func TestNode_Operations(t *testing.T) {
 		in.Valid = fuse.FATTR_MTIME | fuse.FATTR_ATIME
 		in.Mtime = 100
 		in.Atime = 200
-		mfs.EXPECT().Chtimes(ctx, "root", gomock.Any(), gomock.Any()).Return(errors.New("fail"))
+		mfs.EXPECT().Chtimes(gomock.Any(), "root", gomock.Any(), gomock.Any()).Return(errors.New("fail"))
 		if errno := node.Setattr(ctx, nil, in, &out); errno != syscall.EIO {
 			t.Errorf("expected EIO for Chtimes, got %v", errno)
 		}
@@ -392,6 +402,7 @@ func TestNode_Operations(t *testing.T) {
 		mfiRoot := setupFileInfo(ctrl, "root", 0, iofs.ModeDir|0755)
 		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(mfiRoot, nil)
 		mfs.EXPECT().OpenFile(gomock.Any(), "root", gomock.Any(), gomock.Any()).Return(m, nil)
+		m.EXPECT().Stat().Return(mfiRoot, nil)
 		node := MakeNode(t, mfs, "root")
 		fh, _, err := node.Open(t.Context(), uint32(os.O_RDWR))
 		if err != syscall.Errno(0) {
@@ -420,7 +431,7 @@ func TestNode_Operations(t *testing.T) {
 		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(mfiRoot, nil)
 		node := MakeNode(t, mfs, "root")
 
-		mfs.EXPECT().Lstat(ctx, "root").Return(nil, iofs.ErrNotExist)
+		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(nil, iofs.ErrNotExist)
 		var out fuse.AttrOut
 		if errno := node.Getattr(ctx, nil, &out); errno != syscall.ENOENT {
 			t.Errorf("expected ENOENT, got %v", errno)
@@ -436,7 +447,7 @@ func TestNode_Operations(t *testing.T) {
 		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(mfiRoot, nil)
 		node := MakeNode(t, mfs, "root")
 
-		mfs.EXPECT().OpenFile(ctx, "root", gomock.Any(), gomock.Any()).Return(nil, errors.New("open error"))
+		mfs.EXPECT().OpenFile(gomock.Any(), "root", gomock.Any(), gomock.Any()).Return(nil, errors.New("open error"))
 		_, _, errno := node.Open(ctx, 0)
 		if errno != syscall.EIO {
 			t.Errorf("expected EIO, got %v", errno)
@@ -452,7 +463,7 @@ func TestNode_Operations(t *testing.T) {
 		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(mfiRoot, nil)
 		node := MakeNode(t, mfs, "root")
 
-		mfs.EXPECT().ReadDir(ctx, "root").Return(nil, iofs.ErrPermission)
+		mfs.EXPECT().ReadDir(gomock.Any(), "root").Return(nil, iofs.ErrPermission)
 		_, errno := node.Readdir(ctx)
 		if errno != syscall.EPERM {
 			t.Errorf("expected EPERM, got %v", errno)
@@ -468,7 +479,7 @@ func TestNode_Operations(t *testing.T) {
 		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(mfiRoot, nil)
 		node := MakeNode(t, mfs, "root")
 
-		mfs.EXPECT().ReadLink(ctx, "root").Return("", iofs.ErrInvalid)
+		mfs.EXPECT().ReadLink(gomock.Any(), "root").Return("", iofs.ErrInvalid)
 		_, errno := node.Readlink(ctx)
 		if errno != syscall.EINVAL {
 			t.Errorf("expected EINVAL, got %v", errno)
@@ -487,9 +498,9 @@ func TestNode_Operations(t *testing.T) {
 		in := &fuse.SetAttrIn{}
 		in.Valid = fuse.FATTR_GID
 		in.Gid = 1001
-		mfs.EXPECT().Lchown(ctx, "root", "", "1001").Return(nil)
+		mfs.EXPECT().Lchown(gomock.Any(), "root", "", "1001").Return(nil)
 		mfi := setupFileInfo(ctrl, "root", 0, 0644)
-		mfs.EXPECT().Lstat(ctx, "root").Return(mfi, nil)
+		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(mfi, nil)
 		var out fuse.AttrOut
 		if errno := node.Setattr(ctx, nil, in, &out); errno != 0 {
 			t.Errorf("Setattr failed: %v", errno)
@@ -510,8 +521,8 @@ func TestNode_Operations(t *testing.T) {
 		in.Atime = 1234
 
 		mfi := setupFileInfo(ctrl, "root", 0, 0644)
-		mfs.EXPECT().Lstat(ctx, "root").Return(mfi, nil).Times(2)
-		mfs.EXPECT().Chtimes(ctx, "root", gomock.Any(), gomock.Any()).Return(nil)
+		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(mfi, nil).Times(2)
+		mfs.EXPECT().Chtimes(gomock.Any(), "root", gomock.Any(), gomock.Any()).Return(nil)
 
 		var out fuse.AttrOut
 		if errno := node.Setattr(ctx, nil, in, &out); errno != 0 {
@@ -532,7 +543,7 @@ func TestNode_Operations(t *testing.T) {
 		in.Valid = fuse.FATTR_MTIME
 		in.Mtime = 1234
 
-		mfs.EXPECT().Lstat(ctx, "root").Return(nil, errors.New("lstat fail"))
+		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(nil, errors.New("lstat fail"))
 
 		var out fuse.AttrOut
 		if errno := node.Setattr(ctx, nil, in, &out); errno != syscall.EIO {
@@ -768,7 +779,7 @@ func TestNode_WithBridge(t *testing.T) {
 		rootNode := MakeNode(t, mfs, "root")
 
 		mf := mockfs.NewMockFile(ctrl)
-		mfs.EXPECT().OpenFile(ctx, "root/fail", gomock.Any(), gomock.Any()).Return(mf, nil)
+		mfs.EXPECT().OpenFile(gomock.Any(), "root/fail", gomock.Any(), gomock.Any()).Return(mf, nil)
 		mf.EXPECT().Stat().Return(nil, errors.New("stat fail"))
 		mf.EXPECT().Close().Return(nil)
 
@@ -779,3 +790,899 @@ func TestNode_WithBridge(t *testing.T) {
 		}
 	})
 }
+
+func TestNode_OpenCache(t *testing.T) {
+	setup := func(t *testing.T, opts ...fsfuse.Option) (*cmockfs.MockFileSystem, nodeOperations) {
+		ctrl := gomock.NewController(t)
+		mfs := cmockfs.NewMockFileSystem(ctrl)
+		mfi := setupFileInfo(ctrl, "file", 0, 0644)
+		mfs.EXPECT().Lstat(gomock.Any(), "dir/file").Return(mfi, nil)
+		return mfs, MakeNode(t, mfs, "dir/file", opts...)
+	}
+	open := func(t *testing.T, mfs *cmockfs.MockFileSystem, node nodeOperations, flags int, fi iofs.FileInfo) uint32 {
+		t.Helper()
+		mf := mockfs.NewMockFile(gomock.NewController(t))
+		mfs.EXPECT().OpenFile(gomock.Any(), "dir/file", flags, gomock.Any()).Return(mf, nil)
+		if fi != nil {
+			mf.EXPECT().Stat().Return(fi, nil)
+		} else {
+			mf.EXPECT().Stat().Return(nil, errors.New("stat fail"))
+		}
+		_, fuseFlags, errno := node.Open(t.Context(), uint32(flags))
+		if errno != 0 {
+			t.Fatalf("Open failed: %v", errno)
+		}
+		return fuseFlags
+	}
+
+	t.Run("KeepCacheIfUnchanged", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mfs, node := setup(t)
+		fi := setupFileInfo(ctrl, "file", 10, 0644)
+
+		if flags := open(t, mfs, node, os.O_RDONLY, fi); flags&fuse.FOPEN_KEEP_CACHE != 0 {
+			t.Errorf("first Open: unexpected FOPEN_KEEP_CACHE")
+		}
+		if flags := open(t, mfs, node, os.O_RDONLY, fi); flags&fuse.FOPEN_KEEP_CACHE == 0 {
+			t.Errorf("second Open: expected FOPEN_KEEP_CACHE, got %#x", flags)
+		}
+		changed := setupFileInfo(ctrl, "file", 20, 0644)
+		if flags := open(t, mfs, node, os.O_RDONLY, changed); flags&fuse.FOPEN_KEEP_CACHE != 0 {
+			t.Errorf("Open after change: unexpected FOPEN_KEEP_CACHE")
+		}
+	})
+
+	t.Run("Create", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mfs := cmockfs.NewMockFileSystem(ctrl)
+		mfs.EXPECT().Lstat(gomock.Any(), "dir").Return(setupFileInfo(ctrl, "dir", 0, iofs.ModeDir|0755), nil)
+		node := MakeNode(t, mfs, "dir")
+		create := func(flags int) uint32 {
+			t.Helper()
+			mf := mockfs.NewMockFile(ctrl)
+			mfs.EXPECT().OpenFile(gomock.Any(), "dir/file", flags|os.O_CREATE, gomock.Any()).Return(mf, nil)
+			// The file has changed on the backend since it was cached.
+			mf.EXPECT().Stat().Return(setupFileInfo(ctrl, "file", 10, 0644), nil)
+			_, _, fuseFlags, errno := node.Create(t.Context(), "file", uint32(flags), 0644, &fuse.EntryOut{})
+			if errno != 0 {
+				t.Fatalf("Create failed: %v", errno)
+			}
+			return fuseFlags
+		}
+
+		// Without O_EXCL, the file may have existed, with stale pages.
+		if flags := create(os.O_RDWR); flags&fuse.FOPEN_KEEP_CACHE != 0 {
+			t.Errorf("Create of a possibly existing file: unexpected FOPEN_KEEP_CACHE")
+		}
+		if flags := create(os.O_RDWR | os.O_EXCL); flags&fuse.FOPEN_KEEP_CACHE == 0 {
+			t.Errorf("Create with O_EXCL: expected FOPEN_KEEP_CACHE, got %#x", flags)
+		}
+	})
+
+	t.Run("StatError", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mfs, node := setup(t)
+		fi := setupFileInfo(ctrl, "file", 10, 0644)
+
+		open(t, mfs, node, os.O_RDONLY, fi)
+		if flags := open(t, mfs, node, os.O_RDONLY, nil); flags != 0 {
+			t.Errorf("Open without stat: expected no flags, got %#x", flags)
+		}
+	})
+
+	t.Run("O_DIRECT", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mfs, node := setup(t)
+		fi := setupFileInfo(ctrl, "file", 10, 0644)
+
+		open(t, mfs, node, os.O_RDONLY, fi)
+		if flags := open(t, mfs, node, os.O_RDONLY|syscall.O_DIRECT, fi); flags != fuse.FOPEN_DIRECT_IO {
+			t.Errorf("expected FOPEN_DIRECT_IO, got %#x", flags)
+		}
+	})
+
+	t.Run("O_APPEND", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mfs, node := setup(t)
+		fi := setupFileInfo(ctrl, "file", 10, 0644)
+
+		open(t, mfs, node, os.O_RDONLY, fi)
+		if flags := open(t, mfs, node, os.O_WRONLY|os.O_APPEND, fi); flags != fuse.FOPEN_DIRECT_IO {
+			t.Errorf("expected FOPEN_DIRECT_IO, got %#x", flags)
+		}
+	})
+
+	t.Run("DirectIOPattern", func(t *testing.T) {
+		for _, pattern := range []string{"fi*", "dir/*"} {
+			ctrl := gomock.NewController(t)
+			mfs, node := setup(t, fsfuse.DirectIO(pattern))
+			fi := setupFileInfo(ctrl, "file", 10, 0644)
+
+			if flags := open(t, mfs, node, os.O_RDONLY, fi); flags != fuse.FOPEN_DIRECT_IO {
+				t.Errorf("pattern %q: expected FOPEN_DIRECT_IO, got %#x", pattern, flags)
+			}
+		}
+	})
+
+	t.Run("CacheControl", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		var gotName string
+		var gotDef uint32
+		policy := func(ctx context.Context, name string, flags uint32, fi iofs.FileInfo, def uint32) uint32 {
+			gotName, gotDef = name, def
+			return fuse.FOPEN_KEEP_CACHE | fuse.FOPEN_NOFLUSH
+		}
+		mfs, node := setup(t, fsfuse.CacheControl(policy))
+		fi := setupFileInfo(ctrl, "file", 10, 0644)
+
+		if flags := open(t, mfs, node, os.O_RDONLY, fi); flags != fuse.FOPEN_KEEP_CACHE|fuse.FOPEN_NOFLUSH {
+			t.Errorf("expected flags from policy, got %#x", flags)
+		}
+		if gotName != "dir/file" || gotDef != 0 {
+			t.Errorf("policy called with (%q, %#x), want (%q, 0)", gotName, gotDef, "dir/file")
+		}
+	})
+}
+
+func TestNode_ErrorTranslation(t *testing.T) {
+	errQuota := errors.New("backend quota")
+	translate := func(err error) syscall.Errno {
+		if errors.Is(err, errQuota) {
+			return syscall.EDQUOT
+		}
+		return 0
+	}
+
+	ctrl := gomock.NewController(t)
+	ctx := t.Context()
+	mfs := cmockfs.NewMockFileSystem(ctrl)
+	mfiRoot := setupFileInfo(ctrl, "root", 0, iofs.ModeDir|0755)
+	mfs.EXPECT().Lstat(gomock.Any(), "root").Return(mfiRoot, nil)
+	node := MakeNode(t, mfs, "root", fsfuse.TranslateErrors(translate))
+
+	mfs.EXPECT().Remove(gomock.Any(), "root/dir").Return(&iofs.PathError{Op: "remove", Path: "root/dir", Err: fsx.ErrNotEmpty})
+	if errno := node.Rmdir(ctx, "dir"); errno != syscall.ENOTEMPTY {
+		t.Errorf("Rmdir: expected ENOTEMPTY, got %v", errno)
+	}
+
+	mfs.EXPECT().Mkdir(gomock.Any(), "root/dir", gomock.Any()).Return(errQuota)
+	if _, errno := node.Mkdir(ctx, "dir", 0755, &fuse.EntryOut{}); errno != syscall.EDQUOT {
+		t.Errorf("Mkdir: expected EDQUOT, got %v", errno)
+	}
+}
+
+func TestNode_Hide(t *testing.T) {
+	setup := func(t *testing.T, opts ...fsfuse.Option) (*cmockfs.MockFileSystem, nodeOperations) {
+		ctrl := gomock.NewController(t)
+		mfs := cmockfs.NewMockFileSystem(ctrl)
+		mfiRoot := setupFileInfo(ctrl, "root", 0, iofs.ModeDir|0755)
+		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(mfiRoot, nil)
+		opts = append([]fsfuse.Option{
+			fsfuse.Hide(".git", "root/*.lock"),
+			fsfuse.HideFunc(func(name string) bool { return path.Base(name) == "secret" }),
+		}, opts...)
+		return mfs, MakeNode(t, mfs, "root", opts...)
+	}
+
+	t.Run("Readdir", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		ctx := t.Context()
+		mfs, node := setup(t)
+
+		var entries []iofs.DirEntry
+		for _, name := range []string{".git", "a", "b.lock", "secret", "c"} {
+			ent := mockfs.NewMockDirEntry(ctrl)
+			ent.EXPECT().Name().Return(name).AnyTimes()
+			ent.EXPECT().Type().Return(iofs.FileMode(0)).AnyTimes()
+			entries = append(entries, ent)
+		}
+		mfs.EXPECT().ReadDir(gomock.Any(), "root").Return(entries, nil)
+
+		stream, errno := node.Readdir(ctx)
+		if errno != 0 {
+			t.Fatalf("Readdir failed: %v", errno)
+		}
+		var names []string
+		for stream.HasNext() {
+			entry, _ := stream.Next()
+			names = append(names, entry.Name)
+		}
+		if strings.Join(names, ",") != "a,c" {
+			t.Errorf("expected [a c], got %v", names)
+		}
+	})
+
+	t.Run("Lookup", func(t *testing.T) {
+		ctx := t.Context()
+		_, node := setup(t)
+
+		for _, name := range []string{".git", "x.lock", "secret"} {
+			if _, errno := node.Lookup(ctx, name, &fuse.EntryOut{}); errno != syscall.ENOENT {
+				t.Errorf("Lookup(%q): expected ENOENT, got %v", name, errno)
+			}
+		}
+	})
+
+	t.Run("Create", func(t *testing.T) {
+		ctx := t.Context()
+		_, node := setup(t)
+
+		if _, _, _, errno := node.Create(ctx, ".git", 0, 0644, &fuse.EntryOut{}); errno != syscall.EPERM {
+			t.Errorf("Create: expected EPERM, got %v", errno)
+		}
+		if _, errno := node.Mkdir(ctx, ".git", 0755, &fuse.EntryOut{}); errno != syscall.EPERM {
+			t.Errorf("Mkdir: expected EPERM, got %v", errno)
+		}
+		if _, errno := node.Symlink(ctx, "target", "secret", &fuse.EntryOut{}); errno != syscall.EPERM {
+			t.Errorf("Symlink: expected EPERM, got %v", errno)
+		}
+	})
+
+	t.Run("HiddenErrno", func(t *testing.T) {
+		ctx := t.Context()
+		_, node := setup(t, fsfuse.HiddenErrno(syscall.EACCES))
+
+		if _, errno := node.Mkdir(ctx, ".git", 0755, &fuse.EntryOut{}); errno != syscall.EACCES {
+			t.Errorf("Mkdir: expected EACCES, got %v", errno)
+		}
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		ctx := t.Context()
+		_, node := setup(t)
+
+		if errno := node.Unlink(ctx, "x.lock"); errno != syscall.ENOENT {
+			t.Errorf("Unlink: expected ENOENT, got %v", errno)
+		}
+		if errno := node.Rmdir(ctx, ".git"); errno != syscall.ENOENT {
+			t.Errorf("Rmdir: expected ENOENT, got %v", errno)
+		}
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		ctx := t.Context()
+		mfs, node := setup(t)
+		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(setupFileInfo(gomock.NewController(t), "root", 0, iofs.ModeDir|0755), nil)
+		target := MakeNode(t, mfs, "root")
+
+		if errno := node.Rename(ctx, "secret", target, "public", 0); errno != syscall.ENOENT {
+			t.Errorf("Rename from hidden: expected ENOENT, got %v", errno)
+		}
+		if errno := node.Rename(ctx, "public", target, "secret", 0); errno != syscall.EPERM {
+			t.Errorf("Rename to hidden: expected EPERM, got %v", errno)
+		}
+	})
+}
+
+func TestNode_CaseInsensitive(t *testing.T) {
+	dirEntries := func(ctrl *gomock.Controller, names ...string) []iofs.DirEntry {
+		var entries []iofs.DirEntry
+		for _, name := range names {
+			ent := mockfs.NewMockDirEntry(ctrl)
+			ent.EXPECT().Name().Return(name).AnyTimes()
+			ent.EXPECT().Type().Return(iofs.FileMode(0)).AnyTimes()
+			entries = append(entries, ent)
+		}
+		return entries
+	}
+	setup := func(t *testing.T, opts ...fsfuse.Option) (*gomock.Controller, *cmockfs.MockFileSystem, nodeOperations) {
+		ctrl := gomock.NewController(t)
+		mfs := cmockfs.NewMockFileSystem(ctrl)
+		mfiRoot := setupFileInfo(ctrl, "root", 0, iofs.ModeDir|0755)
+		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(mfiRoot, nil)
+		// CollisionFirst reads the directory on every lookup.
+		mfs.EXPECT().ReadDir(gomock.Any(), ".").Return(dirEntries(ctrl, "root"), nil).AnyTimes()
+		return ctrl, mfs, MakeNode(t, mfs, "root", opts...)
+	}
+	notExist := &iofs.PathError{Op: "lstat", Err: iofs.ErrNotExist}
+
+	t.Run("Lookup", func(t *testing.T) {
+		ctx := t.Context()
+		ctrl, mfs, node := setup(t, fsfuse.CaseInsensitive(true, fsfuse.CollisionExact))
+
+		mfs.EXPECT().Lstat(gomock.Any(), "root/FOO").Return(nil, notExist)
+		mfs.EXPECT().ReadDir(gomock.Any(), "root").Return(dirEntries(ctrl, "bar", "foo"), nil)
+		mfs.EXPECT().Lstat(gomock.Any(), "root/foo").Return(setupFileInfo(ctrl, "foo", 3, 0644), nil).Times(2)
+
+		child, errno := node.Lookup(ctx, "FOO", &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatalf("Lookup failed: %v", errno)
+		}
+		// The child refers to the backend name.
+		if errno := child.Operations().(nodeOperations).Getattr(ctx, nil, &fuse.AttrOut{}); errno != 0 {
+			t.Errorf("Getattr failed: %v", errno)
+		}
+
+		mfs.EXPECT().Lstat(gomock.Any(), "root/baz").Return(nil, notExist)
+		mfs.EXPECT().ReadDir(gomock.Any(), "root").Return(dirEntries(ctrl, "bar", "foo"), nil)
+		if _, errno := node.Lookup(ctx, "baz", &fuse.EntryOut{}); errno != syscall.ENOENT {
+			t.Errorf("Lookup(baz): expected ENOENT, got %v", errno)
+		}
+	})
+
+	t.Run("CollisionExact", func(t *testing.T) {
+		ctx := t.Context()
+		ctrl, mfs, node := setup(t, fsfuse.CaseInsensitive(true, fsfuse.CollisionExact))
+
+		mfs.EXPECT().Lstat(gomock.Any(), "root/fOO").Return(nil, notExist)
+		mfs.EXPECT().ReadDir(gomock.Any(), "root").Return(dirEntries(ctrl, "foo", "FOO"), nil)
+		mfs.EXPECT().Lstat(gomock.Any(), "root/FOO").Return(setupFileInfo(ctrl, "FOO", 3, 0644), nil)
+		if _, errno := node.Lookup(ctx, "fOO", &fuse.EntryOut{}); errno != 0 {
+			t.Errorf("Lookup failed: %v", errno)
+		}
+
+		mfs.EXPECT().ReadDir(gomock.Any(), "root").Return(dirEntries(ctrl, "foo", "FOO"), nil)
+		stream, _ := node.Readdir(ctx)
+		var names []string
+		for stream.HasNext() {
+			entry, _ := stream.Next()
+			names = append(names, entry.Name)
+		}
+		if strings.Join(names, ",") != "foo,FOO" {
+			t.Errorf("expected [foo FOO], got %v", names)
+		}
+	})
+
+	t.Run("CollisionFirst", func(t *testing.T) {
+		ctx := t.Context()
+		ctrl, mfs, node := setup(t, fsfuse.CaseInsensitive(true, fsfuse.CollisionFirst))
+
+		mfs.EXPECT().ReadDir(gomock.Any(), "root").Return(dirEntries(ctrl, "foo", "Foo", "bar"), nil)
+		mfs.EXPECT().Lstat(gomock.Any(), "root/Foo").Return(setupFileInfo(ctrl, "Foo", 3, 0644), nil)
+		if _, errno := node.Lookup(ctx, "foo", &fuse.EntryOut{}); errno != 0 {
+			t.Errorf("Lookup failed: %v", errno)
+		}
+
+		mfs.EXPECT().ReadDir(gomock.Any(), "root").Return(dirEntries(ctrl, "foo", "Foo", "bar"), nil)
+		stream, _ := node.Readdir(ctx)
+		var names []string
+		for stream.HasNext() {
+			entry, _ := stream.Next()
+			names = append(names, entry.Name)
+		}
+		if strings.Join(names, ",") != "Foo,bar" {
+			t.Errorf("expected [Foo bar], got %v", names)
+		}
+	})
+
+	t.Run("CollisionError", func(t *testing.T) {
+		ctx := t.Context()
+		ctrl, mfs, node := setup(t, fsfuse.CaseInsensitive(true, fsfuse.CollisionError))
+
+		mfs.EXPECT().Lstat(gomock.Any(), "root/fOO").Return(nil, notExist)
+		mfs.EXPECT().ReadDir(gomock.Any(), "root").Return(dirEntries(ctrl, "foo", "FOO"), nil)
+		if _, errno := node.Lookup(ctx, "fOO", &fuse.EntryOut{}); errno != syscall.EIO {
+			t.Errorf("expected EIO, got %v", errno)
+		}
+	})
+
+	t.Run("Create", func(t *testing.T) {
+		ctx := t.Context()
+		ctrl, mfs, node := setup(t, fsfuse.CaseInsensitive(true, fsfuse.CollisionExact))
+
+		mf := mockfs.NewMockFile(ctrl)
+		mfs.EXPECT().Lstat(gomock.Any(), "root/FOO").Return(nil, notExist).Times(2)
+		mfs.EXPECT().ReadDir(gomock.Any(), "root").Return(dirEntries(ctrl, "foo"), nil)
+		mfs.EXPECT().OpenFile(gomock.Any(), "root/foo", gomock.Any(), gomock.Any()).Return(mf, nil)
+		mf.EXPECT().Stat().Return(setupFileInfo(ctrl, "foo", 0, 0644), nil)
+		if _, _, _, errno := node.Create(ctx, "FOO", uint32(os.O_RDWR), 0644, &fuse.EntryOut{}); errno != 0 {
+			t.Errorf("Create failed: %v", errno)
+		}
+
+		mfs.EXPECT().ReadDir(gomock.Any(), "root").Return(dirEntries(ctrl, "foo"), nil)
+		if _, _, _, errno := node.Create(ctx, "FOO", uint32(os.O_RDWR|os.O_EXCL), 0644, &fuse.EntryOut{}); errno != syscall.EEXIST {
+			t.Errorf("Create with O_EXCL: expected EEXIST, got %v", errno)
+		}
+
+		mfs.EXPECT().Lstat(gomock.Any(), "root/Foo").Return(nil, notExist)
+		mfs.EXPECT().ReadDir(gomock.Any(), "root").Return(dirEntries(ctrl, "foo"), nil)
+		if _, errno := node.Mkdir(ctx, "Foo", 0755, &fuse.EntryOut{}); errno != syscall.EEXIST {
+			t.Errorf("Mkdir: expected EEXIST, got %v", errno)
+		}
+	})
+
+	t.Run("NotPreserving", func(t *testing.T) {
+		ctx := t.Context()
+		ctrl, mfs, node := setup(t, fsfuse.CaseInsensitive(false, fsfuse.CollisionExact))
+
+		mfs.EXPECT().ReadDir(gomock.Any(), "root").Return(dirEntries(ctrl, "foo"), nil)
+		gomock.InOrder(
+			mfs.EXPECT().Lstat(gomock.Any(), "root/newdir").Return(nil, notExist),
+			mfs.EXPECT().Mkdir(gomock.Any(), "root/newdir", iofs.FileMode(0755)).Return(nil),
+			mfs.EXPECT().Lstat(gomock.Any(), "root/newdir").Return(setupFileInfo(ctrl, "newdir", 0, iofs.ModeDir|0755), nil),
+		)
+		if _, errno := node.Mkdir(ctx, "NewDir", 0755, &fuse.EntryOut{}); errno != 0 {
+			t.Errorf("Mkdir failed: %v", errno)
+		}
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		ctx := t.Context()
+		ctrl, mfs, node := setup(t, fsfuse.CaseInsensitive(true, fsfuse.CollisionExact))
+
+		// Replacing an entry differing only in case keeps the new case. The
+		// source exists as named, so only the target is looked for in the
+		// listing.
+		mfs.EXPECT().Lstat(gomock.Any(), "root/a").Return(setupFileInfo(ctrl, "a", 0, 0644), nil)
+		mfs.EXPECT().Lstat(gomock.Any(), "root/FOO").Return(nil, notExist)
+		mfs.EXPECT().ReadDir(gomock.Any(), "root").Return(dirEntries(ctrl, "a", "foo"), nil)
+		gomock.InOrder(
+			mfs.EXPECT().Rename(gomock.Any(), "root/a", "root/foo").Return(nil),
+			mfs.EXPECT().Rename(gomock.Any(), "root/foo", "root/FOO").Return(nil),
+		)
+		if errno := node.Rename(ctx, "a", node, "FOO", 0); errno != 0 {
+			t.Errorf("Rename failed: %v", errno)
+		}
+
+		// Changing only the case of an entry.
+		mfs.EXPECT().Lstat(gomock.Any(), "root/FOO").Return(nil, notExist)
+		mfs.EXPECT().Lstat(gomock.Any(), "root/Foo").Return(nil, notExist)
+		mfs.EXPECT().ReadDir(gomock.Any(), "root").Return(dirEntries(ctrl, "foo"), nil).Times(2)
+		mfs.EXPECT().Rename(gomock.Any(), "root/foo", "root/Foo").Return(nil)
+		if errno := node.Rename(ctx, "FOO", node, "Foo", 0); errno != 0 {
+			t.Errorf("Rename failed: %v", errno)
+		}
+	})
+
+	t.Run("Unlink", func(t *testing.T) {
+		ctx := t.Context()
+		ctrl, mfs, node := setup(t, fsfuse.CaseInsensitive(true, fsfuse.CollisionExact))
+
+		mfs.EXPECT().Lstat(gomock.Any(), "root/FOO").Return(nil, notExist)
+		mfs.EXPECT().ReadDir(gomock.Any(), "root").Return(dirEntries(ctrl, "foo"), nil)
+		mfs.EXPECT().Remove(gomock.Any(), "root/foo").Return(nil)
+		if errno := node.Unlink(ctx, "FOO"); errno != 0 {
+			t.Errorf("Unlink failed: %v", errno)
+		}
+
+		// An exact match is removed without reading the directory.
+		mfs.EXPECT().Lstat(gomock.Any(), "root/bar").Return(setupFileInfo(ctrl, "bar", 0, 0644), nil)
+		mfs.EXPECT().Remove(gomock.Any(), "root/bar").Return(nil)
+		if errno := node.Unlink(ctx, "bar"); errno != 0 {
+			t.Errorf("Unlink(bar) failed: %v", errno)
+		}
+	})
+}
+
+func TestNode_NormalizeNames(t *testing.T) {
+	const nfc, nfd = "caf\u00e9", "cafe\u0301"
+	notExist := &iofs.PathError{Op: "lstat", Err: iofs.ErrNotExist}
+	setup := func(t *testing.T) (*gomock.Controller, *cmockfs.MockFileSystem, nodeOperations) {
+		ctrl := gomock.NewController(t)
+		mfs := cmockfs.NewMockFileSystem(ctrl)
+		mfiRoot := setupFileInfo(ctrl, "root", 0, iofs.ModeDir|0755)
+		mfs.EXPECT().Lstat(gomock.Any(), "root").Return(mfiRoot, nil)
+		return ctrl, mfs, MakeNode(t, mfs, "root", fsfuse.NormalizeNames(fsfuse.NFC))
+	}
+
+	t.Run("Readdir", func(t *testing.T) {
+		ctx := t.Context()
+		ctrl, mfs, node := setup(t)
+
+		var entries []iofs.DirEntry
+		for _, name := range []string{nfd, "x" + nfd, "x" + nfc} {
+			ent := mockfs.NewMockDirEntry(ctrl)
+			ent.EXPECT().Name().Return(name).AnyTimes()
+			ent.EXPECT().Type().Return(iofs.FileMode(0)).AnyTimes()
+			entries = append(entries, ent)
+		}
+		mfs.EXPECT().ReadDir(gomock.Any(), "root").Return(entries, nil)
+
+		stream, errno := node.Readdir(ctx)
+		if errno != 0 {
+			t.Fatalf("Readdir failed: %v", errno)
+		}
+		var names []string
+		for stream.HasNext() {
+			entry, _ := stream.Next()
+			names = append(names, entry.Name)
+		}
+		if want := []string{nfc, "x" + nfc}; !slices.Equal(names, want) {
+			t.Errorf("expected %q, got %q", want, names)
+		}
+	})
+
+	t.Run("Lookup", func(t *testing.T) {
+		ctx := t.Context()
+		ctrl, mfs, node := setup(t)
+
+		mfs.EXPECT().Lstat(gomock.Any(), "root/"+nfc).Return(nil, notExist)
+		mfs.EXPECT().Lstat(gomock.Any(), "root/"+nfd).Return(setupFileInfo(ctrl, nfd, 0, 0644), nil)
+		if _, errno := node.Lookup(ctx, nfc, &fuse.EntryOut{}); errno != 0 {
+			t.Errorf("Lookup failed: %v", errno)
+		}
+
+		mfs.EXPECT().Lstat(gomock.Any(), "root/"+nfc).Return(nil, notExist)
+		mfs.EXPECT().Lstat(gomock.Any(), "root/"+nfd).Return(nil, notExist)
+		if _, errno := node.Lookup(ctx, nfc, &fuse.EntryOut{}); errno != syscall.ENOENT {
+			t.Errorf("expected ENOENT, got %v", errno)
+		}
+	})
+
+	t.Run("Mkdir", func(t *testing.T) {
+		ctx := t.Context()
+		ctrl, mfs, node := setup(t)
+
+		mfs.EXPECT().Lstat(gomock.Any(), "root/"+nfc).Return(nil, notExist)
+		mfs.EXPECT().Lstat(gomock.Any(), "root/"+nfd).Return(nil, notExist)
+		mfs.EXPECT().Mkdir(gomock.Any(), "root/"+nfc, gomock.Any()).Return(nil)
+		mfs.EXPECT().Lstat(gomock.Any(), "root/"+nfc).Return(setupFileInfo(ctrl, nfc, 0, iofs.ModeDir|0755), nil)
+		if _, errno := node.Mkdir(ctx, nfd, 0755, &fuse.EntryOut{}); errno != 0 {
+			t.Errorf("Mkdir failed: %v", errno)
+		}
+	})
+
+	t.Run("Create", func(t *testing.T) {
+		ctx := t.Context()
+		ctrl, mfs, node := setup(t)
+
+		mf := mockfs.NewMockFile(ctrl)
+		mfs.EXPECT().Lstat(gomock.Any(), "root/"+nfc).Return(nil, notExist)
+		mfs.EXPECT().Lstat(gomock.Any(), "root/"+nfd).Return(setupFileInfo(ctrl, nfd, 0, 0644), nil)
+		mfs.EXPECT().OpenFile(gomock.Any(), "root/"+nfd, gomock.Any(), gomock.Any()).Return(mf, nil)
+		mf.EXPECT().Stat().Return(setupFileInfo(ctrl, nfd, 0, 0644), nil)
+		if _, _, _, errno := node.Create(ctx, nfc, uint32(os.O_RDWR), 0644, &fuse.EntryOut{}); errno != 0 {
+			t.Errorf("Create failed: %v", errno)
+		}
+	})
+}
+
+func TestNode_Subtree(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ctx := t.Context()
+	mfs := cmockfs.NewMockFileSystem(ctrl)
+	root := MakeNode(t, mfs, ".", fsfuse.Subtree("projects/foo"))
+
+	mfs.EXPECT().Lstat(gomock.Any(), "projects/foo").Return(setupFileInfo(ctrl, "foo", 0, iofs.ModeDir|0755), nil)
+	if errno := root.Getattr(ctx, nil, &fuse.AttrOut{}); errno != 0 {
+		t.Errorf("Getattr failed: %v", errno)
+	}
+
+	mfs.EXPECT().Lstat(gomock.Any(), "projects/foo/dir").Return(setupFileInfo(ctrl, "dir", 0, iofs.ModeDir|0755), nil)
+	dirInode, errno := root.Lookup(ctx, "dir", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup failed: %v", errno)
+	}
+	dir := dirInode.Operations().(nodeOperations)
+
+	for _, target := range []string{"/etc/passwd", "../../bar", "../../../foo/x"} {
+		if _, errno := dir.Symlink(ctx, target, "link", &fuse.EntryOut{}); errno != syscall.EPERM {
+			t.Errorf("Symlink(%q): expected EPERM, got %v", target, errno)
+		}
+	}
+
+	mfs.EXPECT().Symlink(gomock.Any(), "../x", "projects/foo/dir/link").Return(nil)
+	mfs.EXPECT().Lstat(gomock.Any(), "projects/foo/dir/link").Return(setupFileInfo(ctrl, "link", 0, iofs.ModeSymlink|0777), nil)
+	linkInode, errno := dir.Symlink(ctx, "../x", "link", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Symlink failed: %v", errno)
+	}
+	link := linkInode.Operations().(nodeOperations)
+
+	mfs.EXPECT().ReadLink(gomock.Any(), "projects/foo/dir/link").Return("../../bar", nil)
+	if _, errno := link.Readlink(ctx); errno != syscall.EPERM {
+		t.Errorf("Readlink: expected EPERM, got %v", errno)
+	}
+	mfs.EXPECT().ReadLink(gomock.Any(), "projects/foo/dir/link").Return("../x", nil)
+	if target, errno := link.Readlink(ctx); errno != 0 || string(target) != "../x" {
+		t.Errorf("Readlink = (%q, %v), want (%q, 0)", target, errno, "../x")
+	}
+}
+
+func TestNode_SubtreePatterns(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ctx := t.Context()
+	mfs := cmockfs.NewMockFileSystem(ctrl)
+	// The patterns are relative to the mount, not to the backend.
+	root := MakeNode(t, mfs, ".", fsfuse.Subtree("projects/foo"),
+		fsfuse.Hide("secret", "dir/*.tmp"), fsfuse.DirectIO("dir/*.log"))
+
+	if _, errno := root.Lookup(ctx, "secret", &fuse.EntryOut{}); errno != syscall.ENOENT {
+		t.Errorf("Lookup(secret) = %v, want ENOENT", errno)
+	}
+	mfs.EXPECT().Lstat(gomock.Any(), "projects/foo/dir").Return(setupFileInfo(ctrl, "dir", 0, iofs.ModeDir|0755), nil)
+	dirInode, errno := root.Lookup(ctx, "dir", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup failed: %v", errno)
+	}
+	dir := dirInode.Operations().(nodeOperations)
+	if _, errno := dir.Lookup(ctx, "x.tmp", &fuse.EntryOut{}); errno != syscall.ENOENT {
+		t.Errorf("Lookup(dir/x.tmp) = %v, want ENOENT", errno)
+	}
+
+	for _, tt := range []struct {
+		name string
+		want uint32
+	}{
+		{"app.log", fuse.FOPEN_DIRECT_IO},
+		{"app.txt", 0},
+	} {
+		p := "projects/foo/dir/" + tt.name
+		fi := setupFileInfo(ctrl, tt.name, 0, 0644)
+		mfs.EXPECT().Lstat(gomock.Any(), p).Return(fi, nil)
+		inode, errno := dir.Lookup(ctx, tt.name, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatalf("Lookup(%q) failed: %v", tt.name, errno)
+		}
+		mf := mockfs.NewMockFile(ctrl)
+		mfs.EXPECT().OpenFile(gomock.Any(), p, gomock.Any(), gomock.Any()).Return(mf, nil)
+		mf.EXPECT().Stat().Return(fi, nil)
+		_, flags, errno := inode.Operations().(nodeOperations).Open(ctx, uint32(os.O_RDONLY))
+		if errno != 0 {
+			t.Fatalf("Open(%q) failed: %v", tt.name, errno)
+		}
+		if flags&fuse.FOPEN_DIRECT_IO != tt.want {
+			t.Errorf("Open(%q) flags = %#x, want direct I/O %#x", tt.name, flags, tt.want)
+		}
+	}
+}
+
+func TestNode_SymlinkFollow(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ctx := t.Context()
+	mfs := cmockfs.NewMockFileSystem(ctrl)
+	root := MakeNode(t, mfs, ".", fsfuse.Symlinks(fsfuse.SymlinkFollow))
+
+	// "link" -> "sub/file", where "sub" -> "dir"
+	mfs.EXPECT().Lstat(gomock.Any(), "link").Return(setupFileInfo(ctrl, "link", 0, iofs.ModeSymlink|0777), nil).Times(3)
+	mfs.EXPECT().ReadLink(gomock.Any(), "link").Return("sub/file", nil).Times(2)
+	mfs.EXPECT().Lstat(gomock.Any(), "sub").Return(setupFileInfo(ctrl, "sub", 0, iofs.ModeSymlink|0777), nil).Times(2)
+	mfs.EXPECT().ReadLink(gomock.Any(), "sub").Return("dir", nil).Times(2)
+	mfs.EXPECT().Lstat(gomock.Any(), "dir").Return(setupFileInfo(ctrl, "dir", 0, iofs.ModeDir|0755), nil).Times(2)
+	mfs.EXPECT().Lstat(gomock.Any(), "dir/file").Return(setupFileInfo(ctrl, "file", 42, 0644), nil).Times(2)
+
+	out := &fuse.EntryOut{}
+	inode, errno := root.Lookup(ctx, "link", out)
+	if errno != 0 {
+		t.Fatalf("Lookup failed: %v", errno)
+	}
+	if out.Size != 42 || out.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		t.Errorf("Lookup attributes = (size %d, mode %o), want the target's", out.Size, out.Mode)
+	}
+	if _, errno := inode.Operations().(nodeOperations).Readlink(ctx); errno != syscall.EINVAL {
+		t.Errorf("Readlink: expected EINVAL, got %v", errno)
+	}
+
+	// Links leaving the mount are not exposed.
+	mfs.EXPECT().Lstat(gomock.Any(), "escape").Return(setupFileInfo(ctrl, "escape", 0, iofs.ModeSymlink|0777), nil).Times(3)
+	mfs.EXPECT().ReadLink(gomock.Any(), "escape").Return("../outside", nil).Times(2)
+	if _, errno := root.Lookup(ctx, "escape", &fuse.EntryOut{}); errno != syscall.ENOENT {
+		t.Errorf("Lookup(escape): expected ENOENT, got %v", errno)
+	}
+
+	// Loops are reported.
+	mfs.EXPECT().Lstat(gomock.Any(), "loop").Return(setupFileInfo(ctrl, "loop", 0, iofs.ModeSymlink|0777), nil).AnyTimes()
+	mfs.EXPECT().ReadLink(gomock.Any(), "loop").Return("loop", nil).AnyTimes()
+	if _, errno := root.Lookup(ctx, "loop", &fuse.EntryOut{}); errno != syscall.ELOOP {
+		t.Errorf("Lookup(loop): expected ELOOP, got %v", errno)
+	}
+
+	var entries []iofs.DirEntry
+	for name, typ := range map[string]iofs.FileMode{"link": iofs.ModeSymlink, "escape": iofs.ModeSymlink, "loop": iofs.ModeSymlink, "dir": iofs.ModeDir} {
+		ent := mockfs.NewMockDirEntry(ctrl)
+		ent.EXPECT().Name().Return(name).AnyTimes()
+		ent.EXPECT().Type().Return(typ).AnyTimes()
+		entries = append(entries, ent)
+	}
+	mfs.EXPECT().ReadDir(gomock.Any(), ".").Return(entries, nil)
+	stream, errno := root.Readdir(ctx)
+	if errno != 0 {
+		t.Fatalf("Readdir failed: %v", errno)
+	}
+	got := map[string]uint32{}
+	for stream.HasNext() {
+		e, _ := stream.Next()
+		got[e.Name] = e.Mode
+	}
+	want := map[string]uint32{"link": 0, "dir": uint32(iofs.ModeDir)}
+	if !maps.Equal(got, want) {
+		t.Errorf("Readdir = %v, want %v", got, want)
+	}
+
+	// New links may not leave the mount.
+	if _, errno := root.Symlink(ctx, "/etc/passwd", "new", &fuse.EntryOut{}); errno != syscall.EPERM {
+		t.Errorf("Symlink: expected EPERM, got %v", errno)
+	}
+}
+
+func TestNode_LengthLimits(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ctx := t.Context()
+	mfs := cmockfs.NewMockFileSystem(ctrl)
+	root := MakeNode(t, mfs, ".", fsfuse.MaxNameLen(8), fsfuse.MaxPathLen(16))
+
+	mfs.EXPECT().Lstat(gomock.Any(), "dir").Return(setupFileInfo(ctrl, "dir", 0, iofs.ModeDir|0755), nil)
+	dirInode, errno := root.Lookup(ctx, "dir", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup failed: %v", errno)
+	}
+	dir := dirInode.Operations().(nodeOperations)
+
+	longName := "123456789" // 9 bytes, over MaxNameLen
+	deep := "12345678"      // "dir/12345678" fits both limits
+
+	if _, errno := dir.Lookup(ctx, longName, &fuse.EntryOut{}); errno != syscall.ENAMETOOLONG {
+		t.Errorf("Lookup: expected ENAMETOOLONG, got %v", errno)
+	}
+	if _, _, _, errno := dir.Create(ctx, longName, 0, 0644, &fuse.EntryOut{}); errno != syscall.ENAMETOOLONG {
+		t.Errorf("Create: expected ENAMETOOLONG, got %v", errno)
+	}
+	if _, errno := dir.Mkdir(ctx, longName, 0755, &fuse.EntryOut{}); errno != syscall.ENAMETOOLONG {
+		t.Errorf("Mkdir: expected ENAMETOOLONG, got %v", errno)
+	}
+	if _, errno := dir.Symlink(ctx, "target", longName, &fuse.EntryOut{}); errno != syscall.ENAMETOOLONG {
+		t.Errorf("Symlink: expected ENAMETOOLONG, got %v", errno)
+	}
+	if errno := root.Rename(ctx, "dir", dir, longName, 0); errno != syscall.ENAMETOOLONG {
+		t.Errorf("Rename: expected ENAMETOOLONG, got %v", errno)
+	}
+
+	mfs.EXPECT().Mkdir(gomock.Any(), "dir/"+deep, iofs.FileMode(0755)).Return(nil)
+	mfs.EXPECT().Lstat(gomock.Any(), "dir/"+deep).Return(setupFileInfo(ctrl, deep, 0, iofs.ModeDir|0755), nil)
+	deepInode, errno := dir.Mkdir(ctx, deep, 0755, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Mkdir failed: %v", errno)
+	}
+	// "dir/12345678/abcde" is 18 bytes, over MaxPathLen.
+	if _, errno := deepInode.Operations().(nodeOperations).Mkdir(ctx, "abcde", 0755, &fuse.EntryOut{}); errno != syscall.ENAMETOOLONG {
+		t.Errorf("Mkdir (deep): expected ENAMETOOLONG, got %v", errno)
+	}
+
+	out := &fuse.StatfsOut{}
+	if errno := root.Statfs(ctx, out); errno != 0 || out.NameLen != 8 {
+		t.Errorf("Statfs = (NameLen %d, %v), want (8, 0)", out.NameLen, errno)
+	}
+	out = &fuse.StatfsOut{}
+	if errno := MakeNode(t, mfs, ".").Statfs(ctx, out); errno != 0 || out.NameLen != 255 {
+		t.Errorf("Statfs (default) = (NameLen %d, %v), want (255, 0)", out.NameLen, errno)
+	}
+}
+
+func TestNode_Request(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mfs := cmockfs.NewMockFileSystem(ctrl)
+	var buf strings.Builder
+	root := MakeNode(t, mfs, ".", fsfuse.Logger(slog.New(slog.NewJSONHandler(&buf, nil))))
+	ctx := fuse.NewContext(t.Context(), &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 100}, Pid: 42})
+
+	var id uint64
+	mfs.EXPECT().Mkdir(gomock.Any(), "dir", iofs.FileMode(0755)).DoAndReturn(func(ctx context.Context, name string, perm iofs.FileMode) error {
+		r, ok := fsfuse.RequestFromContext(ctx)
+		if !ok {
+			t.Fatal("RequestFromContext: no request")
+		}
+		if r.Op != "Mkdir" || r.Caller == nil || r.Caller.Pid != 42 {
+			t.Errorf("Request = %+v, want Mkdir by pid 42", r)
+		}
+		id = r.ID
+		return syscall.EACCES
+	})
+	if _, errno := root.Mkdir(ctx, "dir", 0755, &fuse.EntryOut{}); errno != syscall.EACCES {
+		t.Fatalf("Mkdir: expected EACCES, got %v", errno)
+	}
+
+	var record struct {
+		Request struct {
+			ID  uint64
+			Op  string
+			Pid uint32
+			Uid uint32
+		}
+	}
+	if err := json.Unmarshal([]byte(buf.String()), &record); err != nil {
+		t.Fatalf("Unmarshal(%q) failed: %v", buf.String(), err)
+	}
+	if r := record.Request; r.ID != id || r.Op != "Mkdir" || r.Pid != 42 || r.Uid != 1000 {
+		t.Errorf("logged request = %+v, want ID %d of Mkdir by pid 42, uid 1000", r, id)
+	}
+}
+
+func TestNode_RequestSetattr(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mfs := cmockfs.NewMockFileSystem(ctrl)
+	mfs.EXPECT().Lstat(gomock.Any(), "root").Return(setupFileInfo(ctrl, "root", 0, 0644), nil)
+	node := MakeNode(t, mfs, "root")
+	ctx := t.Context()
+
+	var ids []uint64
+	record := func(ctx context.Context) {
+		r, ok := fsfuse.RequestFromContext(ctx)
+		if !ok {
+			t.Fatal("RequestFromContext: no request")
+		}
+		if r.Op != "Setattr" {
+			t.Errorf("Request.Op = %q, want Setattr", r.Op)
+		}
+		ids = append(ids, r.ID)
+	}
+	mfs.EXPECT().Chmod(gomock.Any(), "root", iofs.FileMode(0600)).DoAndReturn(func(ctx context.Context, name string, mode iofs.FileMode) error {
+		record(ctx)
+		return nil
+	})
+	mfs.EXPECT().Lstat(gomock.Any(), "root").DoAndReturn(func(ctx context.Context, name string) (iofs.FileInfo, error) {
+		record(ctx)
+		return setupFileInfo(ctrl, "root", 0, 0600), nil
+	})
+
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_MODE
+	in.Mode = 0600
+	if errno := node.Setattr(ctx, nil, in, &fuse.AttrOut{}); errno != 0 {
+		t.Fatalf("Setattr failed: %v", errno)
+	}
+	if len(ids) != 2 || ids[0] != ids[1] {
+		t.Errorf("request IDs = %v, want the same ID for Chmod and Lstat", ids)
+	}
+}
+
+func TestNode_ReadOnly(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ctx := t.Context()
+	mfs := cmockfs.NewMockFileSystem(ctrl)
+	root := MakeNode(t, mfs, ".", fsfuse.ReadOnly())
+
+	if _, _, _, errno := root.Create(ctx, "file", 0, 0644, &fuse.EntryOut{}); errno != syscall.EROFS {
+		t.Errorf("Create: expected EROFS, got %v", errno)
+	}
+	if _, errno := root.Mkdir(ctx, "dir", 0755, &fuse.EntryOut{}); errno != syscall.EROFS {
+		t.Errorf("Mkdir: expected EROFS, got %v", errno)
+	}
+	if errno := root.Unlink(ctx, "file"); errno != syscall.EROFS {
+		t.Errorf("Unlink: expected EROFS, got %v", errno)
+	}
+	if errno := root.Rmdir(ctx, "dir"); errno != syscall.EROFS {
+		t.Errorf("Rmdir: expected EROFS, got %v", errno)
+	}
+	if _, errno := root.Symlink(ctx, "target", "link", &fuse.EntryOut{}); errno != syscall.EROFS {
+		t.Errorf("Symlink: expected EROFS, got %v", errno)
+	}
+	if errno := root.Rename(ctx, "a", root, "b", 0); errno != syscall.EROFS {
+		t.Errorf("Rename: expected EROFS, got %v", errno)
+	}
+	if errno := root.Setattr(ctx, nil, &fuse.SetAttrIn{}, &fuse.AttrOut{}); errno != syscall.EROFS {
+		t.Errorf("Setattr: expected EROFS, got %v", errno)
+	}
+
+	mfs.EXPECT().Lstat(gomock.Any(), "file").Return(setupFileInfo(ctrl, "file", 0, 0644), nil)
+	fileInode, errno := root.Lookup(ctx, "file", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup failed: %v", errno)
+	}
+	file := fileInode.Operations().(nodeOperations)
+	if _, _, errno := file.Open(ctx, uint32(os.O_RDWR)); errno != syscall.EROFS {
+		t.Errorf("Open(O_RDWR): expected EROFS, got %v", errno)
+	}
+	m := mockfs.NewMockFile(ctrl)
+	m.EXPECT().Stat().Return(setupFileInfo(ctrl, "file", 0, 0644), nil)
+	mfs.EXPECT().OpenFile(gomock.Any(), "file", os.O_RDONLY, iofs.FileMode(0)).Return(m, nil)
+	if _, _, errno := file.Open(ctx, uint32(os.O_RDONLY)); errno != 0 {
+		t.Errorf("Open(O_RDONLY) failed: %v", errno)
+	}
+}
+
+func TestNode_Attributes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mfs := cmockfs.NewMockFileSystem(ctrl)
+	ctx := fuse.NewContext(t.Context(), &fuse.Caller{Owner: fuse.Owner{Uid: 4242, Gid: 4343}})
+	root := MakeNode(t, mfs, ".",
+		fsfuse.MapOwners(fsfuse.MirrorOwner(), func(context.Context, string) string { return "77" }),
+		fsfuse.PermissionMasks(0022, 0077))
+
+	mfs.EXPECT().Lstat(gomock.Any(), "file").Return(setupFileInfo(ctrl, "file", 0, 0666), nil)
+	out := &fuse.EntryOut{}
+	if _, errno := root.Lookup(ctx, "file", out); errno != 0 {
+		t.Fatalf("Lookup failed: %v", errno)
+	}
+	if out.Uid != 4242 || out.Gid != 77 || out.Mode&0777 != 0644 {
+		t.Errorf("file attributes = (uid %d, gid %d, mode %o), want (4242, 77, 644)", out.Uid, out.Gid, out.Mode&0777)
+	}
+
+	mfs.EXPECT().Lstat(gomock.Any(), "dir").Return(setupFileInfo(ctrl, "dir", 0, iofs.ModeDir|0777), nil)
+	out = &fuse.EntryOut{}
+	if _, errno := root.Lookup(ctx, "dir", out); errno != 0 {
+		t.Fatalf("Lookup failed: %v", errno)
+	}
+	if out.Mode&0777 != 0700 {
+		t.Errorf("dir mode = %o, want 700", out.Mode&0777)
+	}
+}
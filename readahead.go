@@ -0,0 +1,280 @@
+package fsfuse
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// readaheadChunk is the size of the backend reads issued by readahead.
+const readaheadChunk = 128 << 10
+
+// Readahead prefetches data of files which can be read at an offset while
+// they are read sequentially. Each handle detects sequential access on its
+// own and then reads ahead of the reader in chunks fetched in parallel, with
+// a window growing up to window bytes as long as the access stays
+// sequential. Random access stops prefetching until the reader is sequential
+// again.
+//
+// memory caps the data held by all handles together; once it is reached,
+// handles prefetch no further chunks until the memory is returned, as
+// readers move past their chunks or handles are released, and reads beyond
+// the prefetched data go to the backend. Zero means no cap beyond the
+// windows.
+// Prefetching stops and its data is dropped when a handle is released.
+//
+// Readahead pays off on backends with a high latency, where the reads of
+// the size requested by the kernel cannot make use of the bandwidth.
+func Readahead(window, memory int) Option {
+	return func(c *config) {
+		if window <= 0 {
+			c.readahead = nil
+			return
+		}
+		c.readahead = &readaheadConfig{
+			window: int64(max(window, readaheadChunk)),
+			budget: memBudget{limit: int64(max(memory, 0))},
+		}
+	}
+}
+
+// readaheadConfig is the configuration of Readahead shared by all handles.
+type readaheadConfig struct {
+	window int64
+	budget memBudget
+}
+
+// memBudget limits the memory held by readahead.
+type memBudget struct {
+	limit int64 // 0 means no limit
+	used  atomic.Int64
+}
+
+// acquire reserves n bytes if the budget allows it.
+func (b *memBudget) acquire(n int64) bool {
+	if b.limit == 0 {
+		return true
+	}
+	for {
+		used := b.used.Load()
+		if used+n > b.limit {
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+// release returns n bytes reserved by acquire.
+func (b *memBudget) release(n int64) {
+	if b.limit != 0 {
+		b.used.Add(-n)
+	}
+}
+
+// readahead prefetches data of a handle.
+type readahead struct {
+	cfg *readaheadConfig
+	ra  io.ReaderAt
+
+	mu sync.Mutex
+	// next is the offset following the last read.
+	next int64
+	// window is the current amount of data to read ahead; zero while the
+	// access is not sequential.
+	window int64
+	// chunks are the chunks fetched or being fetched by offset.
+	chunks map[int64]*chunk
+	// eof is the smallest offset known to be at or past the end of the
+	// file, or -1.
+	eof int64
+	// gen counts the invalidations, so that fetches started before the
+	// last one do not record the end of the file.
+	gen    uint64
+	closed bool
+
+	// ctx is cancelled by close, so that fetches which have not read yet
+	// do not read at all.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// chunk is a piece of prefetched data.
+type chunk struct {
+	off int64
+	// gen is the generation of the readahead when the fetch started.
+	gen  uint64
+	data []byte
+	err  error
+	// done is closed when data and err are set.
+	done chan struct{}
+	// refs counts the fetch in progress and the membership in chunks, the
+	// last of which returns the memory to the budget.
+	refs atomic.Int32
+}
+
+// newReadahead creates the readahead of a handle reading from ra.
+func newReadahead(cfg *readaheadConfig, ra io.ReaderAt) *readahead {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &readahead{cfg: cfg, ra: ra, chunks: make(map[int64]*chunk), eof: -1, ctx: ctx, cancel: cancel}
+}
+
+// read reads into dest at off, from prefetched data where possible, and
+// schedules prefetching if the access is sequential.
+// It returns errors.ErrUnsupported if the file cannot be read at an offset.
+func (r *readahead) read(ctx context.Context, dest []byte, off int64) (int, error) {
+	r.mu.Lock()
+	r.observe(off, int64(len(dest)))
+	r.mu.Unlock()
+
+	n, eof := 0, false
+	for n < len(dest) && !eof {
+		pos := off + int64(n)
+		r.mu.Lock()
+		c := r.chunks[pos-pos%readaheadChunk]
+		r.mu.Unlock()
+		if c == nil {
+			break
+		}
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		end := c.off + int64(len(c.data))
+		if pos < end {
+			n += copy(dest[n:], c.data[pos-c.off:])
+		}
+		if pos+int64(len(dest)-n) > end && len(c.data) < readaheadChunk {
+			if c.err != nil && c.err != io.EOF {
+				// Let the read below report the error.
+				break
+			}
+			eof = true
+		}
+	}
+	if n < len(dest) && !eof {
+		m, err := r.ra.ReadAt(dest[n:], off+int64(n))
+		n += m
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+	}
+
+	r.mu.Lock()
+	r.prefetch(off + int64(n))
+	r.mu.Unlock()
+	return n, nil
+}
+
+// observe adapts the window to a read of size bytes at off. Reads close to
+// the end of the previous one, as reordered by the kernel, are sequential.
+// r.mu must be held.
+func (r *readahead) observe(off, size int64) {
+	if off >= r.next-readaheadChunk && off <= r.next+readaheadChunk {
+		r.window = min(max(2*r.window, readaheadChunk), r.cfg.window)
+	} else {
+		r.window = 0
+	}
+	r.next = off + size
+
+	// Drop the chunks which are behind the reader or, on random access,
+	// all but the one being read.
+	for coff, c := range r.chunks {
+		if coff+readaheadChunk <= off-readaheadChunk || r.window == 0 && (coff > off || coff+readaheadChunk <= off) {
+			r.drop(c)
+		}
+	}
+}
+
+// prefetch starts fetching the chunks within the window from off.
+// r.mu must be held.
+func (r *readahead) prefetch(off int64) {
+	if r.closed || r.window == 0 {
+		return
+	}
+	for coff := off - off%readaheadChunk; coff < off+r.window; coff += readaheadChunk {
+		if r.eof >= 0 && coff >= r.eof {
+			return
+		}
+		if _, ok := r.chunks[coff]; ok {
+			continue
+		}
+		if !r.cfg.budget.acquire(readaheadChunk) {
+			return
+		}
+		c := &chunk{off: coff, gen: r.gen, done: make(chan struct{})}
+		c.refs.Store(2)
+		r.chunks[coff] = c
+		go r.fetch(c)
+	}
+}
+
+// fetch reads the data of c, unless the readahead has been closed.
+func (r *readahead) fetch(c *chunk) {
+	if err := r.ctx.Err(); err != nil {
+		c.err = err
+		close(c.done)
+		r.unref(c)
+		return
+	}
+	data := make([]byte, readaheadChunk)
+	n, err := r.ra.ReadAt(data, c.off)
+	c.data, c.err = data[:n], err
+	close(c.done)
+
+	if n < readaheadChunk && (err == nil || err == io.EOF) {
+		r.mu.Lock()
+		// The file may have grown since an invalidation.
+		if end := c.off + int64(n); c.gen == r.gen && (r.eof < 0 || end < r.eof) {
+			r.eof = end
+		}
+		r.mu.Unlock()
+	}
+	if errors.Is(err, errors.ErrUnsupported) {
+		r.mu.Lock()
+		r.closed = true
+		r.mu.Unlock()
+	}
+	r.unref(c)
+}
+
+// drop removes c from the chunks. r.mu must be held.
+func (r *readahead) drop(c *chunk) {
+	delete(r.chunks, c.off)
+	r.unref(c)
+}
+
+// unref releases a reference to c.
+func (r *readahead) unref(c *chunk) {
+	if c.refs.Add(-1) == 0 {
+		r.cfg.budget.release(readaheadChunk)
+	}
+}
+
+// invalidate drops all prefetched data, e.g. after a write.
+func (r *readahead) invalidate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.chunks {
+		r.drop(c)
+	}
+	r.eof = -1
+	r.gen++
+}
+
+// close stops prefetching and drops the prefetched data. It cancels the
+// fetches which have not read yet but does not wait for those reading, whose
+// data is dropped once read; the reads fail if the file is closed meanwhile.
+func (r *readahead) close() {
+	r.mu.Lock()
+	r.closed = true
+	for _, c := range r.chunks {
+		r.drop(c)
+	}
+	r.mu.Unlock()
+	r.cancel()
+}
@@ -0,0 +1,74 @@
+package fsfuse
+
+// ReplayBuffer keeps the last size bytes read from each handle of a file
+// which can neither be read at an offset nor seeked, such as a pipe or a
+// streaming download. Reads behind the current position of the stream, as
+// issued by the kernel when it reorders readahead or by tools which peek at
+// a header and rewind, are then served from memory as long as they are
+// within the last size bytes. Reads further back fail with ENOSYS.
+//
+// The buffer is allocated on the first read from a stream, so handles of
+// seekable files do not pay for it. Zero, the default, disables replaying.
+func ReplayBuffer(size int) Option {
+	return func(c *config) {
+		c.replaySize = max(size, 0)
+	}
+}
+
+// replayBuffer is a ring buffer holding the most recent bytes read from a
+// stream, ending at the current position of the stream.
+type replayBuffer struct {
+	buf []byte
+	// start is the index of the oldest byte in buf, and n is the number of
+	// bytes held.
+	start int
+	n     int
+}
+
+// newReplayBuffer creates a replay buffer holding up to size bytes.
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{buf: make([]byte, size)}
+}
+
+// Len returns the number of bytes that can be replayed.
+func (r *replayBuffer) Len() int {
+	return r.n
+}
+
+// Reset drops the bytes held.
+func (r *replayBuffer) Reset() {
+	r.start, r.n = 0, 0
+}
+
+// Write records p as read after the bytes held, discarding the oldest bytes
+// beyond the size of the buffer. It never fails, so that it can be used as
+// the destination of the data skipped by forward reads.
+func (r *replayBuffer) Write(p []byte) (int, error) {
+	size := len(r.buf)
+	written := len(p)
+	if written >= size {
+		copy(r.buf, p[written-size:])
+		r.start, r.n = 0, size
+		return written, nil
+	}
+
+	end := (r.start + r.n) % size
+	c := copy(r.buf[end:], p)
+	copy(r.buf, p[c:])
+	r.n += written
+	if r.n > size {
+		r.start = (r.start + r.n - size) % size
+		r.n = size
+	}
+	return written, nil
+}
+
+// ReplayAt copies into p the bytes held starting back bytes before the end
+// of the buffer, and returns their number. back must not exceed Len.
+func (r *replayBuffer) ReplayAt(p []byte, back int) int {
+	want := min(len(p), back)
+	i := (r.start + r.n - back) % len(r.buf)
+	c := copy(p[:want], r.buf[i:])
+	c += copy(p[c:want], r.buf)
+	return c
+}
@@ -0,0 +1,89 @@
+package fsfuse
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Request describes the FUSE request being served. It is attached to the
+// context passed to the backend, so that backends can log with the same
+// correlation attributes as fsfuse itself.
+type Request struct {
+	// ID identifies the request within the process.
+	ID uint64
+	// Op is the name of the operation, as in LogPolicy.
+	Op string
+	// Caller is the process which issued the request, if known.
+	Caller *fuse.Caller
+	// Ino is the inode number of the node the request is about.
+	Ino uint64
+	// Handle identifies the file handle the request is about, if any.
+	Handle uint64
+	// Start is the time the request started being served.
+	Start time.Time
+}
+
+type requestKey struct{}
+
+// lastRequestID and lastHandleID are the most recently assigned request and
+// file handle IDs.
+var lastRequestID, lastHandleID atomic.Uint64
+
+// RequestFromContext returns the Request served with ctx, if any.
+func RequestFromContext(ctx context.Context) (*Request, bool) {
+	r, ok := ctx.Value(requestKey{}).(*Request)
+	return r, ok
+}
+
+// LogValue implements slog.LogValuer, so that a Request can be logged as a
+// group of attributes, e.g. with slog.Any("request", r). The duration is the
+// time elapsed since the request started.
+func (r *Request) LogValue() slog.Value {
+	attrs := make([]slog.Attr, 0, 8)
+	attrs = append(attrs,
+		slog.Uint64("id", r.ID),
+		slog.String("op", r.Op),
+	)
+	if r.Caller != nil {
+		attrs = append(attrs,
+			slog.Uint64("pid", uint64(r.Caller.Pid)),
+			slog.Uint64("uid", uint64(r.Caller.Uid)),
+			slog.Uint64("gid", uint64(r.Caller.Gid)),
+		)
+	}
+	attrs = append(attrs, slog.Uint64("ino", r.Ino))
+	if r.Handle != 0 {
+		attrs = append(attrs, slog.Uint64("handle", r.Handle))
+	}
+	attrs = append(attrs, slog.Duration("duration", time.Since(r.Start)))
+	return slog.GroupValue(attrs...)
+}
+
+// newRequest attaches a new Request for the operation op to ctx.
+func newRequest(ctx context.Context, op string, ino, handle uint64) context.Context {
+	r := &Request{
+		ID:     lastRequestID.Add(1),
+		Op:     op,
+		Ino:    ino,
+		Handle: handle,
+		Start:  time.Now(),
+	}
+	if caller, ok := fuse.FromContext(ctx); ok {
+		r.Caller = caller
+	}
+	return context.WithValue(ctx, requestKey{}, r)
+}
+
+// startRequest attaches a new Request for the operation op on n to ctx.
+func (n *node) startRequest(ctx context.Context, op string) context.Context {
+	return newRequest(ctx, op, n.StableAttr().Ino, 0)
+}
+
+// startRequest attaches a new Request for the operation op on fh to ctx.
+func (fh *fileHandle) startRequest(ctx context.Context, op string) context.Context {
+	return newRequest(ctx, op, fh.node.StableAttr().Ino, fh.id)
+}
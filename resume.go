@@ -0,0 +1,156 @@
+package fsfuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"github.com/gwangyi/fsx/contextual"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// ResumeReads recovers reads of files opened read-only which fail, as when a
+// network backend drops its connection: the file is reopened, positioned
+// where the broken one was by seeking or by discarding data unless it can be
+// read at an offset, and the read is retried, up to attempts times per read.
+//
+// The reopened file must have the size and modification time the file had
+// when it was opened; otherwise the read fails with ESTALE rather than mix
+// the contents of two versions. Zero, the default, disables resuming.
+func ResumeReads(attempts int) Option {
+	return func(c *config) {
+		c.resumeAttempts = max(attempts, 0)
+	}
+}
+
+// errFileChanged reports that a file changed before it could be reopened.
+var errFileChanged = fmt.Errorf("file changed since it was opened: %w", syscall.ESTALE)
+
+// resumeReads lets fh reopen its file, which has just been opened with flags
+// and had the attributes fi, if ResumeReads applies.
+func (fh *fileHandle) resumeReads(flags uint32, fi fs.FileInfo) {
+	if fh.cfg.resumeAttempts == 0 || flags&syscall.O_ACCMODE != syscall.O_RDONLY || fi == nil {
+		return
+	}
+	fh.origin = fi
+}
+
+// resume retries a read at off which failed with errno, reopening the file
+// before each attempt. fh.mu must be held.
+func (fh *fileHandle) resume(ctx context.Context, dest []byte, off int64, errno syscall.Errno) (fuse.ReadResult, syscall.Errno) {
+	var res fuse.ReadResult
+	for attempt := 1; attempt <= fh.cfg.resumeAttempts; attempt++ {
+		// Reads which cannot succeed, or are no longer awaited, are not
+		// retried.
+		if errno == 0 || errno == syscall.ENOSYS || ctx.Err() != nil {
+			break
+		}
+		if err := fh.reopen(ctx, off); err != nil {
+			errno = fh.fail(ctx, "Read", "Reopen failed", err, "path", fh.node.path, "attempt", attempt)
+			if errors.Is(err, errFileChanged) {
+				break
+			}
+			continue
+		}
+		res, errno = fh.readAgain(ctx, dest, off)
+	}
+	return res, errno
+}
+
+// readAgain reads at off from a reopened file. fh.mu must be held.
+func (fh *fileHandle) readAgain(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if !fh.readerAt || fh.noReadAt.Load() {
+		return fh.readPosition(ctx, dest, off)
+	}
+	n, err := fh.readAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, fh.fail(ctx, "Read", "ReadAt failed", err, "offset", off)
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+// reopen replaces the file with a new one opened from the path of the node
+// and, unless it is read at an offset, positioned at the current offset, or
+// at off if it is before. fh.mu must be held.
+func (fh *fileHandle) reopen(ctx context.Context, off int64) error {
+	n := fh.node
+	f, err := contextual.OpenFile(ctx, n.fsys, n.path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err == nil && (fi.Size() != fh.origin.Size() || !fi.ModTime().Equal(fh.origin.ModTime())) {
+		err = errFileChanged
+	}
+	if _, ok := f.(io.ReaderAt); err == nil && ok != fh.readerAt {
+		err = errFileChanged
+	}
+	if err == nil && !fh.readerAt && off < fh.offset {
+		// The data before the offset is read again, so the replay buffer
+		// would no longer end at it.
+		fh.offset = off
+		if fh.replay != nil {
+			fh.replay.Reset()
+		}
+	}
+	if err == nil && !fh.readerAt {
+		err = position(ctx, f, fh.offset)
+	}
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	fh.fmu.Lock()
+	old := fh.f
+	fh.f = f
+	fh.fmu.Unlock()
+	_ = old.Close()
+	if fh.readahead != nil {
+		// Prefetched data may have been read from the broken file.
+		fh.readahead.invalidate()
+	}
+	return nil
+}
+
+// position moves the position of the newly opened file f to off, by seeking
+// or by discarding the data before it.
+func position(ctx context.Context, f contextual.File, off int64) error {
+	if s, ok := f.(io.Seeker); ok {
+		_, err := s.Seek(off, io.SeekStart)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	}
+	for off > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := io.CopyN(io.Discard, f, min(off, 1<<20))
+		off -= n
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stat returns the attributes of the open file. Handles which may reopen
+// their file take mu, as the file may be replaced. The stream of spooled
+// handles is being read by the copy, so it is not asked.
+func (fh *fileHandle) stat() (fs.FileInfo, error) {
+	if fh.spool != nil {
+		return nil, errors.ErrUnsupported
+	}
+	if fh.origin != nil {
+		fh.mu.Lock()
+		defer fh.mu.Unlock()
+	}
+	return fh.f.Stat()
+}
@@ -0,0 +1,183 @@
+package fsfuse
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gwangyi/fsx/contextual"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// spoolChunk is the size of the reads copying a stream into its spool.
+const spoolChunk = 128 << 10
+
+// spoolStopGrace is how long releasing a spooled handle waits for the read
+// of the copy in progress to return before closing the stream under it.
+const spoolStopGrace = 200 * time.Millisecond
+
+// SpoolReads makes handles opened read-only on streams, i.e. files which can
+// neither be read at an offset nor seeked such as streamed blobs, copy the
+// stream into a temporary file in dir in the background. An empty dir means
+// os.TempDir(). Reads at any offset are then served from the temporary file,
+// waiting only until the data they need has arrived, so that random access
+// and mmap work on such files.
+//
+// The copy starts when the file is opened and stops when it is released, so
+// the whole stream is read unless the handle is released early. A stream
+// whose read stalls is closed under it shortly after the release.
+func SpoolReads(dir string) Option {
+	return func(c *config) {
+		c.spoolReads = true
+		c.spoolDir = dir
+	}
+}
+
+// spool is the local copy of a stream being read through a spooled handle.
+type spool struct {
+	// tmp holds the data read so far. It is unlinked on creation.
+	tmp *os.File
+
+	mu sync.Mutex
+	// size is the number of bytes copied.
+	size int64
+	// arrived is closed and replaced whenever data arrives or the copy ends.
+	arrived chan struct{}
+	// done is set when the copy has ended, with err if it failed.
+	done bool
+	err  error
+	// stopped asks the copy to end.
+	stopped bool
+	// exited is closed when the copy has returned and no longer uses the
+	// stream or tmp.
+	exited chan struct{}
+}
+
+// isReadStream reports whether f supports neither reading at an offset nor
+// seeking.
+func isReadStream(f contextual.File) bool {
+	_, readerAt := f.(io.ReaderAt)
+	_, seeker := f.(io.Seeker)
+	return !readerAt && !seeker
+}
+
+// newTempFile creates an unlinked temporary file in dir. The open file is
+// all that is needed, and nothing is left behind if the process dies.
+func newTempFile(dir string) (*os.File, error) {
+	tmp, err := os.CreateTemp(dir, "fsfuse-*")
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Remove(tmp.Name())
+	return tmp, nil
+}
+
+// spoolReads starts spooling for fh, which has just been opened with flags,
+// if SpoolReads applies.
+func (n *node) spoolReads(ctx context.Context, fh *fileHandle, flags uint32) syscall.Errno {
+	if !n.cfg.spoolReads || flags&syscall.O_ACCMODE != syscall.O_RDONLY || !isReadStream(fh.f) {
+		return 0
+	}
+	tmp, err := newTempFile(n.cfg.spoolDir)
+	if err != nil {
+		return n.fail(ctx, "Open", "Spooling: creating temporary file failed", err, "path", n.path)
+	}
+	sp := &spool{tmp: tmp, arrived: make(chan struct{}), exited: make(chan struct{})}
+	fh.spool = sp
+	go sp.copy(fh.f)
+	return 0
+}
+
+// copy copies the stream f into the spool until it ends, fails or the spool
+// is stopped.
+func (sp *spool) copy(f contextual.File) {
+	defer close(sp.exited)
+	buf := make([]byte, spoolChunk)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			// Only this goroutine changes size, so it may read it
+			// without locking.
+			if _, werr := sp.tmp.WriteAt(buf[:n], sp.size); werr != nil {
+				n, err = 0, werr
+			}
+		}
+
+		sp.mu.Lock()
+		sp.size += int64(n)
+		if err != nil || sp.stopped {
+			sp.done = true
+			if err != io.EOF {
+				sp.err = err
+			}
+		}
+		done := sp.done
+		close(sp.arrived)
+		sp.arrived = make(chan struct{})
+		sp.mu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+// wait waits until the spool holds the data up to end, or the copy has
+// ended. It fails if ctx is canceled, or if the copy failed before reaching
+// end.
+func (sp *spool) wait(ctx context.Context, end int64) error {
+	for {
+		sp.mu.Lock()
+		size, done, err, arrived := sp.size, sp.done, sp.err, sp.arrived
+		sp.mu.Unlock()
+		switch {
+		case size >= end:
+			return nil
+		case done:
+			return err
+		}
+		select {
+		case <-arrived:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// stop asks the copy to end, closes the stream f and releases the spooled
+// data. The copy ends at the latest when the read in progress returns. If it
+// has not returned within spoolStopGrace, as on a stalled network stream,
+// the stream is closed under it to unblock it, and the spooled data is
+// released once it has returned.
+func (sp *spool) stop(f contextual.File) error {
+	sp.mu.Lock()
+	sp.stopped = true
+	sp.mu.Unlock()
+	select {
+	case <-sp.exited:
+		_ = sp.tmp.Close()
+		return f.Close()
+	case <-time.After(spoolStopGrace):
+	}
+	err := f.Close()
+	go func() {
+		<-sp.exited
+		_ = sp.tmp.Close()
+	}()
+	return err
+}
+
+// readSpooled reads from the spool, waiting for the data to arrive.
+func (fh *fileHandle) readSpooled(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	sp := fh.spool
+	if err := sp.wait(ctx, off+int64(len(dest))); err != nil {
+		return nil, fh.fail(ctx, "Read", "Spooling: read failed", err, "offset", off)
+	}
+	n, err := sp.tmp.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, fh.fail(ctx, "Read", "Spooling: read failed", err, "offset", off)
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
@@ -0,0 +1,215 @@
+package fsfuse
+
+import (
+	"context"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/gwangyi/fsx/contextual"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// StageWrites makes handles opened for writing on streams, i.e. files which
+// can neither be written at an offset nor seeked such as uploads to object
+// stores, write to a temporary file in dir instead. An empty dir means
+// os.TempDir(). Staged handles support writes at any offset, truncation and
+// reading back what was written.
+//
+// The complete content is streamed to the backend and the backend file is
+// closed when the handle is flushed, so that close(2) reports the outcome of
+// the upload. If the handle is written to again afterwards, the file is
+// reopened and uploaded once more on the next flush or on release.
+//
+// Unless the file is created or truncated on open, its current content is
+// first copied from the backend, so that it is preserved by the upload, and
+// it is only uploaded once modified.
+func StageWrites(dir string) Option {
+	return func(c *config) {
+		c.stageWrites = true
+		c.stageDir = dir
+	}
+}
+
+// stage is the local copy of a file being written through a staged handle.
+type stage struct {
+	// tmp holds the content. It is unlinked on creation.
+	tmp  *os.File
+	size int64
+	// fi are the attributes of the file on open, if known.
+	fi iofs.FileInfo
+	// mtime is the time of the last modification.
+	mtime time.Time
+	// dirty is set if the content has not been uploaded since it was last
+	// modified.
+	dirty bool
+	// closed is set once the backend file has been closed by an upload.
+	closed bool
+}
+
+// isStream reports whether f supports neither writing at an offset nor
+// seeking.
+func isStream(f contextual.File) bool {
+	_, writerAt := f.(io.WriterAt)
+	_, seeker := f.(io.Seeker)
+	return !writerAt && !seeker
+}
+
+// stageWrites sets up staging for fh, which has just been opened with flags,
+// if StageWrites applies. fi are the attributes of the opened file, if known,
+// and fresh indicates that the file was just created.
+func (n *node) stageWrites(ctx context.Context, op string, fh *fileHandle, flags uint32, fi iofs.FileInfo, fresh bool) syscall.Errno {
+	if !n.cfg.stageWrites || flags&syscall.O_ACCMODE == syscall.O_RDONLY || !isStream(fh.f) {
+		return 0
+	}
+	tmp, err := newTempFile(n.cfg.stageDir)
+	if err != nil {
+		return n.fail(ctx, op, "Staging: creating temporary file failed", err, "path", n.path)
+	}
+
+	// Created and truncated files are uploaded even if never written, as
+	// the backend file is empty; others only once modified.
+	truncated := fresh || flags&syscall.O_TRUNC != 0
+	st := &stage{tmp: tmp, fi: fi, mtime: time.Now(), dirty: truncated}
+	if !truncated && (fi == nil || fi.Size() > 0) {
+		if err := st.fill(ctx, n); err != nil {
+			_ = tmp.Close()
+			return n.fail(ctx, op, "Staging: copying content failed", err, "path", n.path)
+		}
+	}
+	fh.stage = st
+	n.staged.Store(fh)
+	if fh.wb != nil {
+		// The staged content is written in one go anyway.
+		n.removeWriter(fh)
+		fh.wb = nil
+	}
+	return 0
+}
+
+// fill copies the current content of the file of n from the backend.
+func (st *stage) fill(ctx context.Context, n *node) error {
+	f, err := contextual.OpenFile(ctx, n.fsys, n.path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	st.size, err = io.Copy(st.tmp, f)
+	return err
+}
+
+// readStaged reads from the staged content. It does not need fh.mu.
+func (fh *fileHandle) readStaged(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := fh.stage.tmp.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, fh.fail(ctx, "Read", "Staging: read failed", err, "offset", off)
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+// writeStaged writes to the staged content. fh.mu must be held.
+func (fh *fileHandle) writeStaged(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	st := fh.stage
+	if fh.flags&syscall.O_APPEND != 0 {
+		off = st.size
+	}
+	n, err := st.tmp.WriteAt(data, off)
+	if n > 0 {
+		st.size = max(st.size, off+int64(n))
+		st.mtime = time.Now()
+		st.dirty = true
+	}
+	if err != nil {
+		return uint32(n), fh.fail(ctx, "Write", "Staging: write failed", err, "offset", off)
+	}
+	return uint32(n), 0
+}
+
+// truncateStaged truncates the staged content.
+func (fh *fileHandle) truncateStaged(ctx context.Context, size int64) syscall.Errno {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	st := fh.stage
+	if err := st.tmp.Truncate(size); err != nil {
+		return fh.fail(ctx, "Setattr", "Staging: truncate failed", err, "size", size)
+	}
+	st.size = size
+	st.mtime = time.Now()
+	st.dirty = true
+	return 0
+}
+
+// stagedAttr fills out with the attributes of the file, with the size and
+// modification time of the staged content.
+func (fh *fileHandle) stagedAttr(ctx context.Context, out *fuse.Attr) syscall.Errno {
+	fh.mu.Lock()
+	fi, size, mtime := fh.stage.fi, fh.stage.size, fh.stage.mtime
+	fh.mu.Unlock()
+
+	n := fh.node
+	if fi == nil {
+		var err error
+		if fi, err = contextual.Lstat(ctx, n.fsys, n.path); err != nil {
+			return n.fail(ctx, "Getattr", "Getattr failed", err, "path", n.path)
+		}
+	}
+	n.fillAttr(ctx, fi, out)
+	out.Size = uint64(size)
+	out.Blocks = (out.Size + 511) / 512
+	out.SetTimes(nil, &mtime, nil)
+	return 0
+}
+
+// upload streams the staged content to the backend if it has been modified
+// since the last upload, and closes the backend file so that the backend can
+// complete the upload. fh.mu must be held.
+func (fh *fileHandle) upload(ctx context.Context) error {
+	st := fh.stage
+	if !st.dirty {
+		return nil
+	}
+	if st.closed {
+		f, err := contextual.OpenFile(ctx, fh.node.fsys, fh.node.path, os.O_WRONLY|os.O_TRUNC, 0)
+		if err != nil {
+			return err
+		}
+		fh.f, st.closed = f, false
+	}
+
+	var err error
+	if w, ok := fh.f.(io.Writer); ok {
+		_, err = io.Copy(w, io.NewSectionReader(st.tmp, 0, st.size))
+	} else {
+		err = errors.ErrUnsupported
+	}
+	cerr := fh.f.Close()
+	st.closed = true
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		st.dirty = false
+	}
+	return err
+}
+
+// releaseStaged uploads the staged content if needed and releases the
+// backend file and the staged content. It reports the first error.
+func (fh *fileHandle) releaseStaged(ctx context.Context) error {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	st := fh.stage
+	err := fh.upload(ctx)
+	if !st.closed {
+		if cerr := fh.f.Close(); err == nil {
+			err = cerr
+		}
+		st.closed = true
+	}
+	_ = st.tmp.Close()
+	fh.node.staged.CompareAndSwap(fh, nil)
+	return err
+}
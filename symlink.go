@@ -0,0 +1,218 @@
+package fsfuse
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/gwangyi/fsx/contextual"
+)
+
+// SymlinkPolicy decides how symbolic links stored in the backend are
+// presented through the mount.
+type SymlinkPolicy int
+
+const (
+	// SymlinkDefault is SymlinkRejectEscaping if Subtree is given, and
+	// SymlinkPassThrough otherwise.
+	SymlinkDefault SymlinkPolicy = iota
+	// SymlinkPassThrough passes link targets verbatim in both directions.
+	SymlinkPassThrough
+	// SymlinkRewriteAbsolute takes absolute targets stored in the backend as
+	// relative to the root of the mount, and presents them as relative
+	// targets, so that they work wherever the filesystem is mounted.
+	// New links are stored verbatim.
+	SymlinkRewriteAbsolute
+	// SymlinkRejectEscaping refuses to create or read links whose target is
+	// absolute or climbs above the root of the mount, with EPERM.
+	SymlinkRejectEscaping
+	// SymlinkFollow presents symbolic links as the entries they point to,
+	// resolving them within the mount. Links which are dangling, loop or
+	// point outside of the mount are left out. New links may only point
+	// within the mount.
+	SymlinkFollow
+)
+
+// maxSymlinkHops bounds the number of links followed while resolving a path,
+// as MAXSYMLINKS does for the kernel.
+const maxSymlinkHops = 40
+
+// errEscapes is returned when resolving a link leads outside of the mount.
+var errEscapes = fmt.Errorf("%w: symbolic link points outside of the mount", fs.ErrNotExist)
+
+// Symlinks sets the policy for symbolic links.
+func Symlinks(p SymlinkPolicy) Option {
+	return func(c *config) {
+		c.symlinks = p
+	}
+}
+
+// symlinkPolicy returns the effective SymlinkPolicy.
+func (c *config) symlinkPolicy() SymlinkPolicy {
+	if c.symlinks != SymlinkDefault {
+		return c.symlinks
+	}
+	if c.confined() {
+		return SymlinkRejectEscaping
+	}
+	return SymlinkPassThrough
+}
+
+// confined reports whether the mount is a subtree of the backend, which
+// symbolic links must not leave by default.
+func (c *config) confined() bool {
+	return c.root != "."
+}
+
+// mountPath converts a backend path into the corresponding path relative to
+// the root of the mount.
+func (c *config) mountPath(p string) string {
+	if c.root == "." {
+		return p
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(p, c.root), "/")
+	if rel == "" {
+		return "."
+	}
+	return rel
+}
+
+// escapes reports whether the target of a symbolic link located at the
+// backend path linkPath points outside of the mount.
+// Absolute targets are always considered escaping, as nothing is known
+// about the place where the filesystem is mounted.
+func (c *config) escapes(linkPath, target string) bool {
+	if path.IsAbs(target) {
+		return true
+	}
+	resolved := path.Join(path.Dir(c.mountPath(linkPath)), target)
+	return resolved == ".." || strings.HasPrefix(resolved, "../")
+}
+
+// newLinkTarget checks the target of a link about to be created at the
+// backend path linkPath against the SymlinkPolicy.
+func (c *config) newLinkTarget(linkPath, target string) syscall.Errno {
+	switch c.symlinkPolicy() {
+	case SymlinkRejectEscaping, SymlinkFollow:
+		if c.escapes(linkPath, target) {
+			return syscall.EPERM
+		}
+	case SymlinkRewriteAbsolute:
+		if c.confined() && !path.IsAbs(target) && c.escapes(linkPath, target) {
+			return syscall.EPERM
+		}
+	}
+	return 0
+}
+
+// linkTarget converts the target of the link at the backend path linkPath,
+// as stored in the backend, into the one presented to the kernel.
+func (c *config) linkTarget(linkPath, target string) (string, syscall.Errno) {
+	switch c.symlinkPolicy() {
+	case SymlinkRejectEscaping:
+		if c.escapes(linkPath, target) {
+			return "", syscall.EPERM
+		}
+	case SymlinkRewriteAbsolute:
+		if path.IsAbs(target) {
+			return relPath(path.Dir(c.mountPath(linkPath)), strings.TrimPrefix(path.Clean(target), "/")), 0
+		}
+		if c.confined() && c.escapes(linkPath, target) {
+			return "", syscall.EPERM
+		}
+	}
+	return target, 0
+}
+
+// relPath returns the relative path leading from the directory from to to.
+// Both are clean slash-separated paths relative to the same root.
+func relPath(from, to string) string {
+	split := func(p string) []string {
+		if p == "." || p == "" {
+			return nil
+		}
+		return strings.Split(p, "/")
+	}
+	fromParts, toParts := split(from), split(to)
+	common := 0
+	for common < len(fromParts) && common < len(toParts) && fromParts[common] == toParts[common] {
+		common++
+	}
+	parts := make([]string, 0, len(fromParts)-common+len(toParts)-common)
+	for range fromParts[common:] {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, toParts[common:]...)
+	if len(parts) == 0 {
+		return "."
+	}
+	return path.Join(parts...)
+}
+
+// resolve follows the symbolic links of the entry name of the directory n,
+// one path component at a time, without leaving the mount.
+// The path of n itself is known to be free of links. It returns the backend
+// path of the final entry along with its attributes.
+func (n *node) resolve(ctx context.Context, name string) (string, fs.FileInfo, error) {
+	var resolved []string
+	if rel := n.cfg.mountPath(n.path); rel != "." {
+		resolved = strings.Split(rel, "/")
+	}
+	pending := []string{name}
+	hops := 0
+	var fi fs.FileInfo
+	for len(pending) > 0 {
+		comp := pending[0]
+		pending = pending[1:]
+		switch comp {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return "", nil, errEscapes
+			}
+			resolved = resolved[:len(resolved)-1]
+			fi = nil
+			continue
+		}
+
+		cur := path.Join(n.cfg.root, path.Join(resolved...), comp)
+		if n.cfg.hidden(cur) {
+			return "", nil, fs.ErrNotExist
+		}
+		var err error
+		fi, err = contextual.Lstat(ctx, n.fsys, cur)
+		if err != nil {
+			return "", nil, err
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			resolved = append(resolved, comp)
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", nil, syscall.ELOOP
+		}
+		target, err := contextual.ReadLink(ctx, n.fsys, cur)
+		if err != nil {
+			return "", nil, err
+		}
+		if path.IsAbs(target) {
+			return "", nil, errEscapes
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+
+	final := path.Join(n.cfg.root, path.Join(resolved...))
+	if fi == nil {
+		var err error
+		if fi, err = contextual.Lstat(ctx, n.fsys, final); err != nil {
+			return "", nil, err
+		}
+	}
+	return final, fi, nil
+}
@@ -1,10 +1,12 @@
 package fsfuse
 
 import (
+	"context"
 	"errors"
 	"io/fs"
-	"os/user"
-	"strconv"
+	"os"
+	"path"
+	"strings"
 	"syscall"
 
 	"github.com/gwangyi/fsx"
@@ -12,12 +14,13 @@ import (
 )
 
 // toErrno converts a standard Go error into a syscall.Errno.
-// It handles common errors from io/fs and syscall, mapping them to appropriate
-// FUSE-compatible error codes.
+// It handles common errors from io/fs, fsx, context and syscall, mapping them
+// to appropriate FUSE-compatible error codes.
 //
-// If the error matches specific fs.Err* errors, it returns the corresponding
-// syscall error (e.g., fs.ErrNotExist -> syscall.ENOENT).
 // If the error can be unwrapped to a syscall.Errno, it is returned directly.
+// If the error matches specific fs.Err* or fsx.Err* errors, it returns the
+// corresponding syscall error (e.g., fs.ErrNotExist -> syscall.ENOENT).
+// Context cancellation maps to EINTR and timeouts to ETIMEDOUT.
 // For unknown errors, it defaults to syscall.EIO to indicate a generic I/O error.
 func toErrno(err error) syscall.Errno {
 	if err == nil {
@@ -27,22 +30,97 @@ func toErrno(err error) syscall.Errno {
 	if errors.As(err, &errno) {
 		return errno
 	}
-	if errors.Is(err, fs.ErrNotExist) {
-		return syscall.ENOENT
+	for _, m := range sentinelErrnos {
+		if errors.Is(err, m.err) {
+			return m.errno
+		}
+	}
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return syscall.ETIMEDOUT
 	}
-	if errors.Is(err, fs.ErrPermission) {
-		return syscall.EPERM
+	return syscall.EIO
+}
+
+// sentinelErrnos maps well-known sentinel errors to errnos.
+// It is ordered; the first match wins.
+var sentinelErrnos = []struct {
+	err   error
+	errno syscall.Errno
+}{
+	{fs.ErrNotExist, syscall.ENOENT},
+	{fs.ErrPermission, syscall.EPERM},
+	{fs.ErrInvalid, syscall.EINVAL},
+	{fs.ErrExist, syscall.EEXIST},
+	{fs.ErrClosed, syscall.EBADF},
+	{fsx.ErrNotEmpty, syscall.ENOTEMPTY},
+	{fsx.ErrNotDir, syscall.ENOTDIR},
+	{fsx.ErrIsDir, syscall.EISDIR},
+	{errors.ErrUnsupported, syscall.ENOSYS},
+	{context.Canceled, syscall.EINTR},
+	{context.DeadlineExceeded, syscall.ETIMEDOUT},
+	{os.ErrDeadlineExceeded, syscall.ETIMEDOUT},
+}
+
+// messageErrnos lists errnos which are recognized by their description by
+// MessageErrors.
+var messageErrnos = []syscall.Errno{
+	syscall.ENOTEMPTY,
+	syscall.ENOTDIR,
+	syscall.EISDIR,
+	syscall.EXDEV,
+	syscall.ENOSPC,
+	syscall.EDQUOT,
+	syscall.EROFS,
+	syscall.ENAMETOOLONG,
+	syscall.ETIMEDOUT,
+	syscall.EMLINK,
+	syscall.EFBIG,
+	syscall.ETXTBSY,
+	syscall.EBUSY,
+	syscall.ELOOP,
+}
+
+// errnoFromMessage looks for an error in the chain of err whose message is
+// the description of one of messageErrnos.
+// This covers e.g. *fs.PathError wrapping errors.New("directory not empty").
+func errnoFromMessage(err error) (syscall.Errno, bool) {
+	if err == nil {
+		return 0, false
 	}
-	if errors.Is(err, fs.ErrInvalid) {
-		return syscall.EINVAL
+	msg := err.Error()
+	for _, errno := range messageErrnos {
+		if msg == errno.Error() {
+			return errno, true
+		}
 	}
-	if errors.Is(err, fs.ErrExist) {
-		return syscall.EEXIST
+	switch x := err.(type) {
+	case interface{ Unwrap() error }:
+		return errnoFromMessage(x.Unwrap())
+	case interface{ Unwrap() []error }:
+		for _, err := range x.Unwrap() {
+			if errno, ok := errnoFromMessage(err); ok {
+				return errno, true
+			}
+		}
 	}
-	if errors.Is(err, errors.ErrUnsupported) {
-		return syscall.ENOSYS
+	return 0, false
+}
+
+// matchPath reports whether p matches any of the given glob patterns.
+// Patterns containing a slash are matched against the whole path,
+// others against its base name only. Malformed patterns never match.
+func matchPath(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		target := path.Base(p)
+		if strings.Contains(pattern, "/") {
+			target = p
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
 	}
-	return syscall.EIO
+	return false
 }
 
 // fillFromXFI populates the FUSE attributes from an fsx.FileInfo object.
@@ -62,20 +140,11 @@ func fillFromXFI(xfi fsx.FileInfo, out *fuse.Attr) {
 	out.Ctime = uint64(ct.Unix())
 	out.Ctimensec = uint32(ct.Nanosecond())
 
-	if uid, err := strconv.Atoi(xfi.Owner()); err == nil {
-		out.Uid = uint32(uid)
-	} else if u, err := user.Lookup(xfi.Owner()); err == nil {
-		if uid, err := strconv.Atoi(u.Uid); err == nil {
-			out.Uid = uint32(uid)
-		}
+	if uid, ok := lookupUID(xfi.Owner()); ok {
+		out.Uid = uid
 	}
-
-	if gid, err := strconv.Atoi(xfi.Group()); err == nil {
-		out.Gid = uint32(gid)
-	} else if g, err := user.LookupGroup(xfi.Group()); err == nil {
-		if gid, err := strconv.Atoi(g.Gid); err == nil {
-			out.Gid = uint32(gid)
-		}
+	if gid, ok := lookupGID(xfi.Group()); ok {
+		out.Gid = gid
 	}
 }
 
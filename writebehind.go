@@ -0,0 +1,157 @@
+package fsfuse
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// WriteBehind buffers up to size bytes of writes per handle, coalescing
+// adjacent writes into one backend write. The buffer is written when a write
+// is not adjacent to it or would overflow it, when it is full, when the file
+// is read through the handle or truncated, and on flush, fsync and release.
+//
+// Sizes reported by Getattr include the buffered data. Errors writing the
+// buffer outside of a write, flush or fsync are reported by the next one of
+// these, so that they reach the application at the latest from close(2).
+// Zero, the default, disables buffering.
+func WriteBehind(size int) Option {
+	return func(c *config) {
+		c.writeBehind = max(size, 0)
+	}
+}
+
+// writeBuffer holds the buffered writes of a handle.
+type writeBuffer struct {
+	// off is the offset of data in the file.
+	off  int64
+	data []byte
+	// errno is the failure of a write of the buffer which is yet to be
+	// reported.
+	errno syscall.Errno
+}
+
+// end returns the offset following the buffered data, or 0 if there is none.
+func (wb *writeBuffer) end() int64 {
+	if len(wb.data) == 0 {
+		return 0
+	}
+	return wb.off + int64(len(wb.data))
+}
+
+// writeBehind buffers data to be written at off. fh.mu must be held.
+func (fh *fileHandle) writeBehind(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	wb, size := fh.wb, fh.cfg.writeBehind
+	if errno := wb.errno; errno != 0 {
+		wb.errno = 0
+		return 0, errno
+	}
+	if len(wb.data) > 0 && (off != wb.end() || len(wb.data)+len(data) > size) {
+		if errno := fh.flushBuffer(ctx); errno != 0 {
+			return 0, errno
+		}
+	}
+	if len(data) >= size {
+		return fh.writeBackend(ctx, data, off)
+	}
+
+	if len(wb.data) == 0 {
+		wb.off = off
+	}
+	wb.data = append(wb.data, data...)
+	if len(wb.data) >= size {
+		// The data is accepted; a failure is reported later.
+		wb.errno = fh.flushBuffer(ctx)
+	}
+	return uint32(len(data)), 0
+}
+
+// flushBuffer writes the buffered data to the backend. The data is dropped
+// even if the write fails. Prefetched data, which may predate the write, is
+// dropped as well. fh.mu must be held.
+func (fh *fileHandle) flushBuffer(ctx context.Context) syscall.Errno {
+	wb := fh.wb
+	if len(wb.data) == 0 {
+		return 0
+	}
+	_, errno := fh.writeBackend(ctx, wb.data, wb.off)
+	wb.data = wb.data[:0]
+	if fh.readahead != nil {
+		fh.readahead.invalidate()
+	}
+	return errno
+}
+
+// flushWrites writes the buffered data and reports any failure which is yet
+// to be reported. fh.mu must be held.
+func (fh *fileHandle) flushWrites(ctx context.Context) syscall.Errno {
+	errno := fh.flushBuffer(ctx)
+	if errno == 0 {
+		errno = fh.wb.errno
+	}
+	fh.wb.errno = 0
+	return errno
+}
+
+// flushDeferred writes the buffered data, leaving a failure to be reported
+// later. fh.mu must be held.
+func (fh *fileHandle) flushDeferred(ctx context.Context) {
+	if errno := fh.flushBuffer(ctx); errno != 0 && fh.wb.errno == 0 {
+		fh.wb.errno = errno
+	}
+}
+
+// flushOverlapping writes the buffered data if it overlaps the size bytes at
+// off, so that reading them returns it. fh.mu must be held.
+func (fh *fileHandle) flushOverlapping(ctx context.Context, off, size int64) {
+	if len(fh.wb.data) > 0 && off < fh.wb.end() && off+size > fh.wb.off {
+		fh.flushDeferred(ctx)
+	}
+}
+
+// addWriter registers a handle buffering writes to the file of n.
+func (n *node) addWriter(fh *fileHandle) {
+	n.writersMu.Lock()
+	defer n.writersMu.Unlock()
+	if n.writers == nil {
+		n.writers = make(map[*fileHandle]struct{})
+	}
+	n.writers[fh] = struct{}{}
+}
+
+// removeWriter unregisters a handle registered by addWriter.
+func (n *node) removeWriter(fh *fileHandle) {
+	n.writersMu.Lock()
+	defer n.writersMu.Unlock()
+	delete(n.writers, fh)
+}
+
+// addBuffered extends the size in out to cover the data buffered by the
+// handles writing to the file of n.
+func (n *node) addBuffered(out *fuse.Attr) {
+	n.writersMu.Lock()
+	defer n.writersMu.Unlock()
+	for fh := range n.writers {
+		fh.mu.Lock()
+		end := fh.wb.end()
+		fh.mu.Unlock()
+		if uint64(end) > out.Size {
+			out.Size = uint64(end)
+			out.Blocks = (out.Size + 511) / 512
+		}
+	}
+}
+
+// flushWriters writes the data buffered by the handles writing to the file
+// of n, e.g. before it is truncated. Failures are reported later by the
+// handles.
+func (n *node) flushWriters(ctx context.Context) {
+	n.writersMu.Lock()
+	defer n.writersMu.Unlock()
+	for fh := range n.writers {
+		fh.mu.Lock()
+		fh.flushDeferred(ctx)
+		fh.mu.Unlock()
+	}
+}